@@ -0,0 +1,40 @@
+// Command mockexchange serves synthetic exchange data on a local port, so that the historical API can run offline
+//
+// Start it, then start the API with the -upstream flag it prints
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:8080", "address to serve the mock exchanges on")
+	failures := flag.String("fail", "", "comma separated exchange=status pairs of exchanges which answer every request with an error, e.g. gdax=503")
+	flag.Parse()
+
+	exchange := mockexchange.NewExchange()
+
+	for _, failure := range strings.Split(*failures, ",") {
+		if failure == "" {
+			continue
+		}
+		parts := strings.SplitN(failure, "=", 2)
+		if len(parts) != 2 {
+			log.Fatal("Please provide -fail as exchange=status; ", failure, " is invalid")
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Fatal("Please provide -fail as exchange=status; ", failure, " is invalid")
+		}
+		exchange.Fail(parts[0], status)
+	}
+
+	log.Println(fmt.Sprintf("Serving mock exchanges on %s; start the API with -upstream %s", *listen, mockexchange.Upstreams("http://"+*listen)))
+	log.Fatal(http.ListenAndServe(*listen, exchange.Handler()))
+}
@@ -0,0 +1,418 @@
+// Package config loads the settings of the service from an optional YAML file overridden by HISTORICALAPI_
+// environment variables, and validates them before the service starts
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of every environment variable overriding the configuration file
+const ENVPREFIX = "HISTORICALAPI_"
+
+// Upstreams which take an API key
+const QUANDL = "quandl"
+
+var apiKeyNames = []string{QUANDL}
+
+// The longest the service waits for MongoDB at startup unless configured otherwise
+const defaultDialTimeout = 10 * time.Second
+
+// Config holds every setting of the service
+type Config struct {
+	// The address the API listens on, e.g. :80 or 127.0.0.1:8000
+	Listen string `yaml:"listen"`
+	Server Server `yaml:"server"`
+	Mongo  Mongo  `yaml:"mongo"`
+	// API keys by upstream; only quandl, shared by bitfinex and bitstamp, takes one so far
+	APIKeys map[string]string `yaml:"apiKeys"`
+	// Settings by exchange name; exchanges left out keep their defaults
+	Exchanges map[string]Exchange `yaml:"exchanges"`
+}
+
+// Server holds the timeouts of the HTTP server, where 0 means no timeout
+type Server struct {
+	// How long a client may take to send the headers of a request
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	// How long a client may take to send a whole request
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+	// How long a response may take from the end of its request, which also cuts off NDJSON streams; WebSockets are
+	// exempt
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// How long a kept-alive connection may wait for its next request
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// How long the requests in flight may take to finish on SIGTERM before their upstream fetches are canceled
+	ShutdownGrace time.Duration `yaml:"shutdownGrace"`
+}
+
+// Mongo holds the MongoDB settings
+type Mongo struct {
+	// The servers to dial; the service runs without MongoDB, and so without the routes needing it, if empty
+	Addrs    []string `yaml:"addrs"`
+	Database string   `yaml:"database"`
+	// The database the user authenticates against
+	AuthDatabase string `yaml:"authDatabase"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	// The longest the service waits for MongoDB at startup
+	DialTimeout time.Duration `yaml:"dialTimeout"`
+}
+
+// Exchange holds the settings of a single exchange
+type Exchange struct {
+	// Whether the exchange is served; true unless set
+	Enabled *bool `yaml:"enabled"`
+	// The base URL of the exchange API, e.g. a mirror or a local stand-in server
+	URL string `yaml:"url"`
+	// The bucket size of some intervals, e.g. DAY: 5m, which must be one the exchange serves
+	Granularities map[string]time.Duration `yaml:"granularities"`
+}
+
+// Default returns the settings of the service without a file or environment: listening on :80 without MongoDB, which
+// is opt-in, and every exchange enabled with its defaults
+func Default() *Config {
+	return &Config{
+		Listen: ":80",
+		Server: Server{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      5 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownGrace:     30 * time.Second,
+		},
+		Mongo: Mongo{
+			DialTimeout: defaultDialTimeout,
+		},
+		APIKeys:   make(map[string]string),
+		Exchanges: make(map[string]Exchange),
+	}
+}
+
+// Load reads the YAML file at path, if any, over the defaults, applies the environment overrides and validates the
+// result
+//
+// Unknown keys in the file are errors, so that a misspelled setting is not silently ignored
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	if path != datamodels.EMPTYSTRING {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the configuration file: %w", err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+
+		// Exchanges are named in lower case everywhere else
+		exchanges := make(map[string]Exchange, len(config.Exchanges))
+		for name, exchange := range config.Exchanges {
+			exchanges[strings.ToLower(name)] = exchange
+		}
+		config.Exchanges = exchanges
+	}
+
+	err := config.override(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Override the settings with the environment variables found by lookup:
+//
+// HISTORICALAPI_LISTEN, HISTORICALAPI_SERVER_READ_HEADER_TIMEOUT, HISTORICALAPI_SERVER_READ_TIMEOUT,
+// HISTORICALAPI_SERVER_WRITE_TIMEOUT, HISTORICALAPI_SERVER_IDLE_TIMEOUT, HISTORICALAPI_SERVER_SHUTDOWN_GRACE,
+// HISTORICALAPI_MONGO_ADDRS (comma separated), HISTORICALAPI_MONGO_DATABASE,
+// HISTORICALAPI_MONGO_AUTH_DATABASE, HISTORICALAPI_MONGO_USERNAME, HISTORICALAPI_MONGO_PASSWORD,
+// HISTORICALAPI_MONGO_DIAL_TIMEOUT, HISTORICALAPI_QUANDL_API_KEY, and for every exchange, e.g. kraken,
+// HISTORICALAPI_KRAKEN_ENABLED, HISTORICALAPI_KRAKEN_URL and HISTORICALAPI_KRAKEN_GRANULARITY_DAY
+func (config *Config) override(lookup func(name string) (string, bool)) error {
+	problems := make([]error, 0)
+
+	lookupString := func(name string, setting *string) {
+		if value, ok := lookup(ENVPREFIX + name); ok {
+			*setting = value
+		}
+	}
+	lookupDuration := func(name string, set func(duration time.Duration)) {
+		value, ok := lookup(ENVPREFIX + name)
+		if !ok {
+			return
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s%s: %q is not a duration such as 10s or 5m", ENVPREFIX, name, value))
+			return
+		}
+		set(duration)
+	}
+
+	lookupString("LISTEN", &config.Listen)
+	for name, setting := range config.Server.settings() {
+		setting := setting
+		lookupDuration("SERVER_"+name, func(duration time.Duration) {
+			*setting = duration
+		})
+	}
+	if addrs, ok := lookup(ENVPREFIX + "MONGO_ADDRS"); ok {
+		config.Mongo.Addrs = nil
+		if addrs != datamodels.EMPTYSTRING {
+			config.Mongo.Addrs = strings.Split(addrs, ",")
+		}
+	}
+	lookupString("MONGO_DATABASE", &config.Mongo.Database)
+	lookupString("MONGO_AUTH_DATABASE", &config.Mongo.AuthDatabase)
+	lookupString("MONGO_USERNAME", &config.Mongo.Username)
+	lookupString("MONGO_PASSWORD", &config.Mongo.Password)
+	lookupDuration("MONGO_DIAL_TIMEOUT", func(duration time.Duration) {
+		config.Mongo.DialTimeout = duration
+	})
+
+	for _, name := range apiKeyNames {
+		if key, ok := lookup(ENVPREFIX + strings.ToUpper(name) + "_API_KEY"); ok {
+			config.APIKeys[name] = key
+		}
+	}
+
+	for _, source := range datamodels.Sources() {
+		name := source.Name()
+		prefix := strings.ToUpper(name) + "_"
+		exchange := config.Exchanges[name]
+
+		if value, ok := lookup(ENVPREFIX + prefix + "ENABLED"); ok {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s%sENABLED: %q is not true or false", ENVPREFIX, prefix, value))
+			} else {
+				exchange.Enabled = &enabled
+			}
+		}
+		lookupString(prefix+"URL", &exchange.URL)
+		for _, interval := range source.Intervals() {
+			interval := interval
+			lookupDuration(prefix+"GRANULARITY_"+interval, func(duration time.Duration) {
+				if exchange.Granularities == nil {
+					exchange.Granularities = make(map[string]time.Duration)
+				}
+				exchange.Granularities[interval] = duration
+			})
+		}
+
+		config.Exchanges[name] = exchange
+	}
+
+	return errors.Join(problems...)
+}
+
+// Validate reports every invalid setting at once
+func (config *Config) Validate() error {
+	problems := make([]error, 0)
+
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		problems = append(problems, fmt.Errorf("listen: %q is not a host:port address such as :80", config.Listen))
+	}
+	timeouts := map[string]time.Duration{
+		"readHeaderTimeout": config.Server.ReadHeaderTimeout,
+		"readTimeout":       config.Server.ReadTimeout,
+		"writeTimeout":      config.Server.WriteTimeout,
+		"idleTimeout":       config.Server.IdleTimeout,
+		"shutdownGrace":     config.Server.ShutdownGrace,
+	}
+	for _, name := range sortedKeys(timeouts) {
+		if timeouts[name] < 0 {
+			problems = append(problems, fmt.Errorf("server.%s: %s is negative", name, timeouts[name]))
+		}
+	}
+
+	for _, addr := range config.Mongo.Addrs {
+		if strings.TrimSpace(addr) == datamodels.EMPTYSTRING {
+			problems = append(problems, fmt.Errorf("mongo.addrs: addresses cannot be empty"))
+		}
+	}
+	if config.Mongo.Enabled() && config.Mongo.Database == datamodels.EMPTYSTRING {
+		problems = append(problems, fmt.Errorf("mongo.database is required along with mongo.addrs"))
+	}
+	if config.Mongo.Enabled() && config.Mongo.DialTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("mongo.dialTimeout: %s is not a positive duration", config.Mongo.DialTimeout))
+	}
+
+	for _, name := range sortedKeys(config.APIKeys) {
+		if !contains(apiKeyNames, name) {
+			problems = append(problems, fmt.Errorf("apiKeys.%s: unknown upstream; only %s takes an API key", name, strings.Join(apiKeyNames, ", ")))
+		}
+	}
+
+	enabled := 0
+	for _, name := range sortedKeys(config.Exchanges) {
+		exchange := config.Exchanges[name]
+		if _, ok := datamodels.GetSource(name); !ok {
+			problems = append(problems, fmt.Errorf("exchanges.%s: unknown exchange; pick one of %s", name, strings.Join(sourceNames(), ", ")))
+			continue
+		}
+
+		if exchange.URL != datamodels.EMPTYSTRING {
+			parsed, err := url.Parse(exchange.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == datamodels.EMPTYSTRING {
+				problems = append(problems, fmt.Errorf("exchanges.%s.url: %q is not an http or https URL", name, exchange.URL))
+			}
+		}
+
+		for _, interval := range sortedKeys(exchange.Granularities) {
+			err := datamodels.CheckGranularity(name, interval, exchange.Granularities[interval])
+			if err != nil {
+				problems = append(problems, fmt.Errorf("exchanges.%s.granularities.%s: %w", name, interval, err))
+			}
+		}
+	}
+	for _, name := range sourceNames() {
+		if config.enabled(name) {
+			enabled++
+		}
+	}
+	if enabled == 0 {
+		problems = append(problems, fmt.Errorf("exchanges: every exchange is disabled"))
+	}
+
+	return errors.Join(problems...)
+}
+
+// Apply configures the exchanges: disabled exchanges are unregistered from every route, and the others get their URL,
+// granularities and API keys
+//
+// Like the setters of datamodels, it must be called before the service starts serving
+func (config *Config) Apply() error {
+	for _, name := range sourceNames() {
+		exchange := config.Exchanges[name]
+		if !config.enabled(name) {
+			err := datamodels.Unregister(name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if exchange.URL != datamodels.EMPTYSTRING {
+			err := datamodels.SetBaseURL(name, exchange.URL)
+			if err != nil {
+				return err
+			}
+		}
+		for interval, granularity := range exchange.Granularities {
+			err := datamodels.SetGranularity(name, interval, granularity)
+			if err != nil {
+				return fmt.Errorf("exchanges.%s.granularities.%s: %w", name, interval, err)
+			}
+		}
+	}
+
+	datamodels.SetQuandlAPIKey(config.APIKeys[QUANDL])
+	if config.APIKeys[QUANDL] == datamodels.EMPTYSTRING && (config.enabled("bitfinex") || config.enabled("bitstamp")) {
+		slog.Warn("Quandl requests are anonymous and get much lower limits; set apiKeys.quandl or " + ENVPREFIX + "QUANDL_API_KEY")
+	}
+	return nil
+}
+
+// HTTPServer returns the server listening on the configured address with the configured timeouts
+//
+// Every request context derives from base, so that canceling it abandons the upstream fetches in flight
+func (config *Config) HTTPServer(handler http.Handler, base context.Context) *http.Server {
+	return &http.Server{
+		Addr:              config.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return base
+		},
+	}
+}
+
+// The server settings by the suffix of their environment variable
+func (server *Server) settings() map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"READ_HEADER_TIMEOUT": &server.ReadHeaderTimeout,
+		"READ_TIMEOUT":        &server.ReadTimeout,
+		"WRITE_TIMEOUT":       &server.WriteTimeout,
+		"IDLE_TIMEOUT":        &server.IdleTimeout,
+		"SHUTDOWN_GRACE":      &server.ShutdownGrace,
+	}
+}
+
+// Enabled reports whether MongoDB is configured at all
+func (mongo Mongo) Enabled() bool {
+	return len(mongo.Addrs) > 0
+}
+
+// DialInfo returns the settings of the MongoDB session
+func (mongo Mongo) DialInfo() *mgo.DialInfo {
+	return &mgo.DialInfo{
+		Addrs:    mongo.Addrs,
+		Timeout:  mongo.DialTimeout,
+		Database: mongo.AuthDatabase,
+		Username: mongo.Username,
+		Password: mongo.Password,
+	}
+}
+
+// Whether a registered exchange is served
+func (config *Config) enabled(name string) bool {
+	if _, ok := datamodels.GetSource(name); !ok {
+		return false
+	}
+	exchange := config.Exchanges[name]
+	return exchange.Enabled == nil || *exchange.Enabled
+}
+
+// The names of every registered exchange
+func sourceNames() []string {
+	names := make([]string, 0)
+	for _, source := range datamodels.Sources() {
+		names = append(names, source.Name())
+	}
+	return names
+}
+
+func sortedKeys[V any](settings map[string]V) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
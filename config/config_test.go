@@ -0,0 +1,164 @@
+package config
+
+import (
+	"github.com/adamhei/historicalapi/datamodels"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultRunsWithoutMongo(t *testing.T) {
+	config := Default()
+
+	if config.Mongo.Enabled() || config.Mongo.Username != datamodels.EMPTYSTRING || config.Mongo.Password != datamodels.EMPTYSTRING {
+		t.Errorf("the default configuration dials MongoDB: %+v", config.Mongo)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("the default configuration is invalid: %s", err)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(config *Config) bool
+		problem string
+	}{
+		{
+			name:  "server timeout",
+			env:   map[string]string{"HISTORICALAPI_SERVER_WRITE_TIMEOUT": "90s"},
+			check: func(config *Config) bool { return config.Server.WriteTimeout == 90*time.Second },
+		},
+		{
+			name: "mongo addresses",
+			env:  map[string]string{"HISTORICALAPI_MONGO_ADDRS": "db1:27017,db2:27017", "HISTORICALAPI_MONGO_DATABASE": "prices"},
+			check: func(config *Config) bool {
+				return len(config.Mongo.Addrs) == 2 && config.Mongo.Addrs[1] == "db2:27017" && config.Mongo.Database == "prices"
+			},
+		},
+		{
+			name:  "api key",
+			env:   map[string]string{"HISTORICALAPI_QUANDL_API_KEY": "secret"},
+			check: func(config *Config) bool { return config.APIKeys[QUANDL] == "secret" },
+		},
+		{
+			name:  "exchange granularity",
+			env:   map[string]string{"HISTORICALAPI_KRAKEN_GRANULARITY_DAY": "5m"},
+			check: func(config *Config) bool { return config.Exchanges["kraken"].Granularities[datamodels.DAY] == 5*time.Minute },
+		},
+		{
+			name:    "bad duration",
+			env:     map[string]string{"HISTORICALAPI_SERVER_IDLE_TIMEOUT": "2 minutes"},
+			problem: `HISTORICALAPI_SERVER_IDLE_TIMEOUT: "2 minutes" is not a duration`,
+		},
+		{
+			name:    "bad granularity duration",
+			env:     map[string]string{"HISTORICALAPI_GDAX_GRANULARITY_DAY": "15"},
+			problem: `HISTORICALAPI_GDAX_GRANULARITY_DAY: "15" is not a duration`,
+		},
+		{
+			name:    "bad boolean",
+			env:     map[string]string{"HISTORICALAPI_KRAKEN_ENABLED": "nope"},
+			problem: `HISTORICALAPI_KRAKEN_ENABLED: "nope" is not true or false`,
+		},
+	}
+
+	for _, test := range tests {
+		config := Default()
+		err := config.override(func(name string) (string, bool) {
+			value, ok := test.env[name]
+			return value, ok
+		})
+
+		if test.problem != datamodels.EMPTYSTRING {
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("%s: override() = %v, want %q", test.name, err, test.problem)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: override() = %s", test.name, err)
+		} else if !test.check(config) {
+			t.Errorf("%s: %v was not applied", test.name, test.env)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(config *Config)
+		problem string
+	}{
+		{
+			name:    "unknown api key",
+			change:  func(config *Config) { config.APIKeys["kraken"] = "secret" },
+			problem: "apiKeys.kraken: unknown upstream; only quandl takes an API key",
+		},
+		{
+			name: "unserved granularity",
+			change: func(config *Config) {
+				config.Exchanges["kraken"] = Exchange{Granularities: map[string]time.Duration{datamodels.DAY: 7 * time.Minute}}
+			},
+			problem: "exchanges.kraken.granularities.DAY: kraken does not serve 7m0s buckets",
+		},
+		{
+			name: "too fine a granularity",
+			change: func(config *Config) {
+				config.Exchanges["binance"] = Exchange{Granularities: map[string]time.Duration{datamodels.YEAR: 8 * time.Hour}}
+			},
+			problem: "buckets of 8h0m0s, but binance serves at most 1000",
+		},
+		{
+			name:    "mongo without a database",
+			change:  func(config *Config) { config.Mongo.Addrs = []string{"localhost:27017"} },
+			problem: "mongo.database is required along with mongo.addrs",
+		},
+		{
+			name: "mongo with a database",
+			change: func(config *Config) {
+				config.Mongo.Addrs = []string{"localhost:27017"}
+				config.Mongo.Database = "prices"
+			},
+		},
+		{
+			name:    "unknown exchange",
+			change:  func(config *Config) { config.Exchanges["mtgox"] = Exchange{} },
+			problem: "exchanges.mtgox: unknown exchange",
+		},
+		{
+			name:    "negative timeout",
+			change:  func(config *Config) { config.Server.ReadTimeout = -time.Second },
+			problem: "server.readTimeout: -1s is negative",
+		},
+	}
+
+	for _, test := range tests {
+		config := Default()
+		test.change(config)
+		err := config.Validate()
+
+		if test.problem == datamodels.EMPTYSTRING && err != nil {
+			t.Errorf("%s: Validate() = %s, want nil", test.name, err)
+		}
+		if test.problem != datamodels.EMPTYSTRING && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("%s: Validate() = %v, want %q", test.name, err, test.problem)
+		}
+	}
+}
+
+// Every invalid setting is reported at once rather than only the first
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := Default()
+	config.Listen = "80"
+	config.APIKeys["gdax"] = "secret"
+	config.Mongo.Addrs = []string{"localhost:27017"}
+
+	err := config.Validate()
+	for _, problem := range []string{"listen:", "apiKeys.gdax:", "mongo.database"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Validate() = %v, want it to report %s", err, problem)
+		}
+	}
+}
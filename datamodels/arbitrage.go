@@ -0,0 +1,175 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The default percentage spread above which an arbitrage opportunity is counted
+const DefaultSpreadThreshold = 1.0
+
+// The spread between the closing prices of two exchanges at a single point in time
+type SpreadPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	PriceA    float64 `json:"priceA"`
+	PriceB    float64 `json:"priceB"`
+	// PriceA - PriceB
+	Spread float64 `json:"spread"`
+	// Spread as a percentage of PriceB
+	PercentSpread float64 `json:"percentSpread"`
+}
+
+// Summary statistics over the absolute spreads of a series
+type SpreadSummary struct {
+	Buckets           int     `json:"buckets"`
+	MaxSpread         float64 `json:"maxSpread"`
+	MaxPercentSpread  float64 `json:"maxPercentSpread"`
+	MeanSpread        float64 `json:"meanSpread"`
+	MeanPercentSpread float64 `json:"meanPercentSpread"`
+	// The percentage spread the following fields are measured against
+	Threshold             float64 `json:"threshold"`
+	BucketsAboveThreshold int     `json:"bucketsAboveThreshold"`
+	SecondsAboveThreshold int64   `json:"secondsAboveThreshold"`
+}
+
+// The spread between two exchanges over a window, newest bucket first
+type ArbitrageReport struct {
+	ExchangeA string    `json:"exchangeA"`
+	ExchangeB string    `json:"exchangeB"`
+	Pair      string    `json:"pair"`
+	Interval  string    `json:"interval"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	// Both series are resampled to buckets of this many seconds before they are compared
+	BucketSeconds int64         `json:"bucketSeconds"`
+	Summary       SpreadSummary `json:"summary"`
+	Spreads       []SpreadPoint `json:"spreads"`
+}
+
+// Given two sources and a query, fetch both series, resample them to the coarser of their granularities, align them
+// on their common timestamps and summarize the spread
+//
+// Both series are fetched at once, so the report takes about as long as the slower exchange
+// threshold is the percentage spread above which a bucket counts as an arbitrage opportunity
+func PollArbitrage(ctx context.Context, sourceA, sourceB HistoricalSource, query HistoricalQuery, threshold float64) (*ArbitrageReport, *errors.MyError) {
+	interval := query.Interval
+
+	sources := []HistoricalSource{sourceA, sourceB}
+	candles := make([][]Candle, len(sources))
+	err := fanOut(ctx, len(sources), fanOutWorkers, func(ctx context.Context, index int) *errors.MyError {
+		var myErr *errors.MyError
+		candles[index], myErr = sources[index].FetchCandles(ctx, query)
+		return myErr.From(sources[index].Name())
+	})
+	if err != nil {
+		return nil, err
+	}
+	candlesA, candlesB := candles[0], candles[1]
+
+	// Resample both series to the same buckets so that they can be compared bucket-for-bucket
+	bucket := sourceA.Granularity(interval)
+	if granularityB := sourceB.Granularity(interval); granularityB > bucket {
+		bucket = granularityB
+	}
+	candlesA = ResampleCandles(candlesA, bucket)
+	candlesB = ResampleCandles(candlesB, bucket)
+
+	spreads := alignSpreads(candlesA, candlesB)
+	if len(spreads) == 0 {
+		return nil, &errors.MyError{
+			Err:       fmt.Sprintf("%s and %s have no %s timestamps in common for %s", sourceA.Name(), sourceB.Name(), query.Pair, interval),
+			ErrorCode: http.StatusNotFound,
+		}
+	}
+
+	return &ArbitrageReport{
+		ExchangeA:     sourceA.Name(),
+		ExchangeB:     sourceB.Name(),
+		Pair:          query.Pair,
+		Interval:      interval,
+		Start:         query.Start,
+		End:           query.End,
+		BucketSeconds: int64(bucket / time.Second),
+		Summary:       summarizeSpreads(spreads, threshold, bucket),
+		Spreads:       spreads,
+	}, nil
+}
+
+// Pair up the comparable prices of both series on identical timestamps, dropping buckets only one side has
+// Returns the spreads in descending order (newest to oldest)
+func alignSpreads(candlesA []Candle, candlesB []Candle) []SpreadPoint {
+	pricesB := make(map[int64]float64, len(candlesB))
+	for _, candle := range candlesB {
+		if price := comparablePrice(candle); price != nil {
+			pricesB[candle.Timestamp] = *price
+		}
+	}
+
+	spreads := make([]SpreadPoint, 0)
+	for _, candle := range candlesA {
+		priceA := comparablePrice(candle)
+		priceB, ok := pricesB[candle.Timestamp]
+		if priceA == nil || !ok || priceB == 0 {
+			continue
+		}
+
+		spread := *priceA - priceB
+		spreads = append(spreads, SpreadPoint{
+			Timestamp:     candle.Timestamp,
+			PriceA:        *priceA,
+			PriceB:        priceB,
+			Spread:        spread,
+			PercentSpread: spread / priceB * 100,
+		})
+	}
+
+	sort.Slice(spreads, func(i, j int) bool {
+		return spreads[i].Timestamp > spreads[j].Timestamp
+	})
+
+	return spreads
+}
+
+// The price both sides of a spread are compared on: the close of a bucket, or its open for sources without a close
+//
+// Unlike the reference price, which differs by source (e.g. the low of GDAX and the VWAP of Bitstamp), this is the same
+// field on every source, so that a spread is not biased by construction
+func comparablePrice(candle Candle) *float64 {
+	if candle.Close != nil {
+		return candle.Close
+	}
+	return candle.Open
+}
+
+// Compute the summary statistics of spreads which were resampled to buckets of the given size
+func summarizeSpreads(spreads []SpreadPoint, threshold float64, bucket time.Duration) SpreadSummary {
+	summary := SpreadSummary{Buckets: len(spreads), Threshold: threshold}
+
+	var totalSpread, totalPercentSpread float64
+	for _, point := range spreads {
+		spread := math.Abs(point.Spread)
+		percentSpread := math.Abs(point.PercentSpread)
+
+		totalSpread += spread
+		totalPercentSpread += percentSpread
+		summary.MaxSpread = math.Max(summary.MaxSpread, spread)
+		summary.MaxPercentSpread = math.Max(summary.MaxPercentSpread, percentSpread)
+
+		if percentSpread > threshold {
+			summary.BucketsAboveThreshold++
+			summary.SecondsAboveThreshold += int64(bucket / time.Second)
+		}
+	}
+
+	if len(spreads) > 0 {
+		summary.MeanSpread = totalSpread / float64(len(spreads))
+		summary.MeanPercentSpread = totalPercentSpread / float64(len(spreads))
+	}
+
+	return summary
+}
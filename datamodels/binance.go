@@ -1,32 +1,31 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
-	"log"
+	"github.com/adamhei/historicalapi/logging"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// May need in the future if more fields are to be added to PricePoint
-// Represents a Binance response bucket
-
-//type binanceResponse struct {
-//	OpenTime                 int64
-//	Open                     string
-//	High                     string
-//	Low                      string
-//	Close                    string
-//	Volumne                  string
-//	CloseTime                int64
-//	QuoteAssetVolume         string
-//	NumTrades                int64
-//	TakerBuyBaseAssetVolume  string
-//	TakerButQuoteAssetVolume string
-//	Ignore                   string
-//}
+// Represents a Binance response bucket, which arrives as a mixed JSON array of strings and integers
+type binanceBucket struct {
+	OpenTime                 int64
+	Open                     string
+	High                     string
+	Low                      string
+	Close                    string
+	Volume                   string
+	CloseTime                int64
+	QuoteAssetVolume         string
+	NumTrades                int64
+	TakerBuyBaseAssetVolume  string
+	TakerBuyQuoteAssetVolume string
+	Ignore                   string
+}
 
 type binanceError struct {
 	Code int64  `json:"code"`
@@ -44,71 +43,267 @@ var binanceIntervals = map[string]string{
 	DAY:        "15m",
 }
 
-const BTCUSDT = "BTCUSDT"
+// The length of each Binance granularity
+// Monthly buckets follow the calendar, so 1M is given the nominal length of 30 days
+var binanceGranularities = map[string]time.Duration{
+	"1M":  30 * 24 * time.Hour,
+	"1w":  7 * 24 * time.Hour,
+	"3d":  3 * 24 * time.Hour,
+	"1d":  24 * time.Hour,
+	"12h": 12 * time.Hour,
+	"8h":  8 * time.Hour,
+	"6h":  6 * time.Hour,
+	"4h":  4 * time.Hour,
+	"2h":  2 * time.Hour,
+	"1h":  time.Hour,
+	"30m": 30 * time.Minute,
+	"15m": 15 * time.Minute,
+	"5m":  5 * time.Minute,
+	"3m":  3 * time.Minute,
+	"1m":  time.Minute,
+}
+
+// Canonical pairs and their Binance symbols
+// Binance has no fiat markets, so USD pairs are served by their Tether (USDT) markets
+var binanceSymbols = map[string]string{
+	"BTC-USD": "BTCUSDT",
+	"ETH-USD": "ETHUSDT",
+	"ETH-BTC": "ETHBTC",
+	"LTC-USD": "LTCUSDT",
+	"LTC-BTC": "LTCBTC",
+}
+
+// Binance returns at most this many buckets per request, and only 500 unless asked
+const binanceMaxLimit = 1000
+const binanceBaseURL = "https://api.binance.com"
 const binanceApiVersion = "v1"
-const binanceHistoricalEndpoint = "https://api.binance.com/api/%s/klines"
+const binanceHistoricalEndpoint = "/api/%s/klines"
+
 var binanceEndpoint = fmt.Sprintf(binanceHistoricalEndpoint, binanceApiVersion)
 
-// Given an interval, check its validity and return all open prices within that interval and any relevant errors
-func PollBinanceHistorical(interval string) ([]PricePoint, *errors.MyError) {
-	interval = strings.ToUpper(interval)
-	if binanceIntervals[string(interval)] == interval {
-		return nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: 400}
+// Binance allows a weight of 1200 per minute, reports the weight used so far in X-MBX-USED-WEIGHT, and weighs a
+// klines request with a limit of 1000 as 5
+var binanceLimiter = &RateLimiter{
+	Rate:         20,
+	Burst:        1200,
+	Weight:       5,
+	MaxWait:      defaultMaxWait,
+	WeightHeader: "X-MBX-USED-WEIGHT",
+	WeightLimit:  1200,
+	WeightWindow: time.Minute,
+	tokens:       1200,
+}
+
+// The Binance klines API as a HistoricalSource
+type binanceSource struct {
+	Upstream
+}
+
+func init() {
+	Register(&binanceSource{Upstream: Upstream{BaseURL: binanceBaseURL, Limiter: binanceLimiter, Breaker: newDefaultBreaker()}})
+}
+
+func (binanceSource) Name() string {
+	return "binance"
+}
+
+func (binanceSource) Pairs() []string {
+	return pairsOf(binanceSymbols)
+}
+
+func (binanceSource) Intervals() []string {
+	return filterIntervals(func(interval string) bool {
+		return binanceIntervals[interval] != EMPTYSTRING
+	})
+}
+
+func (binanceSource) Granularity(interval string) time.Duration {
+	return binanceGranularities[binanceIntervals[strings.ToUpper(interval)]]
+}
+
+func (binanceSource) granularities() []time.Duration {
+	granularities := make([]time.Duration, 0, len(binanceGranularities))
+	for _, granularity := range binanceGranularities {
+		granularities = append(granularities, granularity)
+	}
+	return granularities
+}
+
+func (binanceSource) setGranularity(interval string, granularity time.Duration) {
+	for code, candidate := range binanceGranularities {
+		if candidate == granularity {
+			binanceIntervals[interval] = code
+		}
+	}
+}
+
+// Longer windows are paged, but a configured granularity must not make the default window of its interval take more
+// than one request
+func (binanceSource) maxBuckets() int64 {
+	return binanceMaxLimit
+}
+
+func (source *binanceSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	return PollBinanceHistorical(ctx, &source.Upstream, query)
+}
+
+func (binanceSource) ReferencePrice(candle Candle) *float64 {
+	return candle.Open
+}
+
+// Given a context, upstream and query, check its validity and return all candles within its window and any relevant
+// errors
+func PollBinanceHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	interval := strings.ToUpper(query.Interval)
+	if binanceIntervals[string(interval)] == EMPTYSTRING {
+		return nil, invalidInterval(interval)
+	}
+
+	symbol, myerror := lookupSymbol(binanceSymbols, binanceSource{}.Name(), query.Pair)
+	if myerror != nil {
+		return nil, myerror
 	}
 
-	buckets, myerror := fetchBinanceBuckets(interval)
+	buckets, myerror := fetchBinanceBuckets(ctx, upstream, symbol, interval, query.Start, query.End)
 
 	if myerror != nil {
 		return nil, myerror
 	}
 
-	return unmarshalBinanceBuckets(buckets), nil
+	return unmarshalBinanceBuckets(ctx, buckets)
 }
 
 // Binance gives us JSON arrays of mixed strings and integers, which makes parsing unnecessarily difficult
-func unmarshalBinanceBuckets(buckets [][]interface{}) []PricePoint {
+func unmarshalBinanceBuckets(ctx context.Context, buckets [][]json.RawMessage) ([]Candle, *errors.MyError) {
 	numBuckets := len(buckets)
-	pricePoints := make([]PricePoint, numBuckets)
+	candles := make([]Candle, numBuckets)
 
 	for index, val := range buckets {
-		timestamp := val[0].(float64)
-		// Convert millis -> seconds
-		timestamp = timestamp / 1000
+		bucket, err := unmarshalBinanceBucket(val)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not parse Binance bucket", logging.ERROR, err)
+			return nil, parseFailure(binanceSource{}.Name(), err.Error())
+		}
 
-		open := val[1].(string)
+		candle, err := bucket.toCandle()
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not parse Binance prices", logging.ERROR, err)
+			return nil, parseFailure(binanceSource{}.Name(), err.Error())
+		}
 
 		// Binance gives us data in ascending order, so we must reverse!
-		pricePoints[numBuckets-1-index] = PricePoint{Timestamp: int64(timestamp), Price: open}
+		candles[numBuckets-1-index] = *candle
+	}
+
+	return candles, nil
+}
+
+// Parse the positional fields of a single Binance bucket
+func unmarshalBinanceBucket(jsonBucket []json.RawMessage) (*binanceBucket, error) {
+	bucket := new(binanceBucket)
+
+	fields := []interface{}{
+		&bucket.OpenTime, &bucket.Open, &bucket.High, &bucket.Low, &bucket.Close, &bucket.Volume,
+		&bucket.CloseTime, &bucket.QuoteAssetVolume, &bucket.NumTrades,
+		&bucket.TakerBuyBaseAssetVolume, &bucket.TakerBuyQuoteAssetVolume, &bucket.Ignore,
+	}
+	if len(jsonBucket) < len(fields) {
+		return nil, fmt.Errorf("Binance bucket has %d fields, expected %d", len(jsonBucket), len(fields))
 	}
 
-	return pricePoints
+	for index, field := range fields {
+		err := json.Unmarshal(jsonBucket[index], field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
 }
 
-// Attempt to build the Binance request, query for the data, return the raw data if sucessful and any errors else
-func fetchBinanceBuckets(interval string) ([][]interface{}, *errors.MyError) {
-	requestString, err := buildBinanceRequest(interval)
+// Convert the string prices of a Binance bucket to a Candle
+// Binance has no VWAP, but it can be derived from the quote asset volume
+func (bucket *binanceBucket) toCandle() (*Candle, error) {
+	// Convert millis -> seconds
+	candle := &Candle{Timestamp: bucket.OpenTime / 1000, Trades: &bucket.NumTrades}
+
+	prices := []string{bucket.Open, bucket.High, bucket.Low, bucket.Close, bucket.Volume}
+	fields := []**float64{&candle.Open, &candle.High, &candle.Low, &candle.Close, &candle.Volume}
+	for index, price := range prices {
+		parsed, err := parsePrice(price)
+		if err != nil {
+			return nil, err
+		}
+		*fields[index] = parsed
+	}
+
+	quoteVolume, err := parsePrice(bucket.QuoteAssetVolume)
 	if err != nil {
-		return nil, &errors.MyError{Err: err.Error()}
+		return nil, err
+	}
+	if *candle.Volume > 0 {
+		candle.VWAP = floatPtr(*quoteVolume / *candle.Volume)
 	}
 
-	response, err := http.Get(requestString)
-	defer response.Body.Close()
+	return candle, nil
+}
+
+// Fetch the raw buckets within a window page by page, since Binance returns at most binanceMaxLimit buckets per
+// request, and return them in ascending order
+func fetchBinanceBuckets(ctx context.Context, upstream *Upstream, symbol string, interval string, start, end time.Time) ([][]json.RawMessage, *errors.MyError) {
+	granularity := binanceGranularities[binanceIntervals[interval]]
+
+	buckets := make([][]json.RawMessage, 0)
+	for !start.After(end) {
+		page, myErr := fetchBinancePage(ctx, upstream, symbol, interval, start, end)
+		if myErr != nil {
+			return nil, myErr
+		}
+		buckets = append(buckets, page...)
+
+		// A short page means the window is covered
+		if len(page) < binanceMaxLimit {
+			break
+		}
 
-	log.Println(fmt.Sprintf("Querying %s", requestString))
+		// Otherwise continue with the bucket after the last one returned
+		var openTime int64
+		last := page[len(page)-1]
+		if len(last) == 0 || json.Unmarshal(last[0], &openTime) != nil {
+			logging.FromContext(ctx).Warn("Could not read the open time of the last Binance bucket")
+			return nil, parseFailure(binanceSource{}.Name(), "Binance bucket has no open time")
+		}
+		next := time.Unix(0, openTime*int64(time.Millisecond)).Add(granularity)
+		if !next.After(start) {
+			break
+		}
+		start = next
+	}
 
+	return buckets, nil
+}
+
+// Attempt to build the Binance request for a single page, query for the data, return the raw data if sucessful and any
+// errors else
+func fetchBinancePage(ctx context.Context, upstream *Upstream, symbol string, interval string, start, end time.Time) ([][]json.RawMessage, *errors.MyError) {
+	requestString, err := buildBinanceRequest(ctx, upstream.endpoint(binanceEndpoint), symbol, interval, start, end)
 	if err != nil {
-		log.Println(fmt.Sprintf("Could not reach %s", requestString))
 		return nil, &errors.MyError{Err: err.Error()}
 	}
 
-	buckets := make([][]interface{}, 0)
+	response, myErr := upstream.get(ctx, binanceSource{}.Name(), requestString)
+	if myErr != nil {
+		return nil, myErr
+	}
+	defer response.Body.Close()
+
+	buckets := make([][]json.RawMessage, 0)
 	if response.StatusCode == http.StatusOK {
-		tempBuckets := make([][]interface{}, 0)
+		tempBuckets := make([][]json.RawMessage, 0)
 		err = json.NewDecoder(response.Body).Decode(&tempBuckets)
 
 		if err != nil {
-			log.Println("Could not decode Binance response")
-			return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError}
+			logging.FromContext(ctx).Warn("Could not decode Binance response", logging.ERROR, err)
+			return nil, parseFailure(binanceSource{}.Name(), err.Error())
 		}
 
 		buckets = append(buckets, tempBuckets...)
@@ -117,54 +312,36 @@ func fetchBinanceBuckets(interval string) ([][]interface{}, *errors.MyError) {
 		err = json.NewDecoder(response.Body).Decode(binanceErr)
 
 		if err != nil {
-			log.Println("Could not decode Binance error response")
-			return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError}
+			logging.FromContext(ctx).Warn("Could not decode Binance error response", logging.STATUS, response.StatusCode, logging.ERROR, err)
+			return nil, upstreamError(response.StatusCode, "Binance API error")
 		}
-		return nil, &errors.MyError{Err: binanceErr.Msg, ErrorCode: http.StatusInternalServerError}
+		return nil, upstreamError(response.StatusCode, binanceErr.Msg)
 	}
 
 	return buckets, nil
 }
 
-// Given an interval, construct the proper GET request with all properly formatted params
-func buildBinanceRequest(interval string) (string, error) {
-	request, err := http.NewRequest(http.MethodGet, binanceEndpoint, nil)
+// Given an endpoint, symbol, interval and window, construct the proper GET request with all properly formatted params
+func buildBinanceRequest(ctx context.Context, endpoint string, symbol string, interval string, start, end time.Time) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		log.Println("Could not build Binance request")
-		return EMPTYSTRING, nil
+		logging.FromContext(ctx).Error("Could not build Binance request", logging.ERROR, err)
+		return EMPTYSTRING, err
 	}
 
 	query := request.URL.Query()
 
-	query.Add("symbol", BTCUSDT)
+	query.Add("symbol", symbol)
 	query.Add("interval", binanceIntervals[interval])
-	query.Add("startTime", fmt.Sprintf("%d", getBinanceStartDate(interval)))
+	query.Add("startTime", fmt.Sprintf("%d", toMillis(start)))
+	query.Add("endTime", fmt.Sprintf("%d", toMillis(end)))
+	query.Add("limit", fmt.Sprintf("%d", binanceMaxLimit))
 
 	request.URL.RawQuery = query.Encode()
 	return request.URL.String(), nil
 }
 
-// Based on the interval, return the start time in milliseconds
-func getBinanceStartDate(interval string) int64 {
-	startTime := time.Now()
-
-	switch interval {
-	case TWOYEAR:
-		startTime = startTime.AddDate(-2, 0, 0)
-	case YEAR:
-		startTime = startTime.AddDate(-1, 0, 0)
-	case SIXMONTH:
-		startTime = startTime.AddDate(0, -6, 0)
-	case THREEMONTH:
-		startTime = startTime.AddDate(0, -3, 0)
-	case MONTH:
-		startTime = startTime.AddDate(0, -1, 0)
-	case WEEK:
-		startTime = startTime.AddDate(0, 0, -7)
-	case DAY:
-		startTime = startTime.AddDate(0, 0, -1)
-	}
-
-	// Convert seconds to millis
-	return startTime.Unix() * 1000
+// Binance expects its times in milliseconds
+func toMillis(t time.Time) int64 {
+	return t.Unix() * 1000
 }
@@ -0,0 +1,34 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"testing"
+	"time"
+)
+
+func TestPollBinanceHistoricalPages(t *testing.T) {
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	server := mockexchange.NewServer()
+	defer server.Close()
+	server.Exchange.Now = func() time.Time { return now }
+
+	// 30 days of 15 minute buckets need three pages of at most 1000
+	query := HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: now.AddDate(0, 0, -30), End: now}
+	candles, myErr := PollBinanceHistorical(context.Background(), &Upstream{BaseURL: server.URL}, query)
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+
+	if len(candles) != 30*96+1 {
+		t.Fatalf("got %d candles, want %d", len(candles), 30*96+1)
+	}
+	if newest := candles[0].Timestamp; newest != now.Unix() {
+		t.Errorf("newest candle at %d, want %d", newest, now.Unix())
+	}
+	for index := 1; index < len(candles); index++ {
+		if gap := candles[index-1].Timestamp - candles[index].Timestamp; gap != 900 {
+			t.Fatalf("candles %d and %d are %ds apart, want 900s", index-1, index, gap)
+		}
+	}
+}
@@ -1,79 +1,132 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
-	"log"
+	"github.com/adamhei/historicalapi/logging"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
 
 const bitfinex = "BITFINEX"
-const bitfinexTicker = "BTCUSD"
-const qBitfinexTemplate = "https://www.quandl.com/api/%s/datasets/%s/%s.json"
-
-var qBitfinexEndpoint = fmt.Sprintf(qBitfinexTemplate, quandlApiV3, bitfinex, bitfinexTicker)
+const qBitfinexTemplate = "/api/%s/datasets/%s/%s.json"
+
+// Canonical pairs and their Quandl Bitfinex datasets
+var bitfinexSymbols = map[string]string{
+	"BTC-USD": "BTCUSD",
+	"ETH-USD": "ETHUSD",
+	"ETH-BTC": "ETHBTC",
+	"LTC-USD": "LTCUSD",
+	"LTC-BTC": "LTCBTC",
+}
 
-// Representation of a single Quandl data bucket, e.g.
+// Representation of a single Quandl data bucket, whose prices may be null
 type qBitfinexBucket struct {
 	Date                                   string
-	High, Low, Mid, Last, Bid, Ask, Volume float64
+	High, Low, Mid, Last, Bid, Ask, Volume *float64
+}
+
+// Bitfinex data through Quandl as a HistoricalSource
+type bitfinexSource struct {
+	Upstream
+}
+
+func init() {
+	Register(&bitfinexSource{Upstream: Upstream{BaseURL: quandlBaseURL, Limiter: quandlLimiter, Breaker: quandlBreaker, Timeout: quandlTimeout}})
+}
+
+func (bitfinexSource) Name() string {
+	return "bitfinex"
+}
+
+func (bitfinexSource) Pairs() []string {
+	return pairsOf(bitfinexSymbols)
+}
+
+func (bitfinexSource) Intervals() []string {
+	return filterIntervals(func(interval string) bool {
+		return quandlIntervals[interval]
+	})
+}
+
+func (bitfinexSource) Granularity(interval string) time.Duration {
+	return quandlGranularity
+}
+
+func (source *bitfinexSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	return PollBitfinexHistorical(ctx, &source.Upstream, query)
 }
 
-// Given an interval, check its validity and return all Bitfinex data within that interval, as PricePoints
+// Bitfinex PricePoints report the mid price
+func (bitfinexSource) ReferencePrice(candle Candle) *float64 {
+	return candle.Mid
+}
+
+// Given a context, upstream and query, check its validity and return all Bitfinex data within its window, as Candles
 // Currently, we only support Bitfinex data through Quandl, whose finest granularity is one day
 //
 // TODO: Add direct Bitfinex API to support intervals shorter than 1 month
-func PollBitfinexHistorical(interval string) ([]PricePoint, *errors.MyError) {
-	interval = strings.ToUpper(interval)
+func PollBitfinexHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	interval := strings.ToUpper(query.Interval)
 	if !quandlIntervals[interval] {
-		return nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: http.StatusBadRequest}
+		return nil, invalidInterval(interval)
+	}
+
+	dataset, myErr := lookupSymbol(bitfinexSymbols, bitfinexSource{}.Name(), query.Pair)
+	if myErr != nil {
+		return nil, myErr
 	}
 
-	requestString, err := buildQBitfinexRequest(interval)
+	requestString, err := buildQBitfinexRequest(ctx, upstream.endpoint(fmt.Sprintf(qBitfinexTemplate, quandlApiV3, bitfinex, dataset)), query.Start, query.End)
 	if err != nil {
 		return nil, &errors.MyError{Err: err.Error()}
 	}
 
-	quandlResponse, myErr := fetchQuandlResponse(requestString)
-	if err != nil {
+	quandlResponse, myErr := fetchQuandlResponse(ctx, upstream, bitfinexSource{}.Name(), requestString)
+	if myErr != nil {
 		return nil, myErr
 	}
 
-	return parseQBitfinexBuckets(quandlResponse.DataSetResponse.Data)
+	return parseQBitfinexBuckets(ctx, quandlResponse.DataSetResponse.Data)
 }
 
-// Given the raw 2D Quandl data, convert it to an array of PricePoints
-func parseQBitfinexBuckets(buckets [][]json.RawMessage) ([]PricePoint, *errors.MyError) {
-	pricePoints := make([]PricePoint, len(buckets))
+// Given the raw 2D Quandl data, convert it to an array of Candles
+func parseQBitfinexBuckets(ctx context.Context, buckets [][]json.RawMessage) ([]Candle, *errors.MyError) {
+	candles := make([]Candle, len(buckets))
 
 	for index, val := range buckets {
 		bucket, err := unmarshalQBitfinexBucket(val)
 		if err != nil {
-			return nil, &errors.MyError{Err: err.Error()}
+			return nil, parseFailure(bitfinexSource{}.Name(), err.Error())
 		}
 
 		timestamp, err := time.Parse(DATELAYOUTSTRING, bucket.Date)
 		if err != nil {
-			log.Println("Could not parse time from Bitfinex bucket")
-			return nil, &errors.MyError{Err: "Failure to parse Quandl response", ErrorCode: http.StatusInternalServerError}
+			logging.FromContext(ctx).Warn("Could not parse time from Bitfinex bucket", logging.ERROR, err)
+			return nil, parseFailure(bitfinexSource{}.Name(), "Failure to parse Quandl response")
 		}
 
-		price := strconv.FormatFloat(bucket.Mid, 'f', -1, 64)
-
-		pricePoints[index] = PricePoint{Timestamp: timestamp.Unix(), Price: price}
+		// Quandl has no open, VWAP or trade count for Bitfinex
+		candles[index] = Candle{
+			Timestamp: timestamp.Unix(),
+			High:      bucket.High,
+			Low:       bucket.Low,
+			Close:     bucket.Last,
+			Volume:    bucket.Volume,
+			Bid:       bucket.Bid,
+			Ask:       bucket.Ask,
+			Mid:       bucket.Mid,
+		}
 	}
 
-	return pricePoints, nil
+	return candles, nil
 }
 
 // Quandl decided to return an array of both strings and floats, forcing us to parse it by hand
-// For now, just timestamp and mid price
-//
-// TODO: Add more fields as necessary
+// The columns are [Date, High, Low, Mid, Last, Bid, Ask, Volume]
 func unmarshalQBitfinexBucket(jsonBucket []json.RawMessage) (*qBitfinexBucket, error) {
 	bucket := new(qBitfinexBucket)
 
@@ -83,28 +136,31 @@ func unmarshalQBitfinexBucket(jsonBucket []json.RawMessage) (*qBitfinexBucket, e
 		return nil, err
 	}
 
-	// Parse mid-price
-	err = json.Unmarshal(jsonBucket[3], &bucket.Mid)
-	if err != nil {
-		return nil, err
+	// Parse prices and volume
+	columns := []**float64{&bucket.High, &bucket.Low, &bucket.Mid, &bucket.Last, &bucket.Bid, &bucket.Ask, &bucket.Volume}
+	for index, column := range columns {
+		*column, err = unmarshalQuandlColumn(jsonBucket, index+1)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return bucket, nil
 }
 
-
-
-// Given an interval, add the custom GET parameters to the Quandl request
-func buildQBitfinexRequest(interval string) (string, error) {
-	request, err := http.NewRequest(http.MethodGet, qBitfinexEndpoint, nil)
+// Given the endpoint of a dataset and a window, add the custom GET parameters to the Quandl request
+func buildQBitfinexRequest(ctx context.Context, endpoint string, start, end time.Time) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		log.Println("Could not build Quandl-Bitfinex URL")
+		logging.FromContext(ctx).Error("Could not build Quandl-Bitfinex URL", logging.ERROR, err)
 		return EMPTYSTRING, err
 	}
 
 	query := request.URL.Query()
 
-	query.Add("api_key", quandlApiKey)
-	query.Add("start_date", getQuandlStartDate(interval))
+	if quandlApiKey != EMPTYSTRING {
+		query.Add("api_key", quandlApiKey)
+	}
+	addQuandlDates(query, start, end)
 
 	request.URL.RawQuery = query.Encode()
 	return request.URL.String(), nil
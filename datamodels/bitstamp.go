@@ -1,95 +1,159 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
-	"log"
+	"github.com/adamhei/historicalapi/logging"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
 
 const bitstamp = "BITSTAMP"
-const qBitstampTemplate = "https://www.quandl.com/api/%s/datasets/%s/USD.json"
+const qBitstampTemplate = "/api/%s/datasets/%s/USD.json"
 
 var qBitstampEndpoint = fmt.Sprintf(qBitstampTemplate, quandlApiV3, bitstamp)
 
-type qBitstampBudcket struct {
+// Quandl only has a Bitstamp dataset for BTC-USD
+var bitstampSymbols = map[string]string{
+	"BTC-USD": "USD",
+}
+
+// Representation of a single Quandl data bucket, whose prices may be null
+type qBitstampBucket struct {
 	Date                                    string
-	High, Low, Last, Bid, Ask, Volume, VWAP float64
+	High, Low, Last, Bid, Ask, Volume, VWAP *float64
+}
+
+// Bitstamp data through Quandl as a HistoricalSource
+type bitstampSource struct {
+	Upstream
+}
+
+func init() {
+	Register(&bitstampSource{Upstream: Upstream{BaseURL: quandlBaseURL, Limiter: quandlLimiter, Breaker: quandlBreaker, Timeout: quandlTimeout}})
+}
+
+func (bitstampSource) Name() string {
+	return "bitstamp"
 }
 
-func PollBitstampHistorical(interval string) ([]PricePoint, *errors.MyError) {
-	interval = strings.ToUpper(interval)
+func (bitstampSource) Pairs() []string {
+	return pairsOf(bitstampSymbols)
+}
+
+func (bitstampSource) Intervals() []string {
+	return filterIntervals(func(interval string) bool {
+		return quandlIntervals[interval]
+	})
+}
+
+func (bitstampSource) Granularity(interval string) time.Duration {
+	return quandlGranularity
+}
+
+func (source *bitstampSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	return PollBitstampHistorical(ctx, &source.Upstream, query)
+}
+
+// Bitstamp PricePoints report the VWAP
+func (bitstampSource) ReferencePrice(candle Candle) *float64 {
+	return candle.VWAP
+}
+
+// Given a context, upstream and query, check its validity and return all Bitstamp data within its window, as Candles
+func PollBitstampHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	interval := strings.ToUpper(query.Interval)
 	if !quandlIntervals[interval] {
-		return nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: http.StatusBadRequest}
+		return nil, invalidInterval(interval)
+	}
+
+	_, myErr := lookupSymbol(bitstampSymbols, bitstampSource{}.Name(), query.Pair)
+	if myErr != nil {
+		return nil, myErr
 	}
 
-	requestString, err := buildQBitstampRequest(interval)
+	requestString, err := buildQBitstampRequest(ctx, upstream.endpoint(qBitstampEndpoint), query.Start, query.End)
 	if err != nil {
 		return nil, &errors.MyError{Err: err.Error()}
 	}
 
-	quandlReponse, myErr := fetchQuandlResponse(requestString)
+	quandlReponse, myErr := fetchQuandlResponse(ctx, upstream, bitstampSource{}.Name(), requestString)
 	if myErr != nil {
 		return nil, myErr
 	}
 
-	return parseQBitstampBuckets(quandlReponse.DataSetResponse.Data)
+	return parseQBitstampBuckets(ctx, quandlReponse.DataSetResponse.Data)
 }
 
-func parseQBitstampBuckets(buckets [][]json.RawMessage) ([]PricePoint, *errors.MyError) {
-	pricePoints := make([]PricePoint, len(buckets))
+// Given the raw 2D Quandl data, convert it to an array of Candles
+func parseQBitstampBuckets(ctx context.Context, buckets [][]json.RawMessage) ([]Candle, *errors.MyError) {
+	candles := make([]Candle, len(buckets))
 
 	for index, val := range buckets {
-		bucket, err := unmarshalQBitstampBucket(val)
+		bucket, err := unmarshalQBitstampBucket(ctx, val)
 		if err != nil {
-			return nil, &errors.MyError{Err: err.Error()}
+			return nil, parseFailure(bitstampSource{}.Name(), err.Error())
 		}
 
 		timestamp, err := time.Parse(DATELAYOUTSTRING, bucket.Date)
 		if err != nil {
-			log.Println("Could not parse time from Bitstamp bucket")
-			return nil, &errors.MyError{Err: "Failure to parse Quandl response", ErrorCode: http.StatusInternalServerError}
+			logging.FromContext(ctx).Warn("Could not parse time from Bitstamp bucket", logging.ERROR, err)
+			return nil, parseFailure(bitstampSource{}.Name(), "Failure to parse Quandl response")
 		}
 
-		price := strconv.FormatFloat(bucket.VWAP, 'f', -1, 64)
-
-		pricePoints[index] = PricePoint{Timestamp: timestamp.Unix(), Price: price}
+		// Quandl has no open or trade count for Bitstamp
+		candles[index] = Candle{
+			Timestamp: timestamp.Unix(),
+			High:      bucket.High,
+			Low:       bucket.Low,
+			Close:     bucket.Last,
+			Volume:    bucket.Volume,
+			VWAP:      bucket.VWAP,
+			Bid:       bucket.Bid,
+			Ask:       bucket.Ask,
+		}
 	}
 
-	return pricePoints, nil
+	return candles, nil
 }
 
-func unmarshalQBitstampBucket(jsonBucket []json.RawMessage) (*qBitstampBudcket, error) {
-	bucket := new(qBitstampBudcket)
+// The columns are [Date, High, Low, Last, Bid, Ask, Volume, VWAP]
+func unmarshalQBitstampBucket(ctx context.Context, jsonBucket []json.RawMessage) (*qBitstampBucket, error) {
+	bucket := new(qBitstampBucket)
 
 	err := json.Unmarshal(jsonBucket[0], &bucket.Date)
 	if err != nil {
-		log.Println("Failed to parse Bitstamp bucket date")
+		logging.FromContext(ctx).Warn("Failed to parse Bitstamp bucket date", logging.ERROR, err)
 		return nil, err
 	}
 
-	err = json.Unmarshal(jsonBucket[7], &bucket.VWAP)
-	if err != nil {
-		log.Println("Failed to parse Bitstamp bucket VWAP")
-		return nil, err
+	columns := []**float64{&bucket.High, &bucket.Low, &bucket.Last, &bucket.Bid, &bucket.Ask, &bucket.Volume, &bucket.VWAP}
+	for index, column := range columns {
+		*column, err = unmarshalQuandlColumn(jsonBucket, index+1)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Failed to parse Bitstamp bucket prices", logging.ERROR, err)
+			return nil, err
+		}
 	}
 	return bucket, nil
 }
 
-func buildQBitstampRequest(interval string) (string, error) {
-	request, err := http.NewRequest(http.MethodGet, qBitstampEndpoint, nil)
+// Given an endpoint and window, add the custom GET parameters to the Quandl request
+func buildQBitstampRequest(ctx context.Context, endpoint string, start, end time.Time) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		log.Println("Could not build Quandl Bitstamp URL")
+		logging.FromContext(ctx).Error("Could not build Quandl Bitstamp URL", logging.ERROR, err)
 		return EMPTYSTRING, err
 	}
 
 	query := request.URL.Query()
-	query.Add("api_key", quandlApiKey)
-	query.Add("start_date", getQuandlStartDate(interval))
+	if quandlApiKey != EMPTYSTRING {
+		query.Add("api_key", quandlApiKey)
+	}
+	addQuandlDates(query, start, end)
 
 	request.URL.RawQuery = query.Encode()
 	return request.URL.String(), nil
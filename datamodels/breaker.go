@@ -0,0 +1,167 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	// Requests are sent as usual
+	BREAKERCLOSED = "closed"
+	// The upstream is considered down and requests fail fast
+	BREAKEROPEN = "open"
+	// The cooldown has passed and a single trial request decides whether the breaker closes or opens again
+	BREAKERHALFOPEN = "half-open"
+)
+
+// The consecutive failed requests which open a breaker, and how long it stays open, unless configured otherwise
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// CircuitBreaker fails requests to an upstream fast while it is down, rather than letting every client wait for its
+// retries to run out
+//
+// The breaker opens after Threshold consecutive failed requests, retries included, and lets a single trial request
+// through once Cooldown has passed. The breaker closes again if the trial succeeds and reopens if it fails.
+type CircuitBreaker struct {
+	// The consecutive failed requests which open the breaker
+	Threshold int
+	// How long the breaker stays open before it lets a trial request through
+	Cooldown time.Duration
+
+	mutex     sync.Mutex
+	state     string
+	failures  int
+	lastError string
+	openedAt  time.Time
+	// Whether the trial request of a half-open breaker is in flight
+	trial bool
+}
+
+// BreakerStatus is a snapshot of a CircuitBreaker
+type BreakerStatus struct {
+	State string `json:"state"`
+	// The consecutive failed requests so far
+	Failures int `json:"failures"`
+	// Why the last request failed, if it did
+	LastError string `json:"lastError,omitempty"`
+	// When the breaker last opened and when it lets the next trial request through, while it is open
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+	RetryAt  *time.Time `json:"retryAt,omitempty"`
+}
+
+// NewCircuitBreaker returns a closed breaker which opens after threshold consecutive failures, for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown, state: BREAKERCLOSED}
+}
+
+// Returns a breaker with the default threshold and cooldown
+func newDefaultBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown)
+}
+
+// SetCircuitBreaker replaces the breaker of the named source, or removes it if breaker is nil
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetCircuitBreaker(name string, breaker *CircuitBreaker) error {
+	upstream, err := upstreamOf(name)
+	if err != nil {
+		return err
+	}
+
+	upstream.Breaker = breaker
+	return nil
+}
+
+// Allow lets a request to the named exchange through, or rejects it with 503 Service Unavailable while the breaker is
+// open
+//
+// Every allowed request must be followed by exactly one call to Success, Failure or Release. State changes are logged
+// with the logger of ctx, i.e. along with the request which caused them
+func (breaker *CircuitBreaker) Allow(ctx context.Context, exchange string) *errors.MyError {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	now := time.Now()
+	if breaker.state == BREAKEROPEN && !now.Before(breaker.openedAt.Add(breaker.Cooldown)) {
+		logging.FromContext(ctx).Info("Sending a trial request through a circuit breaker", logging.EXCHANGE, exchange)
+		breaker.state = BREAKERHALFOPEN
+	}
+
+	switch breaker.state {
+	case BREAKEROPEN:
+		retryIn := breaker.openedAt.Add(breaker.Cooldown).Sub(now)
+		return &errors.MyError{Err: fmt.Sprintf("%s is unavailable; please retry in %s", exchange, retryIn.Round(time.Second)), ErrorCode: http.StatusServiceUnavailable, Code: errors.UPSTREAMUNAVAILABLE}
+	case BREAKERHALFOPEN:
+		if breaker.trial {
+			return &errors.MyError{Err: fmt.Sprintf("%s is unavailable; please retry shortly", exchange), ErrorCode: http.StatusServiceUnavailable, Code: errors.UPSTREAMUNAVAILABLE}
+		}
+		breaker.trial = true
+	}
+	return nil
+}
+
+// Success closes the breaker after a request which reached the upstream and was answered
+func (breaker *CircuitBreaker) Success() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.state = BREAKERCLOSED
+	breaker.failures = 0
+	breaker.trial = false
+}
+
+// Failure counts a request which failed after all its retries, opening the breaker at the threshold or if it was the
+// trial request
+func (breaker *CircuitBreaker) Failure(ctx context.Context, exchange string, reason string) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.failures++
+	breaker.lastError = reason
+	if breaker.state == BREAKERHALFOPEN || breaker.failures >= breaker.Threshold {
+		if breaker.state != BREAKEROPEN {
+			logging.FromContext(ctx).Warn("Opened a circuit breaker", logging.EXCHANGE, exchange, "cooldown", breaker.Cooldown, "failures", breaker.failures, logging.ERROR, reason)
+		}
+		breaker.state = BREAKEROPEN
+		breaker.openedAt = time.Now()
+	}
+	breaker.trial = false
+}
+
+// Release gives back an allowed request which was never sent, e.g. because the rate limiter rejected it
+func (breaker *CircuitBreaker) Release() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.trial = false
+}
+
+// Status returns the current state of the breaker
+func (breaker *CircuitBreaker) Status() BreakerStatus {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	status := BreakerStatus{State: breaker.state, Failures: breaker.failures, LastError: breaker.lastError}
+	if breaker.state == BREAKEROPEN && !time.Now().Before(breaker.openedAt.Add(breaker.Cooldown)) {
+		// The next request will be the trial
+		status.State = BREAKERHALFOPEN
+	}
+	if !breaker.openedAt.IsZero() {
+		openedAt := breaker.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if status.State == BREAKEROPEN {
+		retryAt := breaker.openedAt.Add(breaker.Cooldown)
+		status.RetryAt = &retryAt
+	}
+	return status
+}
@@ -0,0 +1,206 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/metrics"
+	"sync"
+	"time"
+)
+
+// Whether a query was answered from the cache
+type CacheStatus string
+
+const (
+	CacheHit  CacheStatus = "HIT"
+	CacheMiss CacheStatus = "MISS"
+)
+
+// Bounds of the time to live of a cached series
+const (
+	minCacheTTL = time.Minute
+	maxCacheTTL = 6 * time.Hour
+)
+
+// CandleCache keeps recently fetched series in memory for a time which depends on their granularity, so that
+// identical requests do not reach the exchanges again
+//
+// Concurrent requests for the same series wait for a single upstream fetch
+type CandleCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// A cached series, or one which is still being fetched while ready is open
+type cacheEntry struct {
+	ready   chan struct{}
+	candles []Candle
+	err     *errors.MyError
+	expires time.Time
+}
+
+// NewCandleCache returns an empty cache
+func NewCandleCache() *CandleCache {
+	return &CandleCache{entries: make(map[string]*cacheEntry)}
+}
+
+// A HistoricalSource answering from a CandleCache and reporting the status of every lookup
+type cachedSource struct {
+	HistoricalSource
+	cache  *CandleCache
+	report func(status CacheStatus)
+}
+
+// NewCachedSource wraps a source in the cache, calling report with the status of every FetchCandles
+func NewCachedSource(source HistoricalSource, cache *CandleCache, report func(status CacheStatus)) HistoricalSource {
+	return &cachedSource{HistoricalSource: source, cache: cache, report: report}
+}
+
+func (source *cachedSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	candles, status, err := source.cache.Fetch(ctx, source.HistoricalSource, query)
+	source.lookedUp(status)
+	return candles, err
+}
+
+func (source *cachedSource) StreamCandles(ctx context.Context, query HistoricalQuery, yield func(candles []Candle) error) *errors.MyError {
+	return source.cache.Stream(ctx, source.HistoricalSource, query, source.lookedUp, yield)
+}
+
+// Count a lookup in the cache metrics before reporting it
+func (source *cachedSource) lookedUp(status CacheStatus) {
+	metrics.CacheLookup(source.Name(), string(status))
+	source.report(status)
+}
+
+// Fetch answers a query from the cache, or fetches and caches it on a miss
+//
+// Query windows are truncated to the granularity of the series, so every request within the same bucket shares an
+// entry. Errors are never cached.
+func (cache *CandleCache) Fetch(ctx context.Context, source HistoricalSource, query HistoricalQuery) ([]Candle, CacheStatus, *errors.MyError) {
+	return cache.fetch(ctx, source, query, source.FetchCandles)
+}
+
+// Stream is like Fetch, but on a miss yields the Candles of the source as they arrive when it is a StreamingSource
+//
+// report is called with the status of the lookup before the first Candles are yielded. A stream which yield ended
+// early is never cached.
+func (cache *CandleCache) Stream(ctx context.Context, source HistoricalSource, query HistoricalQuery, report func(status CacheStatus), yield func(candles []Candle) error) *errors.MyError {
+	streamed := false
+
+	candles, status, myErr := cache.fetch(ctx, source, query, func(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+		streamed = true
+		report(CacheMiss)
+
+		candles := make([]Candle, 0)
+		myErr := StreamCandles(ctx, source, query, func(batch []Candle) error {
+			candles = append(candles, batch...)
+			return yield(batch)
+		})
+		return candles, myErr
+	})
+	if streamed {
+		return myErr
+	}
+
+	report(status)
+	if myErr != nil {
+		return myErr
+	}
+	return yieldError(yield(candles))
+}
+
+// Answer a query from the cache, or call fetch and cache its result on a miss
+//
+// Requests waiting for the same fetch stop waiting once their own ctx is done, and fetch again if the request which
+// fetched was canceled, since that says nothing about their own
+func (cache *CandleCache) fetch(ctx context.Context, source HistoricalSource, query HistoricalQuery, fetch func(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError)) ([]Candle, CacheStatus, *errors.MyError) {
+	granularity := source.Granularity(query.Interval)
+	if granularity < time.Second {
+		// Invalid intervals are left to the source to report
+		candles, err := fetch(ctx, query)
+		return candles, CacheMiss, err
+	}
+	key := cacheKey(source, query, granularity)
+
+	cache.mutex.Lock()
+	if entry, ok := cache.entries[key]; ok {
+		cache.mutex.Unlock()
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, CacheMiss, contextError(source.Name(), ctx.Err())
+		}
+
+		if entry.err == nil && time.Now().Before(entry.expires) {
+			return entry.candles, CacheHit, nil
+		}
+		if entry.err != nil && entry.err.ErrorCode == statusClientClosedRequest && ctx.Err() == nil {
+			return cache.fetch(ctx, source, query, fetch)
+		}
+		if entry.err != nil {
+			return nil, CacheMiss, entry.err
+		}
+
+		cache.mutex.Lock()
+		// Only replace the expired entry if nobody else has in the meantime
+		if cache.entries[key] == entry {
+			delete(cache.entries, key)
+		}
+		cache.mutex.Unlock()
+		return cache.fetch(ctx, source, query, fetch)
+	}
+
+	entry := &cacheEntry{ready: make(chan struct{})}
+	cache.entries[key] = entry
+	cache.evictExpired()
+	cache.mutex.Unlock()
+
+	entry.candles, entry.err = fetch(ctx, query)
+	entry.expires = time.Now().Add(cacheTTL(granularity))
+
+	// Failed entries are dropped before anyone is woken up, so that those fetching again start a new entry
+	if entry.err != nil {
+		cache.mutex.Lock()
+		delete(cache.entries, key)
+		cache.mutex.Unlock()
+	}
+	close(entry.ready)
+
+	return entry.candles, CacheMiss, entry.err
+}
+
+// Drop every expired entry; the cache mutex must be held
+func (cache *CandleCache) evictExpired() {
+	now := time.Now()
+	for key, entry := range cache.entries {
+		select {
+		case <-entry.ready:
+			if now.After(entry.expires) {
+				delete(cache.entries, key)
+			}
+		default:
+			// Still being fetched
+		}
+	}
+}
+
+// Identify a series and its window, truncated to whole buckets
+func cacheKey(source HistoricalSource, query HistoricalQuery, granularity time.Duration) string {
+	start := bucketStart(query.Start.Unix(), granularity)
+	end := bucketStart(query.End.Unix(), granularity)
+	return fmt.Sprintf("%s/%s/%s/%d/%d", source.Name(), query.Pair, query.Interval, start, end)
+}
+
+// Coarse series change slowly, so they may be cached for longer: a daily series lives for hours and a
+// fifteen-minute series for minutes
+func cacheTTL(granularity time.Duration) time.Duration {
+	ttl := granularity / 6
+	if ttl < minCacheTTL {
+		return minCacheTTL
+	}
+	if ttl > maxCacheTTL {
+		return maxCacheTTL
+	}
+	return ttl
+}
@@ -0,0 +1,117 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Fails every request for a series, like an exchange which is down
+type failingSource struct {
+	limitedSource
+}
+
+func (source *failingSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	source.calls = append(source.calls, query)
+	return nil, &errors.MyError{Err: "limited is down", ErrorCode: http.StatusServiceUnavailable, Code: errors.UPSTREAMUNAVAILABLE}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		granularity time.Duration
+		ttl         time.Duration
+	}{
+		{granularity: time.Second, ttl: time.Minute},
+		{granularity: time.Minute, ttl: time.Minute},
+		{granularity: 6 * time.Minute, ttl: time.Minute},
+		{granularity: 15 * time.Minute, ttl: 150 * time.Second},
+		{granularity: time.Hour, ttl: 10 * time.Minute},
+		{granularity: 24 * time.Hour, ttl: 4 * time.Hour},
+		{granularity: 36 * time.Hour, ttl: 6 * time.Hour},
+		{granularity: 7 * 24 * time.Hour, ttl: 6 * time.Hour},
+	}
+
+	for _, test := range tests {
+		if ttl := cacheTTL(test.granularity); ttl != test.ttl {
+			t.Errorf("cacheTTL(%s) = %s, want %s", test.granularity, ttl, test.ttl)
+		}
+	}
+}
+
+func TestCachedSourceLookups(t *testing.T) {
+	end := time.Date(2018, time.September, 30, 12, 0, 0, 0, time.UTC)
+	window := HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -1), End: end}
+	withinBucket := window
+	withinBucket.Start, withinBucket.End = window.Start.Add(20*time.Minute), window.End.Add(20*time.Minute)
+	nextBucket := window
+	nextBucket.Start, nextBucket.End = window.Start.Add(time.Hour), window.End.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		query  HistoricalQuery
+		expire bool
+		status CacheStatus
+		// Whether the lookup reached the source
+		fetched bool
+	}{
+		{name: "first lookup", query: window, status: CacheMiss, fetched: true},
+		{name: "same window", query: window, status: CacheHit},
+		{name: "window within the same buckets", query: withinBucket, status: CacheHit},
+		{name: "window one bucket later", query: nextBucket, status: CacheMiss, fetched: true},
+		{name: "expired window", query: window, expire: true, status: CacheMiss, fetched: true},
+		{name: "window fetched again", query: window, status: CacheHit},
+	}
+
+	cache := NewCandleCache()
+	source := &limitedSource{limit: 1000}
+	statuses := make([]CacheStatus, 0)
+	cached := NewCachedSource(source, cache, func(status CacheStatus) {
+		statuses = append(statuses, status)
+	})
+
+	for _, test := range tests {
+		if test.expire {
+			cache.mutex.Lock()
+			for _, entry := range cache.entries {
+				entry.expires = time.Now().Add(-time.Second)
+			}
+			cache.mutex.Unlock()
+		}
+
+		calls := len(source.calls)
+		statuses = statuses[:0]
+		candles, myErr := cached.FetchCandles(context.Background(), test.query)
+		if myErr != nil {
+			t.Fatalf("%s: %s", test.name, myErr.Err)
+		}
+		if len(candles) == 0 {
+			t.Errorf("%s: got no candles", test.name)
+		}
+
+		if len(statuses) != 1 || statuses[0] != test.status {
+			t.Errorf("%s: reported %v, want [%s]", test.name, statuses, test.status)
+		}
+		if fetched := len(source.calls) > calls; fetched != test.fetched {
+			t.Errorf("%s: reached the source %t, want %t", test.name, fetched, test.fetched)
+		}
+	}
+}
+
+func TestCandleCacheDoesNotCacheErrors(t *testing.T) {
+	end := time.Date(2018, time.September, 30, 12, 0, 0, 0, time.UTC)
+	query := HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -1), End: end}
+	cache := NewCandleCache()
+	source := &failingSource{}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		_, status, myErr := cache.Fetch(context.Background(), source, query)
+		if myErr == nil || myErr.Kind() != errors.UPSTREAMUNAVAILABLE || status != CacheMiss {
+			t.Fatalf("attempt %d: Fetch() = %s, %v, want a %s %s", attempt, status, myErr, CacheMiss, errors.UPSTREAMUNAVAILABLE)
+		}
+	}
+	if len(source.calls) != 2 {
+		t.Errorf("a failing series reached the source %d times in 2 lookups, want 2", len(source.calls))
+	}
+}
@@ -1,13 +1,13 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
-	"log"
+	"github.com/adamhei/historicalapi/logging"
 	"net/http"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -34,127 +34,156 @@ var coinDeskIntervals = map[string]bool{
 	MONTH:      true,
 }
 
+// Canonical pairs and the currency the CoinDesk index is quoted in
+var coinDeskSymbols = map[string]string{
+	"BTC-USD": "USD",
+	"BTC-EUR": "EUR",
+	"BTC-GBP": "GBP",
+}
+
+// The finest granularity of the CoinDesk index
+const coinDeskGranularity = 24 * time.Hour
+
+const coinDeskBaseURL = "https://api.coindesk.com"
 const coinDeskApiVersion = "v1"
-const coinDeskEndpoint = "https://api.coindesk.com/%s/bpi/historical/open.json"
+const coinDeskEndpoint = "/%s/bpi/historical/open.json"
+
 var coinDeskHistoricalEndpoint = fmt.Sprintf(coinDeskEndpoint, coinDeskApiVersion)
 
-// Given an interval, check its validity and return all CoinDesk Bitcoin Price Index data within that interval, as PricePoints
+// CoinDesk publishes no limit, so stay polite
+var coinDeskLimiter = NewRateLimiter(1, 5)
+
+// The CoinDesk Bitcoin Price Index as a HistoricalSource, served as "index"
+type coinDeskSource struct {
+	Upstream
+}
+
+func init() {
+	Register(&coinDeskSource{Upstream: Upstream{BaseURL: coinDeskBaseURL, Limiter: coinDeskLimiter, Breaker: newDefaultBreaker()}})
+}
+
+func (coinDeskSource) Name() string {
+	return "index"
+}
+
+func (coinDeskSource) Pairs() []string {
+	return pairsOf(coinDeskSymbols)
+}
+
+func (coinDeskSource) Intervals() []string {
+	return filterIntervals(func(interval string) bool {
+		return coinDeskIntervals[interval]
+	})
+}
+
+func (coinDeskSource) Granularity(interval string) time.Duration {
+	return coinDeskGranularity
+}
+
+func (source *coinDeskSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	return PollCoinDeskHistorical(ctx, &source.Upstream, query)
+}
+
+func (coinDeskSource) ReferencePrice(candle Candle) *float64 {
+	return candle.Open
+}
+
+// Given a context, upstream and query, check its validity and return all CoinDesk Bitcoin Price Index data within its
+// window, as Candles
 // Currently, we only support 1 month as the shortest lookback period, since the finest granularity of data is 1 day
 //
 // TODO: Add support for shorter, finer lookbacks (coinmarketcap?)
-func PollCoinDeskHistorical(interval string) ([]PricePoint, *errors.MyError) {
-	interval = strings.ToUpper(interval)
+func PollCoinDeskHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	interval := strings.ToUpper(query.Interval)
 	if !coinDeskIntervals[interval] {
-		return nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: http.StatusBadRequest}
+		return nil, invalidInterval(interval)
+	}
+
+	currency, err := lookupSymbol(coinDeskSymbols, coinDeskSource{}.Name(), query.Pair)
+	if err != nil {
+		return nil, err
 	}
 
-	coinDeskResponse, err := fetchCoinDeskResponse(interval)
+	coinDeskResponse, err := fetchCoinDeskResponse(ctx, upstream, currency, query.Start, query.End)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return parseCoinDeskBuckets(coinDeskResponse.BPI)
+	return parseCoinDeskBuckets(ctx, coinDeskResponse.BPI)
 }
 
-// Given the 2D date -> price response from CoinDesk, convert the data to PricePoints
-func parseCoinDeskBuckets(buckets map[string]float64) ([]PricePoint, *errors.MyError) {
-	pricePoints := make([]PricePoint, len(buckets))
+// Given the 2D date -> price response from CoinDesk, convert the data to Candles
+// The index only has a single daily opening price, so every other field is null
+func parseCoinDeskBuckets(ctx context.Context, buckets map[string]float64) ([]Candle, *errors.MyError) {
+	candles := make([]Candle, len(buckets))
 
 	index := 0
 	for date, price := range buckets {
 		timestamp, err := time.Parse(DATELAYOUTSTRING, date)
 
 		if err != nil {
-			log.Println("Could not parse CoinDesk date")
-			return nil, &errors.MyError{Err: "Could not properly parse CoinDesk response", ErrorCode: http.StatusInternalServerError}
+			logging.FromContext(ctx).Warn("Could not parse CoinDesk date", logging.ERROR, err)
+			return nil, parseFailure(coinDeskSource{}.Name(), "Could not properly parse CoinDesk response")
 		}
 
-		priceString := strconv.FormatFloat(price, 'f', -1, 64)
-
-		pricePoints[index] = PricePoint{Timestamp: timestamp.Unix(), Price: priceString}
+		candles[index] = Candle{Timestamp: timestamp.Unix(), Open: floatPtr(price)}
 		index++
 	}
 
 	// Sort because iteration over a map doesn't preserve insertion order
-	sort.Slice(pricePoints, func(i, j int) bool {
-		return pricePoints[i].Timestamp >= pricePoints[j].Timestamp
+	sort.Slice(candles, func(i, j int) bool {
+		return candles[i].Timestamp >= candles[j].Timestamp
 	})
 
-	return pricePoints, nil
+	return candles, nil
 }
 
-// Given an interval:
+// Given a context, upstream, currency and window:
 // 1. Build the GET request
 // 2. Fetch the historical index data from CoinDesk
 // 3. Return the response if successful, error if not
-func fetchCoinDeskResponse(interval string) (*CoinDeskResponse, *errors.MyError) {
-	requestString, err := buildCoinDeskRequest(interval)
+func fetchCoinDeskResponse(ctx context.Context, upstream *Upstream, currency string, start, end time.Time) (*CoinDeskResponse, *errors.MyError) {
+	requestString, err := buildCoinDeskRequest(ctx, upstream.endpoint(coinDeskHistoricalEndpoint), currency, start, end)
 	if err != nil {
 		return nil, &errors.MyError{Err: err.Error()}
 	}
 
-	response, err := http.Get(requestString)
-	defer response.Body.Close()
-
-	log.Println(fmt.Sprintf("Querying %s", requestString))
-
-	if err != nil {
-		log.Println(fmt.Sprintf("Could not reach %s", requestString))
-		return nil, &errors.MyError{Err: err.Error()}
+	response, myErr := upstream.get(ctx, coinDeskSource{}.Name(), requestString)
+	if myErr != nil {
+		return nil, myErr
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode == http.StatusOK {
 		coinDeskResponse := new(CoinDeskResponse)
 		err = json.NewDecoder(response.Body).Decode(coinDeskResponse)
 
 		if err != nil {
-			log.Println("Could not decode CoinDesk response")
-			return nil, &errors.MyError{Err: err.Error()}
+			logging.FromContext(ctx).Warn("Could not decode CoinDesk response", logging.ERROR, err)
+			return nil, parseFailure(coinDeskSource{}.Name(), err.Error())
 		}
 		return coinDeskResponse, nil
 	} else {
-		log.Println(fmt.Sprintf("There was an error contacting Coin Desk with response code %d", response.StatusCode))
-		return nil, &errors.MyError{Err: "Coin Desk API error", ErrorCode: http.StatusInternalServerError}
+		logging.FromContext(ctx).Warn("There was an error contacting Coin Desk", logging.STATUS, response.StatusCode)
+		return nil, upstreamError(response.StatusCode, "Coin Desk API error")
 	}
 }
 
-// Given an interval, determine the start and end date for the CoinDesk request and construct it
-func buildCoinDeskRequest(interval string) (string, error) {
-	request, err := http.NewRequest(http.MethodGet, coinDeskHistoricalEndpoint, nil)
+// Given an endpoint, currency and window, construct the CoinDesk request for every day the window touches
+func buildCoinDeskRequest(ctx context.Context, endpoint string, currency string, start, end time.Time) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		log.Println("Could not build CoinDesk URL")
+		logging.FromContext(ctx).Error("Could not build CoinDesk URL", logging.ERROR, err)
 		return EMPTYSTRING, err
 	}
 
 	query := request.URL.Query()
 
-	startDate := getCoinDeskStartDate(interval)
-	endDate := time.Now().Format("2006-01-02")
-
-	query.Add("start", startDate)
-	query.Add("end", endDate)
+	query.Add("currency", currency)
+	query.Add("start", start.UTC().Format(DATELAYOUTSTRING))
+	query.Add("end", end.UTC().Format(DATELAYOUTSTRING))
 
 	request.URL.RawQuery = query.Encode()
 	return request.URL.String(), nil
 }
-
-// Similar to Bitfinex, only support TWOYEAR through MONTH
-func getCoinDeskStartDate(interval string) string {
-	startTime := time.Now()
-
-	switch interval {
-	case TWOYEAR:
-		startTime = startTime.AddDate(-2, 0, 0)
-	case YEAR:
-		startTime = startTime.AddDate(-1, 0, 0)
-	case SIXMONTH:
-		startTime = startTime.AddDate(0, -6, 0)
-	case THREEMONTH:
-		startTime = startTime.AddDate(0, -3, 0)
-	case MONTH:
-		startTime = startTime.AddDate(0, -1, 0)
-	}
-
-	return startTime.Format("2006-01-02")
-}
@@ -0,0 +1,75 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"time"
+)
+
+// ExchangeSeries is the series of one exchange within a Comparison, or the reason it could not be fetched
+type ExchangeSeries struct {
+	Exchange    string            `json:"exchange"`
+	PricePoints []PricePoint      `json:"pricePoints"`
+	Error       *errors.ErrorBody `json:"error,omitempty"`
+}
+
+// Comparison holds the series of several exchanges for the same pair and window, in the order they were asked for
+type Comparison struct {
+	Pair     string    `json:"pair"`
+	Interval string    `json:"interval"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// Every series was resampled to buckets of this many seconds, if any
+	BucketSeconds int64            `json:"bucketSeconds,omitempty"`
+	Series        []ExchangeSeries `json:"series"`
+}
+
+// Given sources and a query, fetch the series of every source at once and optionally resample them to buckets of the
+// same size, so that the comparison takes about as long as the slowest exchange
+//
+// An exchange which fails is reported in its series rather than failing the whole comparison, unless they all fail
+func PollComparison(ctx context.Context, sources []HistoricalSource, query HistoricalQuery, bucket time.Duration) (*Comparison, *errors.MyError) {
+	series := make([]ExchangeSeries, len(sources))
+	failures := make([]*errors.MyError, len(sources))
+
+	myErr := fanOut(ctx, len(sources), fanOutWorkers, func(ctx context.Context, index int) *errors.MyError {
+		source := sources[index]
+		series[index] = ExchangeSeries{Exchange: source.Name(), PricePoints: make([]PricePoint, 0)}
+
+		candles, myErr := source.FetchCandles(ctx, query)
+		if myErr != nil {
+			failures[index] = myErr.From(source.Name())
+			failure := failures[index].Response(EMPTYSTRING).Error
+			series[index].Error = &failure
+			return nil
+		}
+
+		if bucket != 0 {
+			candles = ResampleCandles(candles, bucket)
+		}
+		series[index].PricePoints = ToPricePoints(source, candles)
+		return nil
+	})
+	if myErr != nil {
+		return nil, myErr
+	}
+
+	failed := 0
+	for _, failure := range failures {
+		if failure != nil {
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(sources) {
+		return nil, failures[0]
+	}
+
+	return &Comparison{
+		Pair:          query.Pair,
+		Interval:      query.Interval,
+		Start:         query.Start,
+		End:           query.End,
+		BucketSeconds: int64(bucket / time.Second),
+		Series:        series,
+	}, nil
+}
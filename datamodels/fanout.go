@@ -0,0 +1,65 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"sync"
+)
+
+// The most upstream fetches a single query runs at once, whether they are the partitions of a long window or the
+// exchanges of a comparison; the rate limiter of each upstream still decides when they are actually sent
+const fanOutWorkers = 6
+
+// Call fetch for every index from 0 to n-1 on at most workers goroutines at once, and wait for all of them
+//
+// The context given to fetch is canceled as soon as one of them fails, so that the others stop early, and the first
+// error is returned. Results are reassembled in order by having fetch store them at its index.
+func fanOut(ctx context.Context, n int, workers int, fetch func(ctx context.Context, index int) *errors.MyError) *errors.MyError {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wait     sync.WaitGroup
+		once     sync.Once
+		firstErr *errors.MyError
+	)
+
+	indices := make(chan int)
+	if workers > n {
+		workers = n
+	}
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := range indices {
+				myErr := fetch(ctx, index)
+				if myErr != nil {
+					once.Do(func() {
+						firstErr = myErr
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	handedOut := 0
+handOut:
+	for ; handedOut < n; handedOut++ {
+		select {
+		case indices <- handedOut:
+		case <-ctx.Done():
+			// Everything left would fail immediately
+			break handOut
+		}
+	}
+	close(indices)
+	wait.Wait()
+
+	if firstErr == nil && handedOut < n {
+		// The caller gave up before any fetch noticed
+		return &errors.MyError{Err: "The request was canceled", ErrorCode: statusClientClosedRequest, Code: errors.CANCELED}
+	}
+	return firstErr
+}
@@ -0,0 +1,203 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Two years of daily GDAX data, which takes 3 partitions of at most 300 buckets
+var gdaxTestQuery = HistoricalQuery{Pair: DefaultPair, Interval: TWOYEAR, Start: fixtureTime.AddDate(-2, 0, 0), End: fixtureTime}
+
+// A mock GDAX which holds every request for as long as delay says, given the end of its partition, or until its client
+// goes away
+func newDelayingServer(t *testing.T, delay func(end time.Time) time.Duration) *httptest.Server {
+	exchange := mockexchange.NewExchange()
+	exchange.Now = func() time.Time { return fixtureTime }
+	handler := exchange.Handler()
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		end, _ := time.Parse(time.RFC3339, request.URL.Query().Get("end"))
+		select {
+		case <-time.After(delay(end)):
+		case <-request.Context().Done():
+			return
+		}
+		handler.ServeHTTP(responseWriter, request)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFanOutReassemblesResultsInOrder(t *testing.T) {
+	results := make([]int, 10)
+	myErr := fanOut(context.Background(), len(results), 4, func(ctx context.Context, index int) *errors.MyError {
+		// The later indices finish first
+		time.Sleep(time.Duration(len(results)-index) * time.Millisecond)
+		results[index] = index
+		return nil
+	})
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+
+	for index, result := range results {
+		if result != index {
+			t.Fatalf("fanOut() stored %v, want every index at its own position", results)
+		}
+	}
+}
+
+func TestFanOutLimitsWorkers(t *testing.T) {
+	var running, most int64
+	fanOut(context.Background(), 20, 3, func(ctx context.Context, index int) *errors.MyError {
+		now := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			seen := atomic.LoadInt64(&most)
+			if now <= seen || atomic.CompareAndSwapInt64(&most, seen, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+
+	if most > 3 {
+		t.Errorf("fanOut() ran %d fetches at once, want at most 3", most)
+	}
+}
+
+func TestFanOutStopsAtTheFirstError(t *testing.T) {
+	var fetched int64
+	myErr := fanOut(context.Background(), 100, 2, func(ctx context.Context, index int) *errors.MyError {
+		atomic.AddInt64(&fetched, 1)
+		if index == 1 {
+			return &errors.MyError{Err: "partition 1 failed", Code: errors.UPSTREAMERROR}
+		}
+
+		select {
+		case <-ctx.Done():
+			return contextError("test", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+			return nil
+		}
+	})
+
+	if myErr == nil || myErr.Err != "partition 1 failed" {
+		t.Fatalf("fanOut() = %v, want the error of partition 1", myErr)
+	}
+	if fetched > 4 {
+		t.Errorf("fanOut() started %d of 100 fetches after the first one failed", fetched)
+	}
+}
+
+func TestFanOutCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	myErr := fanOut(ctx, 100, 2, func(ctx context.Context, index int) *errors.MyError {
+		if index == 3 {
+			cancel()
+		}
+		return nil
+	})
+
+	if myErr == nil || myErr.Kind() != errors.CANCELED {
+		t.Fatalf("fanOut() = %v, want %s", myErr, errors.CANCELED)
+	}
+}
+
+func TestStreamGdaxYieldsPartitionsInOrder(t *testing.T) {
+	// The newest partition, which is yielded first, is answered last
+	server := newDelayingServer(t, func(end time.Time) time.Duration {
+		if end.Equal(gdaxTestQuery.End) {
+			return 100 * time.Millisecond
+		}
+		return 0
+	})
+	upstream := &Upstream{BaseURL: server.URL}
+
+	batches := make([][]Candle, 0)
+	myErr := StreamGdaxHistorical(context.Background(), upstream, gdaxTestQuery, func(candles []Candle) error {
+		batches = append(batches, candles)
+		return nil
+	})
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+
+	if len(batches) != 3 {
+		t.Fatalf("StreamGdaxHistorical() yielded %d batches, want one per partition", len(batches))
+	}
+	previous := gdaxTestQuery.End.Unix() + 1
+	for index, batch := range batches {
+		for _, candle := range batch {
+			if candle.Timestamp >= previous {
+				t.Fatalf("batch %d yielded %s after %s, want every candle newest first", index, time.Unix(candle.Timestamp, 0).UTC(), time.Unix(previous, 0).UTC())
+			}
+			previous = candle.Timestamp
+		}
+	}
+}
+
+func TestStreamGdaxCanceledMidStream(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// The newest partition is answered at once and the others only once their client goes away
+	server := newDelayingServer(t, func(end time.Time) time.Duration {
+		if end.Equal(gdaxTestQuery.End) {
+			return 0
+		}
+		return time.Minute
+	})
+	transport := &http.Transport{}
+	upstream := &Upstream{BaseURL: server.URL, Client: &http.Client{Transport: transport}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	yielded := 0
+	started := time.Now()
+	myErr := StreamGdaxHistorical(ctx, upstream, gdaxTestQuery, func(candles []Candle) error {
+		yielded++
+		// The client goes away after the first batch
+		cancel()
+		return nil
+	})
+
+	if myErr == nil || myErr.Kind() != errors.CANCELED {
+		t.Fatalf("StreamGdaxHistorical() = %v, want %s", myErr, errors.CANCELED)
+	}
+	if yielded != 1 {
+		t.Errorf("StreamGdaxHistorical() yielded %d batches after its client went away, want 1", yielded)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("StreamGdaxHistorical() took %s to notice its client went away", elapsed)
+	}
+
+	// Every fetch is done once the stream returns, so only the server and connections have yet to wind down
+	server.Close()
+	transport.CloseIdleConnections()
+	leaked := goroutinesAbove(before, time.Second)
+	if leaked > 0 {
+		t.Errorf("%d goroutines outlived a canceled stream", leaked)
+	}
+}
+
+// How many more goroutines than want are still running once timeout passes, or 0 as soon as there are no more
+func goroutinesAbove(want int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := runtime.NumGoroutine()
+		if running <= want {
+			return 0
+		}
+		if time.Now().After(deadline) {
+			return running - want
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
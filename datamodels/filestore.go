@@ -0,0 +1,74 @@
+package datamodels
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileStore is a CandleStore keeping one JSON file per series in a local directory, so that it runs without any
+// external services
+type FileStore struct {
+	Dir string
+}
+
+// NewFileStore returns a FileStore in dir, creating the directory if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+// Load returns the stored series for a key, or nil if nothing has been stored yet
+func (store *FileStore) Load(key StoreKey) (*StoredSeries, error) {
+	contents, err := os.ReadFile(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	series := new(StoredSeries)
+	err = json.Unmarshal(contents, series)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt candle store file %s: %s", store.path(key), err)
+	}
+	return series, nil
+}
+
+// Save replaces the stored series for a key
+//
+// The series is written to a temporary file first so that a crash never leaves a half-written series behind
+func (store *FileStore) Save(key StoreKey, series *StoredSeries) error {
+	contents, err := json.Marshal(series)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(store.Dir, "series")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(contents)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), store.path(key))
+}
+
+// e.g. kraken_BTC-USD_86400.json
+func (store *FileStore) path(key StoreKey) string {
+	name := strings.Replace(key.String(), "/", "_", -1) + ".json"
+	return filepath.Join(store.Dir, name)
+}
@@ -0,0 +1,151 @@
+package datamodels
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/fixtures"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// go test ./datamodels -run TestParseFixtures -update records the fixtures again through fixtures.Recorder, from the
+// mock exchange but under the URLs of the real APIs, and rewrites the parsed candles they are checked against
+var updateFixtures = flag.Bool("update", false, "record the upstream fixtures and golden candles in testdata again")
+
+const (
+	fixtureDir = "testdata/fixtures"
+	goldenDir  = "testdata/golden"
+)
+
+// The newest data of the recorded fixtures
+var fixtureTime = time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// A recorded response of every adapter, replayed through its whole fetch and parse path
+var fixtureTests = []struct {
+	name    string
+	baseURL string
+	poll    func(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError)
+	query   HistoricalQuery
+}{
+	{
+		name:    "binance",
+		baseURL: binanceBaseURL,
+		poll:    PollBinanceHistorical,
+		query:   HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: fixtureTime.Add(-6 * time.Hour), End: fixtureTime},
+	},
+	{
+		name:    "bitfinex",
+		baseURL: quandlBaseURL,
+		poll:    PollBitfinexHistorical,
+		query:   HistoricalQuery{Pair: DefaultPair, Interval: MONTH, Start: fixtureTime.AddDate(0, 0, -14), End: fixtureTime},
+	},
+	{
+		name:    "bitstamp",
+		baseURL: quandlBaseURL,
+		poll:    PollBitstampHistorical,
+		query:   HistoricalQuery{Pair: DefaultPair, Interval: MONTH, Start: fixtureTime.AddDate(0, 0, -14), End: fixtureTime},
+	},
+	{
+		name:    "gdax",
+		baseURL: gdaxBaseURL,
+		poll:    PollGdaxHistorical,
+		query:   HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: fixtureTime.Add(-6 * time.Hour), End: fixtureTime},
+	},
+	{
+		name:    "index",
+		baseURL: coinDeskBaseURL,
+		poll:    PollCoinDeskHistorical,
+		query:   HistoricalQuery{Pair: DefaultPair, Interval: MONTH, Start: fixtureTime.AddDate(0, 0, -14), End: fixtureTime},
+	},
+	{
+		name:    "kraken",
+		baseURL: krakenBaseURL,
+		poll:    PollKrakenHistorical,
+		query:   HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: fixtureTime.Add(-6 * time.Hour), End: fixtureTime},
+	},
+}
+
+func TestParseFixtures(t *testing.T) {
+	client := &http.Client{Transport: fixtures.NewReplayer(fixtureDir)}
+	if *updateFixtures {
+		client = recordingClient(t)
+	}
+
+	for _, test := range fixtureTests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := &Upstream{BaseURL: test.baseURL, Client: client}
+			candles, myErr := test.poll(context.Background(), upstream, test.query)
+			if myErr != nil {
+				t.Fatal(myErr.Err)
+			}
+			if len(candles) == 0 {
+				t.Fatal("parsed no candles")
+			}
+
+			parsed, err := json.MarshalIndent(candles, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join(goldenDir, test.name+".json")
+			if *updateFixtures {
+				err = os.WriteFile(golden, append(parsed, '\n'), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bytes.TrimSpace(parsed), bytes.TrimSpace(want)) {
+				t.Errorf("the candles parsed from the %s fixtures differ from %s", test.name, golden)
+			}
+		})
+	}
+}
+
+// A client recording into the fixture directory, whose requests are answered by a mock exchange
+func recordingClient(t *testing.T) *http.Client {
+	server := mockexchange.NewServer()
+	t.Cleanup(server.Close)
+	server.Exchange.Now = func() time.Time { return fixtureTime }
+
+	mock, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{fixtureDir, goldenDir} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder, err := fixtures.NewRecorder(fixtureDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Transport = redirectTransport{to: mock}
+	return &http.Client{Transport: recorder}
+}
+
+// Sends every request to another host, leaving the request the caller sees untouched
+type redirectTransport struct {
+	to *url.URL
+}
+
+func (transport redirectTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	redirected := request.Clone(request.Context())
+	redirected.URL.Scheme, redirected.URL.Host = transport.to.Scheme, transport.to.Host
+	redirected.Host = transport.to.Host
+	return http.DefaultTransport.RoundTrip(redirected)
+}
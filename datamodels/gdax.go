@@ -1,11 +1,12 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
 	"github.com/adamhei/historicaldata/trademodels"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -38,103 +39,248 @@ const (
 	minuteBySeconds        = 60
 )
 
-const gdaxHistoricalEndpoint = "https://api.gdax.com/products/BTC-USD/candles"
+// GDAX returns at most this many buckets per request
+const gdaxMaxBuckets = 300
+
+const gdaxBaseURL = "https://api.gdax.com"
+const gdaxHistoricalEndpoint = "/products/%s/candles"
+
+// GDAX allows 3 public requests per second, in bursts of up to 6
+var gdaxLimiter = NewRateLimiter(3, 6)
+
+// Canonical pairs and their GDAX products, which happen to share our naming
+var gdaxSymbols = map[string]string{
+	"BTC-USD": "BTC-USD",
+	"BTC-EUR": "BTC-EUR",
+	"ETH-USD": "ETH-USD",
+	"ETH-EUR": "ETH-EUR",
+	"ETH-BTC": "ETH-BTC",
+	"LTC-USD": "LTC-USD",
+	"LTC-EUR": "LTC-EUR",
+	"LTC-BTC": "LTC-BTC",
+}
 
-// Given an interval, check its validity and attempt to return all GDAX BTC data within that interval, with a
-// pre-determined granularity
-func PollGdaxHistorical(interval string) ([]PricePoint, *errors.MyError) {
-	interval = strings.ToUpper(interval)
-	if gdaxIntervalToGranularity[string(interval)] == 0 {
-		return nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: 400}
+// The GDAX candles API as a HistoricalSource
+type gdaxSource struct {
+	Upstream
+}
+
+func init() {
+	Register(&gdaxSource{Upstream: Upstream{BaseURL: gdaxBaseURL, Limiter: gdaxLimiter, Breaker: newDefaultBreaker()}})
+}
+
+func (gdaxSource) Name() string {
+	return "gdax"
+}
+
+func (gdaxSource) Pairs() []string {
+	return pairsOf(gdaxSymbols)
+}
+
+func (gdaxSource) Intervals() []string {
+	return filterIntervals(func(interval string) bool {
+		return gdaxIntervalToGranularity[interval] != 0
+	})
+}
+
+func (gdaxSource) Granularity(interval string) time.Duration {
+	return time.Duration(gdaxIntervalToGranularity[strings.ToUpper(interval)]) * time.Second
+}
+
+func (gdaxSource) granularities() []time.Duration {
+	granularities := make([]time.Duration, 0)
+	for _, seconds := range []int64{minuteBySeconds, fiveminuteBySeconds, fifteenminuteBySeconds, hourBySeconds, sixhourBySeconds, dailyBySeconds} {
+		granularities = append(granularities, time.Duration(seconds)*time.Second)
 	}
+	return granularities
+}
+
+func (gdaxSource) setGranularity(interval string, granularity time.Duration) {
+	gdaxIntervalToGranularity[interval] = int64(granularity / time.Second)
+}
+
+// Long windows are split into requests of gdaxMaxBuckets
+func (gdaxSource) maxBuckets() int64 {
+	return 0
+}
+
+func (source *gdaxSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	return PollGdaxHistorical(ctx, &source.Upstream, query)
+}
 
-	buckets, myerror := fetchGdaxBuckets(interval)
+func (source *gdaxSource) StreamCandles(ctx context.Context, query HistoricalQuery, yield func(candles []Candle) error) *errors.MyError {
+	return StreamGdaxHistorical(ctx, &source.Upstream, query, yield)
+}
+
+// GDAX PricePoints have always reported the second field of each bucket, which is the low
+func (gdaxSource) ReferencePrice(candle Candle) *float64 {
+	return candle.Low
+}
+
+// Given a context, upstream and query, check its validity and attempt to return all GDAX data for its pair within its
+// window, with a pre-determined granularity
+func PollGdaxHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	candles := make([]Candle, 0)
 
+	myerror := StreamGdaxHistorical(ctx, upstream, query, func(batch []Candle) error {
+		candles = append(candles, batch...)
+		return nil
+	})
 	if myerror != nil {
 		return nil, myerror
 	}
 
-	log.Println(fmt.Sprintf("Found %d buckets from GDAX", len(buckets)))
+	logging.FromContext(ctx).Debug("Found GDAX buckets", "buckets", len(candles))
+
+	return candles, nil
+}
+
+// Like PollGdaxHistorical, but yield the Candles of every GDAX request as soon as it completes, newest first
+func StreamGdaxHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery, yield func(candles []Candle) error) *errors.MyError {
+	interval := strings.ToUpper(query.Interval)
+	if gdaxIntervalToGranularity[string(interval)] == 0 {
+		return invalidInterval(interval)
+	}
+
+	product, myerror := lookupSymbol(gdaxSymbols, gdaxSource{}.Name(), query.Pair)
+	if myerror != nil {
+		return myerror
+	}
 
-	return generalizeGdaxBuckets(buckets), nil
+	return fetchGdaxBuckets(ctx, upstream, product, interval, query.Start, query.End, func(buckets [][]float64) error {
+		return yield(generalizeGdaxBuckets(buckets))
+	})
 }
 
-// Convert an array of GdaxBuckets to the more general PricePoints
-func generalizeGdaxBuckets(buckets [][]float64) []PricePoint {
-	pricePoints := make([]PricePoint, len(buckets))
+// Convert an array of GdaxBuckets to the more general Candles
+// Each bucket is [time, low, high, open, close, volume]
+func generalizeGdaxBuckets(buckets [][]float64) []Candle {
+	candles := make([]Candle, len(buckets))
 
 	for index, val := range buckets {
-		price := strconv.FormatFloat(val[1], 'f', -1, 64)
-		pricePoints[index] = PricePoint{int64(val[0]), price}
+		candles[index] = Candle{
+			Timestamp: int64(val[0]),
+			Low:       floatPtr(val[1]),
+			High:      floatPtr(val[2]),
+			Open:      floatPtr(val[3]),
+			Close:     floatPtr(val[4]),
+			Volume:    floatPtr(val[5]),
+		}
 	}
 
-	return pricePoints
+	return candles
 }
 
-// Given a time interval, return a slice of timestamps and BTC prices from GDAX within that interval looking back from today
+// Given a context, upstream, product, interval and window, yield the timestamps and prices from GDAX within that
+// window request by request, newest first
 //
-// Some time intervals, such as 2 years and 1 year, require multiple requests to GDAX,
+// Long windows, such as 2 years of daily data, require multiple requests to GDAX,
 // which is why we treat the intervalPartition as a slice of an arbitrary number of timePeriods/requests to make
-func fetchGdaxBuckets(interval string) ([][]float64, *errors.MyError) {
-	intervalPartition := getIntervalPartition(interval)
+// The requests are sent concurrently, but each is only yielded once those before it have been, so the window takes
+// roughly as long as its slowest request. Each request is retried on its own, so a transient failure of one partition
+// does not fail the whole window, and a partition which does fail cancels those still in flight.
+func fetchGdaxBuckets(ctx context.Context, upstream *Upstream, product string, interval string, start, end time.Time, yield func(buckets [][]float64) error) *errors.MyError {
 	granularity := gdaxIntervalToGranularity[interval]
+	intervalPartition := getIntervalPartition(start, end, granularity)
 
-	buckets := make([][]float64, 0)
-	for _, timePeriod := range intervalPartition {
-		requestString, err := buildGdaxRequest(granularity, timePeriod.start, timePeriod.end)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		if err != nil {
-			return nil, &errors.MyError{Err: err.Error()}
+	// The buckets of every partition, which may be yielded once its channel is closed
+	buckets := make([][][]float64, len(intervalPartition))
+	fetched := make([]chan struct{}, len(intervalPartition))
+	for index := range fetched {
+		fetched[index] = make(chan struct{})
+	}
+
+	var fanOutErr *errors.MyError
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		fanOutErr = fanOut(ctx, len(intervalPartition), fanOutWorkers, func(ctx context.Context, index int) *errors.MyError {
+			defer close(fetched[index])
+
+			var myErr *errors.MyError
+			buckets[index], myErr = fetchGdaxPartition(ctx, upstream, product, granularity, intervalPartition[index])
+			return myErr
+		})
+	}()
+
+	for index := range intervalPartition {
+		select {
+		case <-fetched[index]:
+		case <-finished:
+			select {
+			case <-fetched[index]:
+			default:
+				// Never fetched, since an earlier partition failed
+				return fanOutErr
+			}
 		}
 
-		response, err := http.Get(requestString)
-		log.Println(fmt.Sprintf("Querying %s", requestString))
+		if buckets[index] == nil {
+			<-finished
+			return fanOutErr
+		}
 
-		if err != nil {
-			log.Println("Could not reach ", requestString)
-			response.Body.Close()
-			return nil, &errors.MyError{Err: "Failed to reach GDAX API", ErrorCode: http.StatusInternalServerError}
+		myErr := yieldError(yield(buckets[index]))
+		if myErr != nil {
+			cancel()
+			<-finished
+			return myErr
 		}
-		if response.StatusCode == http.StatusOK {
-			tempBuckets := make([][]float64, 0)
-			err = json.NewDecoder(response.Body).Decode(&tempBuckets)
-			response.Body.Close()
-
-			if err != nil {
-				log.Println("Could not decode GDAX response")
-				return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError}
-			}
+	}
 
-			// Filter out extra data
-			tempBuckets = filterBuckets(timePeriod.start, timePeriod.end, tempBuckets)
+	<-finished
+	return fanOutErr
+}
 
-			buckets = append(buckets, tempBuckets...)
-		} else {
-			errResp := new(trademodels.GdaxError)
-			err = json.NewDecoder(response.Body).Decode(errResp)
+// Fetch the buckets of a single partition from GDAX, or nil and the reason it failed
+func fetchGdaxPartition(ctx context.Context, upstream *Upstream, product string, granularity int64, timePeriod timePeriod) ([][]float64, *errors.MyError) {
+	requestString, err := buildGdaxRequest(ctx, upstream.endpoint(fmt.Sprintf(gdaxHistoricalEndpoint, product)), granularity, timePeriod.start, timePeriod.end)
 
-			response.Body.Close()
-			if err != nil {
-				log.Println("Could not decode GDAX error response with code ", response.StatusCode)
-				return nil, &errors.MyError{Err: err.Error()}
-			} else {
-				return nil, &errors.MyError{Err: errResp.Message}
-			}
+	if err != nil {
+		return nil, &errors.MyError{Err: err.Error()}
+	}
+
+	response, myErr := upstream.get(ctx, gdaxSource{}.Name(), requestString)
+	if myErr != nil {
+		return nil, myErr
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		errResp := new(trademodels.GdaxError)
+		err = json.NewDecoder(response.Body).Decode(errResp)
+
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not decode GDAX error response", logging.STATUS, response.StatusCode, logging.ERROR, err)
+			return nil, upstreamError(response.StatusCode, "GDAX API error")
 		}
+		return nil, upstreamError(response.StatusCode, errResp.Message)
 	}
 
-	return buckets, nil
+	tempBuckets := make([][]float64, 0)
+	err = json.NewDecoder(response.Body).Decode(&tempBuckets)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not decode GDAX response", logging.ERROR, err)
+		return nil, parseFailure(gdaxSource{}.Name(), err.Error())
+	}
+
+	// Filter out extra data
+	return filterBuckets(timePeriod.start, timePeriod.end, tempBuckets), nil
 }
 
 // We want to send only those price data which are within the time interval the user requested
 // Unfortunately, GDAX is lazy and gives us too much data sometimes
+// The end is exclusive so that the boundary between two consecutive timePeriods is only returned once
 // See: https://docs.gdax.com/#get-historic-rates
 func filterBuckets(start time.Time, end time.Time, buckets [][]float64) [][]float64 {
 	filtered := make([][]float64, 0)
 
 	for _, bucket := range buckets {
 		timestamp := time.Unix(int64(bucket[0]), 0)
-		if timestamp.Before(end) && timestamp.After(start) || timestamp.Equal(start) || timestamp.Equal(end) {
+		if timestamp.Before(end) && (timestamp.After(start) || timestamp.Equal(start)) {
 			filtered = append(filtered, bucket)
 		}
 	}
@@ -142,12 +288,13 @@ func filterBuckets(start time.Time, end time.Time, buckets [][]float64) [][]floa
 	return filtered
 }
 
-// Given a granularity and start and end times, buildGdaxRequest returns the formatted GET request URL for the GDAX API
-// Ex: https://api.gdax.com/products/BTC-USD/candles?start=2017-01-15&end=2017-01-16&granularity=3600
-func buildGdaxRequest(granularity int64, start time.Time, end time.Time) (string, error) {
-	req, err := http.NewRequest("GET", gdaxHistoricalEndpoint, nil)
+// Given the candles endpoint of a product, a granularity and start and end times, buildGdaxRequest returns the formatted
+// GET request URL for the GDAX API
+// Ex: https://api.gdax.com/products/BTC-USD/candles?start=2017-01-15T00:00:00Z&end=2017-01-16T00:00:00Z&granularity=3600
+func buildGdaxRequest(ctx context.Context, endpoint string, granularity int64, start time.Time, end time.Time) (string, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
-		log.Println("Could not build GDAX historical URL")
+		logging.FromContext(ctx).Error("Could not build GDAX historical URL", logging.ERROR, err)
 		return "", err
 	}
 
@@ -156,45 +303,27 @@ func buildGdaxRequest(granularity int64, start time.Time, end time.Time) (string
 
 	q.Add("granularity", strconv.FormatInt(granularity, 10))
 
-	q.Add("start", start.Format("2006-01-02"))
-	q.Add("end", end.Format("2006-01-02"))
+	q.Add("start", start.UTC().Format(time.RFC3339))
+	q.Add("end", end.UTC().Format(time.RFC3339))
 
 	req.URL.RawQuery = q.Encode()
 	return req.URL.String(), nil
 }
 
-// Given an interval, return a slice partition of that interval into timePeriods in reverse chronological order
-// to preserve order when making consecutive requests to GDAX
-func getIntervalPartition(interval string) []timePeriod {
-	nowRounded := roundTime(time.Now())
-	nowRounded = nowRounded.AddDate(0, 0, 1)
+// Given a window and granularity, return a slice partition of that window into timePeriods in reverse chronological
+// order to preserve order when making consecutive requests to GDAX
+//
+// Each timePeriod holds at most gdaxMaxBuckets buckets, the most GDAX returns for a single request
+func getIntervalPartition(start time.Time, end time.Time, granularity int64) []timePeriod {
+	periodLength := time.Duration(granularity*gdaxMaxBuckets) * time.Second
 
 	intervalPartition := make([]timePeriod, 0)
-	switch interval {
-	case TWOYEAR:
-		twoYearsAgo := nowRounded.AddDate(-2, 0, 0)
-		for timeIndex := nowRounded.AddDate(0, -6, 0); timeIndex.After(twoYearsAgo) || timeIndex.Equal(twoYearsAgo); timeIndex = timeIndex.AddDate(0, -6, 0) {
-			intervalPartition = append(intervalPartition, timePeriod{timeIndex, timeIndex.AddDate(0, 6, 0)})
-		}
-	case YEAR:
-		oneYearAgo := nowRounded.AddDate(-1, 0, 0)
-		for timeIndex := nowRounded.AddDate(0, -6, 0); timeIndex.After(oneYearAgo) || timeIndex.Equal(oneYearAgo); timeIndex = timeIndex.AddDate(0, -6, 0) {
-			intervalPartition = append(intervalPartition, timePeriod{timeIndex, timeIndex.AddDate(0, 6, 0)})
+	for periodEnd := end; periodEnd.After(start); periodEnd = periodEnd.Add(-periodLength) {
+		periodStart := periodEnd.Add(-periodLength)
+		if periodStart.Before(start) {
+			periodStart = start
 		}
-	case SIXMONTH:
-		intervalPartition = []timePeriod{{nowRounded.AddDate(0, -6, 0), nowRounded}}
-	case THREEMONTH:
-		intervalPartition = []timePeriod{{nowRounded.AddDate(0, -3, 0), nowRounded}}
-	case MONTH:
-		intervalPartition = []timePeriod{{nowRounded.AddDate(0, -1, 0), nowRounded}}
-	case WEEK:
-		first := nowRounded.AddDate(0, 0, -8)
-		second := first.AddDate(0, 0, 3)
-		third := second.AddDate(0, 0, 3)
-		fourth := third.AddDate(0, 0, 2)
-		intervalPartition = []timePeriod{{third, fourth}, {second, third}, {first, second}}
-	case DAY:
-		intervalPartition = []timePeriod{{nowRounded.AddDate(0, 0, -2), nowRounded}}
+		intervalPartition = append(intervalPartition, timePeriod{periodStart, periodEnd})
 	}
 
 	return intervalPartition
@@ -1,70 +1,66 @@
 package datamodels
 
 import (
-	"fmt"
 	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
 	"github.com/adamhei/historicaldata/trademodels"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"log"
-	"time"
+	"log/slog"
+	"net/http"
 )
 
 // Deprecated: currently obsolete since we are no longer populating the database with Gemini data
-func QueryGeminiHistorical(db *mgo.Database, interval string) ([]trademodels.GeminiOrder, *errors.MyError) {
-	coll := db.C(trademodels.GeminiCollection)
-
-	startTimeMs := getStartTimeMs(interval)
-
-	log.Println(fmt.Sprintf("Searching for Gemini trades since %s", time.Unix(0, startTimeMs*int64(time.Millisecond))))
-
-	query := coll.Find(bson.M{"timestampms": bson.M{"$gte": startTimeMs}})
+func QueryGeminiHistorical(db *mgo.Database, historicalQuery HistoricalQuery) ([]trademodels.GeminiOrder, *errors.MyError) {
+	query := findGeminiTrades(db, historicalQuery)
 
 	count, err := query.Count()
 	if err != nil {
-		log.Println("Could not count the number of Gemini trades")
-		panic(err)
+		slog.Error("Could not count the number of Gemini trades", logging.ERROR, err)
+		return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError, Code: errors.DBERROR}
 	}
-	log.Println(fmt.Sprintf("Found %d trades", count))
+	slog.Debug("Found Gemini trades", "trades", count)
 
 	results := make([]trademodels.GeminiOrder, 0)
 	err = query.All(&results)
 
 	if err != nil {
-		return nil, &errors.MyError{Err: err.Error(), ErrorCode: 500}
+		return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError, Code: errors.DBERROR}
 	} else {
 		return results, nil
 	}
 }
 
-// Return the time in milliseconds that is one "interval" from now
-func getStartTimeMs(interval string) int64 {
-	startTime := roundTime(time.Now())
+// Deprecated: like QueryGeminiHistorical, but yield the trades one by one as they are read from the database instead
+// of loading them all into memory, stopping at the first error returned by yield
+func StreamGeminiHistorical(db *mgo.Database, historicalQuery HistoricalQuery, yield func(order trademodels.GeminiOrder) error) *errors.MyError {
+	iter := findGeminiTrades(db, historicalQuery).Iter()
+
+	var order trademodels.GeminiOrder
+	for iter.Next(&order) {
+		err := yield(order)
+		if err != nil {
+			iter.Close()
+			return yieldError(err)
+		}
+	}
 
-	switch interval {
-	case TWOYEAR:
-		startTime = startTime.AddDate(-2, 0, 0)
-	case YEAR:
-		startTime = startTime.AddDate(-1, 0, 0)
-	case SIXMONTH:
-		startTime = startTime.AddDate(0, -6, 0)
-	case THREEMONTH:
-		startTime = startTime.AddDate(0, -3, 0)
-	case MONTH:
-		startTime = startTime.AddDate(0, -1, 0)
-	case WEEK:
-		startTime = startTime.AddDate(0, 0, -4)
-	case DAY:
-		startTime = startTime.AddDate(0, 0, -1)
-	case TWELVEHOUR:
-		startTime = startTime.Add(-12 * time.Hour)
-	case SIXHOUR:
-		startTime = startTime.Add(-6 * time.Hour)
-	case HOUR:
-		startTime = startTime.Add(-1 * time.Hour)
-	case THIRTYMINUTE:
-		startTime = startTime.Add(-30 * time.Minute)
+	err := iter.Close()
+	if err != nil {
+		slog.Error("Could not read the Gemini trades", logging.ERROR, err)
+		return &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError, Code: errors.DBERROR}
 	}
+	return nil
+}
+
+// The Gemini trades within the window of a query
+func findGeminiTrades(db *mgo.Database, historicalQuery HistoricalQuery) *mgo.Query {
+	coll := db.C(trademodels.GeminiCollection)
+
+	startTimeMs := roundTime(historicalQuery.Start).Unix() * 1000
+	endTimeMs := historicalQuery.End.Unix() * 1000
+
+	slog.Debug("Searching for Gemini trades", "start", historicalQuery.Start, "end", historicalQuery.End)
 
-	return startTime.Unix() * 1000
+	return coll.Find(bson.M{"timestampms": bson.M{"$gte": startTimeMs, "$lte": endTimeMs}})
 }
@@ -0,0 +1,91 @@
+package datamodels
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// granularSource is implemented by sources whose exchange serves more than one bucket size, so that the granularity of
+// each interval can be configured
+type granularSource interface {
+	HistoricalSource
+	// The bucket sizes the exchange serves
+	granularities() []time.Duration
+	// Serve an interval in buckets of granularity, which must be one of granularities
+	setGranularity(interval string, granularity time.Duration)
+	// The most buckets the exchange serves for one window, or 0 if the source fetches a window in as many requests as
+	// it takes
+	maxBuckets() int64
+}
+
+// CheckGranularity reports whether the named source could serve an interval in buckets of granularity, which must be
+// a bucket size its exchange serves and cut the interval into no more buckets than the exchange or MAXWINDOWBUCKETS
+// allow
+func CheckGranularity(name string, interval string, granularity time.Duration) error {
+	source, ok := GetSource(name)
+	if !ok {
+		return fmt.Errorf("unknown exchange %s", name)
+	}
+
+	interval = strings.ToUpper(interval)
+	if !contains(source.Intervals(), interval) {
+		return fmt.Errorf("%s does not serve the %s interval; pick one of %s", source.Name(), interval, strings.Join(source.Intervals(), ", "))
+	}
+	if granularity == source.Granularity(interval) {
+		return nil
+	}
+
+	granular, ok := source.(granularSource)
+	if !ok {
+		return fmt.Errorf("%s only serves %s buckets", source.Name(), source.Granularity(interval))
+	}
+	supported := granular.granularities()
+	for _, candidate := range supported {
+		if candidate == granularity {
+			return checkBuckets(granular, interval, granularity)
+		}
+	}
+
+	sort.Slice(supported, func(i, j int) bool {
+		return supported[i] < supported[j]
+	})
+	names := make([]string, len(supported))
+	for index, candidate := range supported {
+		names[index] = candidate.String()
+	}
+	return fmt.Errorf("%s does not serve %s buckets; pick one of %s", source.Name(), granularity, strings.Join(names, ", "))
+}
+
+// Report an interval which takes more buckets of granularity than a source serves at once
+func checkBuckets(source granularSource, interval string, granularity time.Duration) error {
+	limit := int64(MAXWINDOWBUCKETS)
+	if max := source.maxBuckets(); max > 0 && max < limit {
+		limit = max
+	}
+
+	end := time.Now()
+	buckets := int64(end.Sub(intervalStart(interval, end)) / granularity)
+	if buckets > limit {
+		return fmt.Errorf("%s takes %d buckets of %s, but %s serves at most %d at once", interval, buckets, granularity, source.Name(), limit)
+	}
+	return nil
+}
+
+// SetGranularity makes the named source serve an interval in buckets of granularity, which must be one of the bucket
+// sizes its exchange serves
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetGranularity(name string, interval string, granularity time.Duration) error {
+	err := CheckGranularity(name, interval, granularity)
+	if err != nil {
+		return err
+	}
+
+	source, _ := GetSource(name)
+	if granular, ok := source.(granularSource); ok {
+		granular.setGranularity(strings.ToUpper(interval), granularity)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckGranularity(t *testing.T) {
+	tests := []struct {
+		exchange    string
+		interval    string
+		granularity time.Duration
+		problem     string
+	}{
+		{exchange: "kraken", interval: DAY, granularity: 15 * time.Minute},
+		{exchange: "kraken", interval: "week", granularity: time.Hour},
+		{exchange: "kraken", interval: DAY, granularity: 7 * time.Minute, problem: "does not serve 7m0s buckets"},
+		{exchange: "kraken", interval: DAY, granularity: time.Minute, problem: "kraken serves at most 720"},
+		{exchange: "kraken", interval: YEAR, granularity: 4 * time.Hour, problem: "kraken serves at most 720"},
+		{exchange: "binance", interval: WEEK, granularity: 15 * time.Minute},
+		{exchange: "binance", interval: MONTH, granularity: 15 * time.Minute, problem: "binance serves at most 1000"},
+		{exchange: "binance", interval: DAY, granularity: 5 * time.Minute},
+		{exchange: "binance", interval: MONTH, granularity: 12 * time.Hour},
+		{exchange: "binance", interval: DAY, granularity: 3 * time.Minute},
+		{exchange: "binance", interval: WEEK, granularity: 2 * time.Hour},
+		{exchange: "binance", interval: SIXMONTH, granularity: 8 * time.Hour},
+		{exchange: "binance", interval: YEAR, granularity: 8 * time.Hour, problem: "binance serves at most 1000"},
+		{exchange: "binance", interval: TWOYEAR, granularity: 3 * 24 * time.Hour},
+		{exchange: "binance", interval: TWOYEAR, granularity: 30 * 24 * time.Hour},
+		{exchange: "binance", interval: DAY, granularity: 10 * time.Minute, problem: "does not serve 10m0s buckets"},
+		{exchange: "gdax", interval: MONTH, granularity: 15 * time.Minute},
+		{exchange: "gdax", interval: MONTH, granularity: time.Minute, problem: "gdax serves at most 5000"},
+		{exchange: "index", interval: MONTH, granularity: time.Hour, problem: "only serves"},
+		{exchange: "kraken", interval: "DECADE", granularity: time.Hour, problem: "does not serve the DECADE interval"},
+	}
+
+	for _, test := range tests {
+		err := CheckGranularity(test.exchange, test.interval, test.granularity)
+		if test.problem == EMPTYSTRING && err != nil {
+			t.Errorf("CheckGranularity(%s, %s, %s) = %s, want nil", test.exchange, test.interval, test.granularity, err)
+		}
+		if test.problem != EMPTYSTRING && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("CheckGranularity(%s, %s, %s) = %v, want %q", test.exchange, test.interval, test.granularity, err, test.problem)
+		}
+	}
+}
+
+// Every bucket size the adapter knows is one the exchange serves, in buckets of that length
+func TestBinanceGranularities(t *testing.T) {
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	server := mockexchange.NewServer()
+	defer server.Close()
+	server.Exchange.Now = func() time.Time { return now }
+	upstream := &Upstream{BaseURL: server.URL}
+
+	dayCode := binanceIntervals[DAY]
+	defer func() { binanceIntervals[DAY] = dayCode }()
+
+	for code, granularity := range binanceGranularities {
+		binanceIntervals[DAY] = code
+		query := HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: now.Add(-4 * granularity), End: now}
+
+		candles, myErr := PollBinanceHistorical(context.Background(), upstream, query)
+		if myErr != nil {
+			t.Errorf("%s: %s", code, myErr.Err)
+			continue
+		}
+		if len(candles) < 2 {
+			t.Errorf("%s: got %d buckets, want several", code, len(candles))
+			continue
+		}
+		if step := time.Duration(candles[0].Timestamp-candles[1].Timestamp) * time.Second; step != granularity {
+			t.Errorf("%s: buckets are %s apart, want %s", code, step, granularity)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
-	"log"
+	"github.com/adamhei/historicalapi/logging"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,15 +13,16 @@ import (
 )
 
 // Top level Kraken response body
+// The result is keyed by the requested pair, alongside "last"
 type KrakenResponse struct {
-	Error  []string        `json:"error"`
-	Result KrakenResultMap `json:"result"`
+	Error  []string                   `json:"error"`
+	Result map[string]json.RawMessage `json:"result"`
 }
 
 // Mid-level Kraken response body containing actual price data
 type KrakenResultMap struct {
-	Buckets [][]json.RawMessage `json:"XXBTZUSD"`
-	Last    int64               `json:"last"`
+	Buckets [][]json.RawMessage
+	Last    int64
 }
 
 // Represents an individual array of instantaneous price data
@@ -54,148 +56,309 @@ var krakenIntervalToGranularity = map[string]int64{
 	DAY:        fiveMinutes,
 }
 
+// Kraken only serves the 720 most recent buckets of each granularity
+const krakenMaxBuckets = 720
+
+const krakenBaseURL = "https://api.kraken.com"
+
+// Kraken allows roughly one public call per second
+var krakenLimiter = NewRateLimiter(1, 2)
+
 const krakenApiVersion = "0"
-const krakenEndpoint = "https://api.kraken.com/%s/public/OHLC"
+const krakenEndpoint = "/%s/public/OHLC"
+
 var krakenHistoricalEndpoint = fmt.Sprintf(krakenEndpoint, krakenApiVersion)
 
-// Given an interval, check its validity and return all Kraken BTC data within that interval, by a pre-determined granularity
-func PollKrakenHistorical(interval string) ([]PricePoint, *errors.MyError) {
-	interval = strings.ToUpper(interval)
+// Canonical pairs and their Kraken symbols
+var krakenSymbols = map[string]string{
+	"BTC-USD": "XXBTZUSD",
+	"BTC-EUR": "XXBTZEUR",
+	"ETH-USD": "XETHZUSD",
+	"ETH-EUR": "XETHZEUR",
+	"ETH-BTC": "XETHXXBT",
+	"LTC-USD": "XLTCZUSD",
+	"LTC-EUR": "XLTCZEUR",
+	"LTC-BTC": "XLTCXXBT",
+}
+
+// The Kraken OHLC API as a HistoricalSource
+type krakenSource struct {
+	Upstream
+}
+
+func init() {
+	Register(&krakenSource{Upstream: Upstream{BaseURL: krakenBaseURL, Limiter: krakenLimiter, Breaker: newDefaultBreaker(), Inspect: inspectKrakenResponse}})
+}
+
+func (krakenSource) Name() string {
+	return "kraken"
+}
+
+func (krakenSource) Pairs() []string {
+	return pairsOf(krakenSymbols)
+}
+
+func (krakenSource) Intervals() []string {
+	return filterIntervals(func(interval string) bool {
+		return krakenIntervalToGranularity[interval] != 0
+	})
+}
+
+func (krakenSource) Granularity(interval string) time.Duration {
+	return time.Duration(krakenIntervalToGranularity[strings.ToUpper(interval)]) * time.Minute
+}
+
+func (krakenSource) granularities() []time.Duration {
+	granularities := make([]time.Duration, 0)
+	for _, minutes := range []int64{minute, fiveMinutes, fifteenMinutes, thirtyMinutes, hourByMinutes, fourHourByMinutes, oneDayByMinutes, oneWeekByMinutes, fifteenDaysByMinutes} {
+		granularities = append(granularities, time.Duration(minutes)*time.Minute)
+	}
+	return granularities
+}
+
+func (krakenSource) setGranularity(interval string, granularity time.Duration) {
+	krakenIntervalToGranularity[interval] = int64(granularity / time.Minute)
+}
+
+func (krakenSource) maxBuckets() int64 {
+	return krakenMaxBuckets
+}
+
+func (source *krakenSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	return PollKrakenHistorical(ctx, &source.Upstream, query)
+}
+
+func (krakenSource) ReferencePrice(candle Candle) *float64 {
+	return candle.Open
+}
+
+// Given a context, upstream and query, check its validity and return all Kraken data for its pair within its window,
+// by a pre-determined granularity
+//
+// Kraken only serves the 720 most recent buckets of each granularity, so a window which ends before the oldest of them is
+// rejected, and one which starts before it is served from there on
+func PollKrakenHistorical(ctx context.Context, upstream *Upstream, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	interval := strings.ToUpper(query.Interval)
 	if krakenIntervalToGranularity[string(interval)] == 0 {
-		return nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: http.StatusBadRequest}
+		return nil, invalidInterval(interval)
+	}
+
+	symbol, err := lookupSymbol(krakenSymbols, krakenSource{}.Name(), query.Pair)
+	if err != nil {
+		return nil, err
 	}
 
-	resultMap, err := fetchKrakenResponse(interval)
+	resultMap, err := fetchKrakenResponse(ctx, upstream, symbol, interval, query.Start)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseKrakenBuckets(resultMap.Buckets)
+	candles, err := parseKrakenBuckets(ctx, resultMap.Buckets)
+	if err != nil {
+		return nil, err
+	}
+	if len(candles) > 0 && candles[len(candles)-1].Timestamp > query.End.Unix() {
+		return nil, beyondKrakenReach(interval, candles[len(candles)-1].Timestamp)
+	}
+
+	// Kraken has no end parameter
+	return filterCandles(candles, query, krakenSource{}.Granularity(interval)), nil
 }
 
-// Given the Kraken 2D-price data array, convert it to an array of the universal PricePoint data structure
-func parseKrakenBuckets(buckets [][]json.RawMessage) ([]PricePoint, *errors.MyError) {
+// The error of a window which ended before the oldest bucket Kraken still serves
+func beyondKrakenReach(interval string, oldest int64) *errors.MyError {
+	return &errors.MyError{
+		Err:       fmt.Sprintf("Please provide a later window; kraken serves at most %d buckets of %s, the oldest of which starts at %s", krakenMaxBuckets, krakenSource{}.Granularity(interval), time.Unix(oldest, 0).UTC().Format(time.RFC3339)),
+		ErrorCode: http.StatusBadRequest,
+		Code:      errors.INVALIDREQUEST,
+		Source:    krakenSource{}.Name(),
+	}
+}
+
+// Given the Kraken 2D-price data array, convert it to an array of the universal Candle data structure
+func parseKrakenBuckets(ctx context.Context, buckets [][]json.RawMessage) ([]Candle, *errors.MyError) {
 	n := len(buckets)
-	pricePoints := make([]PricePoint, n)
+	candles := make([]Candle, n)
 
 	for index, val := range buckets {
 		bucket := new(KrakenBucket)
 
 		err := unmarshalKrakenBucket(val, bucket)
+		if err != nil {
+			return nil, parseFailure(krakenSource{}.Name(), err.Error())
+		}
 
+		candle, err := bucket.toCandle()
 		if err != nil {
-			return nil, &errors.MyError{Err: err.Error()}
+			logging.FromContext(ctx).Warn("Could not parse Kraken prices", logging.ERROR, err)
+			return nil, parseFailure(krakenSource{}.Name(), err.Error())
 		}
 
-		// Return the pricepoints in descending order (newest to oldest)
-		pricePoints[n-1-index] = PricePoint{bucket.Timestamp, bucket.Open}
+		// Return the candles in descending order (newest to oldest)
+		candles[n-1-index] = *candle
 	}
-	return pricePoints, nil
+	return candles, nil
 }
 
 // Since Kraken decided to return an array of strings and integers, we need to parse it by hand
-// For now, just parsing timestamp and open price
-//
-// TODO: Add more fields as necessary
+// Each bucket is [time, open, high, low, close, vwap, volume, count]
 func unmarshalKrakenBucket(jsonBucket []json.RawMessage, bucket *KrakenBucket) error {
-	err := json.Unmarshal(jsonBucket[0], &bucket.Timestamp)
-	if err != nil {
-		return err
+	if len(jsonBucket) < 8 {
+		return fmt.Errorf("Kraken bucket has %d fields, expected 8", len(jsonBucket))
 	}
-	err = json.Unmarshal(jsonBucket[1], &bucket.Open)
-	if err != nil {
-		return err
+
+	fields := []interface{}{
+		&bucket.Timestamp,
+		&bucket.Open, &bucket.High, &bucket.Low, &bucket.Close,
+		&bucket.Vwap, &bucket.Volume,
+		&bucket.Count,
+	}
+	for index, field := range fields {
+		err := json.Unmarshal(jsonBucket[index], field)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// Given an interval:
+// Kraken sends its prices as strings, which we parse into a Candle
+func (bucket *KrakenBucket) toCandle() (*Candle, error) {
+	candle := &Candle{Timestamp: bucket.Timestamp, Trades: &bucket.Count}
+
+	prices := []string{bucket.Open, bucket.High, bucket.Low, bucket.Close, bucket.Vwap, bucket.Volume}
+	fields := []**float64{&candle.Open, &candle.High, &candle.Low, &candle.Close, &candle.VWAP, &candle.Volume}
+	for index, price := range prices {
+		parsed, err := parsePrice(price)
+		if err != nil {
+			return nil, err
+		}
+		*fields[index] = parsed
+	}
+
+	return candle, nil
+}
+
+// Given a context, upstream, symbol, interval and start time:
 // 1. Construct the GET request
 // 2. Fetch the historical data from Kraken
 // 3. Return KrakenResultMap if successful, error else
-func fetchKrakenResponse(interval string) (*KrakenResultMap, *errors.MyError) {
-	requestString, err := buildKrakenRequest(interval)
+func fetchKrakenResponse(ctx context.Context, upstream *Upstream, symbol string, interval string, since time.Time) (*KrakenResultMap, *errors.MyError) {
+	requestString, err := buildKrakenRequest(ctx, upstream.endpoint(krakenHistoricalEndpoint), symbol, interval, since)
 
 	if err != nil {
-		log.Println("Could build Kraken request string")
+		logging.FromContext(ctx).Error("Could not build Kraken request string", logging.ERROR, err)
 		return nil, &errors.MyError{Err: err.Error()}
 	}
 
-	response, err := http.Get(requestString)
-	defer response.Body.Close()
-
-	log.Println(fmt.Sprintf("Querying %s", requestString))
-
-	if err != nil {
-		log.Println("Could not reach ", requestString)
-		return nil, &errors.MyError{Err: err.Error()}
+	response, myErr := upstream.get(ctx, krakenSource{}.Name(), requestString)
+	if myErr != nil {
+		return nil, myErr
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode == http.StatusOK {
 		krakenResponse := new(KrakenResponse)
 		err = json.NewDecoder(response.Body).Decode(krakenResponse)
 
 		if err != nil {
-			log.Println("Could not decode Kraken Response")
-			return nil, &errors.MyError{Err: err.Error()}
+			logging.FromContext(ctx).Warn("Could not decode Kraken response", logging.ERROR, err)
+			return nil, parseFailure(krakenSource{}.Name(), err.Error())
 		}
 		if len(krakenResponse.Error) > 0 {
-			log.Println(krakenResponse.Error[0])
-			return nil, &errors.MyError{Err: krakenResponse.Error[0]}
+			logging.FromContext(ctx).Warn("Kraken API error", logging.ERROR, krakenResponse.Error[0])
+			myErr := upstreamError(krakenErrorStatus(krakenResponse.Error[0]), krakenResponse.Error[0])
+			myErr.UpstreamStatus = response.StatusCode
+			return nil, myErr
 		}
-		return &krakenResponse.Result, nil
+		return unmarshalKrakenResult(ctx, krakenResponse.Result, symbol)
 	} else {
 		resp := new(interface{})
 		json.NewDecoder(response.Body).Decode(&resp)
-		log.Println(resp)
-		log.Println(fmt.Sprintf("Either the Kraken API is down or the request was incorrect with response code %d", response.StatusCode))
-		return nil, &errors.MyError{Err: "Kraken API error", ErrorCode: http.StatusInternalServerError}
+		logging.FromContext(ctx).Warn("Either the Kraken API is down or the request was incorrect", logging.STATUS, response.StatusCode, "body", resp)
+		return nil, upstreamError(response.StatusCode, "Kraken API error")
+	}
+}
+
+// Kraken answers most of its errors with 200 OK, so the ones which may pass on their own are picked out of the body:
+// its services being unavailable or busy, and its rate limit
+func inspectKrakenResponse(response *http.Response) string {
+	if response.StatusCode != http.StatusOK {
+		return EMPTYSTRING
+	}
+
+	body, err := peekBody(response)
+	if err != nil {
+		return EMPTYSTRING
+	}
+	krakenResponse := new(KrakenResponse)
+	if json.Unmarshal(body, krakenResponse) != nil {
+		return EMPTYSTRING
+	}
+	for _, krakenError := range krakenResponse.Error {
+		if krakenErrorStatus(krakenError) != http.StatusOK {
+			return krakenError
+		}
+	}
+	return EMPTYSTRING
+}
+
+// The status a Kraken error amounts to: 503 while its services are unavailable or busy, 429 once its rate limit is
+// hit, and the 200 it came with otherwise
+func krakenErrorStatus(krakenError string) int {
+	switch {
+	case strings.HasPrefix(krakenError, "EService:"):
+		return http.StatusServiceUnavailable
+	case strings.HasPrefix(krakenError, "EAPI:Rate limit"):
+		return http.StatusTooManyRequests
 	}
+	return http.StatusOK
 }
 
-// From an interval, add the custom GET parameters to the Kraken request
-func buildKrakenRequest(interval string) (string, error) {
-	request, err := http.NewRequest("GET", krakenHistoricalEndpoint, nil)
+// Kraken keys the buckets by the requested symbol, so pick them out of the result by hand
+func unmarshalKrakenResult(ctx context.Context, result map[string]json.RawMessage, symbol string) (*KrakenResultMap, *errors.MyError) {
+	resultMap := new(KrakenResultMap)
+
+	buckets, ok := result[symbol]
+	if !ok {
+		logging.FromContext(ctx).Warn("Kraken response has no data for the symbol", "symbol", symbol)
+		return nil, &errors.MyError{Err: fmt.Sprintf("Kraken returned no data for %s", symbol), ErrorCode: http.StatusBadGateway, Code: errors.UPSTREAMERROR}
+	}
+
+	err := json.Unmarshal(buckets, &resultMap.Buckets)
 	if err != nil {
-		log.Println("Could not build Kraken historical URL")
+		logging.FromContext(ctx).Warn("Could not decode Kraken buckets", logging.ERROR, err)
+		return nil, parseFailure(krakenSource{}.Name(), err.Error())
+	}
+
+	if last, ok := result["last"]; ok {
+		err = json.Unmarshal(last, &resultMap.Last)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Could not decode Kraken last timestamp", logging.ERROR, err)
+			return nil, parseFailure(krakenSource{}.Name(), err.Error())
+		}
+	}
+
+	return resultMap, nil
+}
+
+// From an endpoint, symbol, interval and start time, add the custom GET parameters to the Kraken request
+func buildKrakenRequest(ctx context.Context, endpoint string, symbol string, interval string, since time.Time) (string, error) {
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		logging.FromContext(ctx).Error("Could not build Kraken historical URL", logging.ERROR, err)
 		return EMPTYSTRING, err
 	}
 
 	query := request.URL.Query()
 
-	query.Add("pair", "XXBTZUSD")
+	query.Add("pair", symbol)
 	query.Add("interval", strconv.FormatInt(krakenIntervalToGranularity[interval], 10))
 
-	since := getRoundedStartTime(interval)
-
-	query.Add("since", strconv.FormatInt(since.Unix(), 10))
+	// We round the time to the nearest 5-min step to synchronize consecutive requests
+	query.Add("since", strconv.FormatInt(roundTime(since).Unix(), 10))
 
 	request.URL.RawQuery = query.Encode()
 	return request.URL.String(), nil
 }
-
-// We round the time to the nearest 5-min step to synchronize consecutive requests
-func getRoundedStartTime(interval string) time.Time {
-	startTime := time.Now()
-	startTime = roundTime(startTime)
-
-	switch interval {
-	case TWOYEAR:
-		return startTime.AddDate(-2, 0, 0)
-	case YEAR:
-		return startTime.AddDate(-1, 0, 0)
-	case SIXMONTH:
-		return startTime.AddDate(0, -6, 0)
-	case THREEMONTH:
-		return startTime.AddDate(0, -3, 0)
-	case MONTH:
-		return startTime.AddDate(0, -3, 0)
-	case WEEK:
-		return startTime.AddDate(0, 0, -8)
-	case DAY:
-		return startTime.AddDate(0, 0, -1)
-	default:
-		return startTime.AddDate(-1, 0, 0)
-	}
-}
@@ -0,0 +1,63 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollKrakenHistoricalReach(t *testing.T) {
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	server := mockexchange.NewServer()
+	defer server.Close()
+	server.Exchange.Now = func() time.Time { return now }
+	upstream := &Upstream{BaseURL: server.URL}
+
+	// 720 buckets of 5 minutes reach back 2.5 days
+	reach := now.Add(-719 * 5 * time.Minute)
+
+	tests := []struct {
+		name   string
+		query  HistoricalQuery
+		oldest time.Time
+		beyond bool
+	}{
+		{
+			name:   "within reach",
+			query:  HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: now.Add(-6 * time.Hour), End: now},
+			oldest: now.Add(-6 * time.Hour),
+		},
+		{
+			name:   "starting beyond reach",
+			query:  HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: now.AddDate(0, 0, -5), End: now},
+			oldest: reach,
+		},
+		{
+			name:   "ending beyond reach",
+			query:  HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: now.AddDate(0, 0, -10), End: now.AddDate(0, 0, -9)},
+			beyond: true,
+		},
+	}
+
+	for _, test := range tests {
+		candles, myErr := PollKrakenHistorical(context.Background(), upstream, test.query)
+		if test.beyond {
+			if myErr == nil || myErr.Status() != http.StatusBadRequest || myErr.Kind() != errors.INVALIDREQUEST || !strings.Contains(myErr.Err, "720") {
+				t.Errorf("%s: PollKrakenHistorical() = %v, want a 400 %s naming the 720 bucket limit", test.name, myErr, errors.INVALIDREQUEST)
+			}
+			continue
+		}
+
+		if myErr != nil {
+			t.Errorf("%s: %s", test.name, myErr.Err)
+			continue
+		}
+		if oldest := candles[len(candles)-1].Timestamp; oldest != test.oldest.Unix() {
+			t.Errorf("%s: the oldest candle starts at %s, want %s", test.name, time.Unix(oldest, 0).UTC(), test.oldest)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A source is never polled more often than this many times per bucket of its finest granularity, so that daily
+// sources such as Quandl are only polled every 15 minutes
+const livePollsPerBucket = 96
+
+// Updates a slow subscriber has not received yet are dropped beyond this many, since the next update supersedes them
+const liveBufferSize = 64
+
+// LivePrice is the latest price of a pair on an exchange
+type LivePrice struct {
+	Exchange string `json:"exchange"`
+	Pair     string `json:"pair"`
+	// The start of the newest bucket, which the price closes or, for sources without a close, references
+	Timestamp int64   `json:"timestamp"`
+	Price     float64 `json:"price"`
+	// When the exchange was last polled
+	Polled time.Time `json:"polled"`
+}
+
+// LiveSpread is the current spread between the most and the least expensive exchanges of a pair
+type LiveSpread struct {
+	Pair string `json:"pair"`
+	// The most expensive exchange
+	High string `json:"high"`
+	// The least expensive exchange
+	Low    string  `json:"low"`
+	Spread float64 `json:"spread"`
+	// Spread as a percentage of the lowest price
+	PercentSpread float64 `json:"percentSpread"`
+}
+
+// LiveUpdate is pushed to subscribers whenever a price changes, followed by the resulting spread
+type LiveUpdate struct {
+	Price  *LivePrice  `json:"price,omitempty"`
+	Spread *LiveSpread `json:"spread,omitempty"`
+}
+
+// LiveHub polls the registered sources for the latest price of every pair which has subscribers, and pushes the
+// changes to them
+//
+// Polling starts with the first subscriber of a pair and stops with its last one
+type LiveHub struct {
+	// The shortest time between two polls of the same source
+	Period time.Duration
+
+	mutex sync.Mutex
+	feeds map[string]*liveFeed
+	// Closed by Close, telling every subscriber to leave
+	closing chan struct{}
+	closed  bool
+	// The subscriptions which have not ended yet
+	subscriptions sync.WaitGroup
+}
+
+// The subscribers and latest prices of a single pair
+type liveFeed struct {
+	pair        string
+	latest      map[string]LivePrice
+	subscribers map[chan LiveUpdate]bool
+	// Done once the last subscriber leaves, which also abandons the polls in flight
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// NewLiveHub returns a hub polling every source at most once per period
+func NewLiveHub(period time.Duration) *LiveHub {
+	return &LiveHub{Period: period, feeds: make(map[string]*liveFeed), closing: make(chan struct{})}
+}
+
+// Closing returns a channel which is closed once the hub is closing, after which subscribers must end their
+// subscriptions
+func (hub *LiveHub) Closing() <-chan struct{} {
+	return hub.closing
+}
+
+// Close refuses new subscribers, tells the current ones to leave and waits until they have ended their subscriptions
+// or ctx is done
+func (hub *LiveHub) Close(ctx context.Context) error {
+	hub.mutex.Lock()
+	if !hub.closed {
+		hub.closed = true
+		close(hub.closing)
+	}
+	hub.mutex.Unlock()
+
+	left := make(chan struct{})
+	go func() {
+		hub.subscriptions.Wait()
+		close(left)
+	}()
+
+	select {
+	case <-left:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe returns the updates of a pair, starting with its latest known prices, and the function which ends the
+// subscription
+func (hub *LiveHub) Subscribe(pair string) (<-chan LiveUpdate, func(), *errors.MyError) {
+	pair = strings.ToUpper(pair)
+	sources := SourcesTrading(pair)
+	if len(sources) == 0 {
+		return nil, nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid pair; no exchange trades %s", pair), ErrorCode: http.StatusBadRequest}
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if hub.closed {
+		return nil, nil, &errors.MyError{Err: "Live prices are shutting down", ErrorCode: http.StatusServiceUnavailable, Code: errors.INTERNALERROR}
+	}
+
+	feed, ok := hub.feeds[pair]
+	if !ok {
+		feed = &liveFeed{pair: pair, latest: make(map[string]LivePrice), subscribers: make(map[chan LiveUpdate]bool)}
+		feed.ctx, feed.stop = context.WithCancel(context.Background())
+		hub.feeds[pair] = feed
+
+		for _, source := range sources {
+			go hub.poll(feed, source)
+		}
+	}
+
+	updates := make(chan LiveUpdate, liveBufferSize)
+	feed.subscribers[updates] = true
+	hub.subscriptions.Add(1)
+
+	for _, price := range feed.latest {
+		price := price
+		updates <- LiveUpdate{Price: &price}
+	}
+	if spread := feed.spread(); spread != nil {
+		updates <- LiveUpdate{Spread: spread}
+	}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			hub.mutex.Lock()
+			defer hub.mutex.Unlock()
+
+			delete(feed.subscribers, updates)
+			if len(feed.subscribers) == 0 {
+				feed.stop()
+				delete(hub.feeds, pair)
+			}
+			hub.subscriptions.Done()
+		})
+	}
+	return updates, unsubscribe, nil
+}
+
+// Poll a source for the latest price of a feed until the feed stops
+func (hub *LiveHub) poll(feed *liveFeed, source HistoricalSource) {
+	intervals := source.Intervals()
+	finest := intervals[len(intervals)-1]
+	granularity := source.Granularity(finest)
+
+	period := granularity / livePollsPerBucket
+	if period < hub.Period {
+		period = hub.Period
+	}
+
+	for {
+		hub.pollOnce(feed, source, finest, granularity)
+
+		select {
+		case <-feed.ctx.Done():
+			return
+		case <-time.After(period):
+		}
+	}
+}
+
+// Fetch the newest buckets of a source and push its price if it changed
+func (hub *LiveHub) pollOnce(feed *liveFeed, source HistoricalSource, interval string, granularity time.Duration) {
+	now := time.Now()
+	query := HistoricalQuery{Pair: feed.pair, Interval: interval, Start: now.Add(-2 * granularity), End: now}
+
+	candles, myErr := source.FetchCandles(feed.ctx, query)
+	if myErr != nil && feed.ctx.Err() != nil {
+		return
+	}
+	if myErr != nil {
+		logging.FromContext(feed.ctx).Warn("Could not poll a live price", logging.EXCHANGE, source.Name(), logging.PAIR, feed.pair, logging.CODE, myErr.Kind(), logging.ERROR, myErr.Err)
+		return
+	}
+	if len(candles) == 0 {
+		return
+	}
+
+	price := livePrice(source, candles[0])
+	if price == nil {
+		return
+	}
+	latest := LivePrice{Exchange: source.Name(), Pair: feed.pair, Timestamp: candles[0].Timestamp, Price: *price, Polled: now}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	previous, known := feed.latest[source.Name()]
+	feed.latest[source.Name()] = latest
+	if known && previous.Timestamp == latest.Timestamp && previous.Price == latest.Price {
+		return
+	}
+
+	feed.broadcast(LiveUpdate{Price: &latest})
+	if spread := feed.spread(); spread != nil {
+		feed.broadcast(LiveUpdate{Spread: spread})
+	}
+}
+
+// The current price of a bucket is its close, or the reference price of its source while it has none
+func livePrice(source HistoricalSource, candle Candle) *float64 {
+	if candle.Close != nil {
+		return candle.Close
+	}
+	return source.ReferencePrice(candle)
+}
+
+// Push an update to every subscriber, dropping it for those which are too slow to keep up; the hub mutex must be held
+func (feed *liveFeed) broadcast(update LiveUpdate) {
+	for subscriber := range feed.subscribers {
+		select {
+		case subscriber <- update:
+		default:
+		}
+	}
+}
+
+// The spread between the latest prices of the feed, or nil with fewer than two exchanges; the hub mutex must be held
+func (feed *liveFeed) spread() *LiveSpread {
+	if len(feed.latest) < 2 {
+		return nil
+	}
+
+	var high, low *LivePrice
+	for _, price := range feed.latest {
+		price := price
+		if high == nil || price.Price > high.Price || (price.Price == high.Price && price.Exchange < high.Exchange) {
+			high = &price
+		}
+		if low == nil || price.Price < low.Price || (price.Price == low.Price && price.Exchange < low.Exchange) {
+			low = &price
+		}
+	}
+
+	spread := &LiveSpread{Pair: feed.pair, High: high.Exchange, Low: low.Exchange, Spread: high.Price - low.Price}
+	if low.Price != 0 {
+		spread.PercentSpread = spread.Spread / low.Price * 100
+	}
+	return spread
+}
@@ -0,0 +1,135 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/logging"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Probe states
+const (
+	// The source has not been probed yet
+	PROBEUNKNOWN = "unknown"
+	// The last probe of the source succeeded
+	PROBEUP = "up"
+	// The last probe of the source failed
+	PROBEDOWN = "down"
+)
+
+// The longest a single probe may take before it counts as failed
+const probeTimeout = 10 * time.Second
+
+// ProbeResult is the outcome of the latest probes of a source
+type ProbeResult struct {
+	Exchange string `json:"exchange"`
+	State    string `json:"state"`
+	// When the source was last probed and how long it took to answer
+	ProbedAt  *time.Time `json:"probedAt,omitempty"`
+	LatencyMs int64      `json:"latencyMs"`
+	// When the source last answered a probe
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// Why the source last failed a probe, and when
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Prober periodically asks every registered source for its newest buckets, so that a broken source shows up before
+// clients run into it
+//
+// Probes are as light as a live poll: the finest interval of the source over the last two buckets. They go through the
+// rate limiter and circuit breaker of the source like any other request, but never through the cache.
+type Prober struct {
+	// The time between two probes of the same source
+	Period time.Duration
+
+	mutex   sync.Mutex
+	results map[string]*ProbeResult
+}
+
+// NewProber returns a prober probing every source once per period once started
+func NewProber(period time.Duration) *Prober {
+	prober := &Prober{Period: period, results: make(map[string]*ProbeResult)}
+	for _, source := range Sources() {
+		prober.results[source.Name()] = &ProbeResult{Exchange: source.Name(), State: PROBEUNKNOWN}
+	}
+	return prober
+}
+
+// Start probes every source right away and then once per period, until ctx is done
+func (prober *Prober) Start(ctx context.Context) {
+	for _, source := range Sources() {
+		go func(source HistoricalSource) {
+			for {
+				prober.probe(ctx, source)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(prober.Period):
+				}
+			}
+		}(source)
+	}
+}
+
+// Results returns the latest probe result of every source, by name
+func (prober *Prober) Results() []ProbeResult {
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+
+	results := make([]ProbeResult, 0, len(prober.results))
+	for _, result := range prober.results {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Exchange < results[j].Exchange
+	})
+	return results
+}
+
+// Fetch the newest buckets of a source and record how it went
+func (prober *Prober) probe(ctx context.Context, source HistoricalSource) {
+	intervals := source.Intervals()
+	finest := intervals[len(intervals)-1]
+	granularity := source.Granularity(finest)
+
+	pair := DefaultPair
+	if !contains(source.Pairs(), pair) {
+		pair = source.Pairs()[0]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	now := time.Now()
+	query := HistoricalQuery{Pair: pair, Interval: finest, Start: now.Add(-2 * granularity), End: now}
+	_, myErr := source.FetchCandles(ctx, query)
+	latency := time.Since(now)
+
+	if myErr != nil && ctx.Err() == context.Canceled {
+		// The prober was stopped, which says nothing about the source
+		return
+	}
+
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+
+	result, ok := prober.results[source.Name()]
+	if !ok {
+		result = &ProbeResult{Exchange: source.Name()}
+		prober.results[source.Name()] = result
+	}
+	result.ProbedAt = &now
+	result.LatencyMs = latency.Milliseconds()
+	if myErr != nil {
+		logging.FromContext(ctx).Warn("Probe failed", logging.EXCHANGE, source.Name(), logging.LATENCY, latency, logging.CODE, myErr.Kind(), logging.ERROR, myErr.Err)
+		result.State = PROBEDOWN
+		result.LastError = myErr.Err
+		result.LastErrorAt = &now
+	} else {
+		result.State = PROBEUP
+		result.LastSuccess = &now
+	}
+}
@@ -1,16 +1,38 @@
 package datamodels
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adamhei/historicalapi/errors"
-	"log"
+	"github.com/adamhei/historicalapi/logging"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+const quandlBaseURL = "https://www.quandl.com"
 const quandlApiV3 = "v3"
 
+// Quandl allows 300 calls per 10 seconds and 2000 per 10 minutes per API key, shared by every Quandl source
+var quandlLimiter = NewRateLimiter(2000.0/600, 300)
+
+// Quandl is down for every Quandl source at once
+var quandlBreaker = newDefaultBreaker()
+
+// Quandl answers with whole datasets, which take longer to send than the windows of the other exchanges
+const quandlTimeout = 30 * time.Second
+
+// The API key sent with every Quandl request; anonymous requests get much lower limits
+var quandlApiKey string
+
+// SetQuandlAPIKey sets the API key of every Quandl source
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetQuandlAPIKey(key string) {
+	quandlApiKey = key
+}
+
 // Top level response body
 type quandlResponse struct {
 	DataSetResponse quandlDataSetResponse `json:"dataset"`
@@ -51,53 +73,50 @@ var quandlIntervals = map[string]bool{
 	MONTH:      true,
 }
 
-// Given an interval
-// 1. Build the GET request
-// 2. Fetch the historical data from Quandl
-// 3. Return the response if successful, error if not
-func fetchQuandlResponse(requestString string) (*quandlResponse, *errors.MyError) {
-	response, err := http.Get(requestString)
-
-	defer response.Body.Close()
+// Quandl only has daily data
+const quandlGranularity = 24 * time.Hour
 
-	log.Println(fmt.Sprintf("Querying %s", requestString))
-
-	if err != nil {
-		log.Println(fmt.Sprintf("Could not reach %s", requestString))
-		return nil, &errors.MyError{Err: err.Error()}
+// Given an upstream, the name of the exchange whose Quandl dataset is requested and the request
+// 1. Fetch the historical data from Quandl
+// 2. Return the response if successful, error if not
+func fetchQuandlResponse(ctx context.Context, upstream *Upstream, exchange string, requestString string) (*quandlResponse, *errors.MyError) {
+	response, myErr := upstream.get(ctx, exchange, requestString)
+	if myErr != nil {
+		return nil, myErr
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode == http.StatusOK {
 		quandlResponse := new(quandlResponse)
-		err = json.NewDecoder(response.Body).Decode(quandlResponse)
+		err := json.NewDecoder(response.Body).Decode(quandlResponse)
 
 		if err != nil {
-			log.Println("Could not decode Quandl response")
-			return nil, &errors.MyError{Err: err.Error()}
+			logging.FromContext(ctx).Warn("Could not decode Quandl response", logging.ERROR, err)
+			return nil, parseFailure(exchange, err.Error())
 		}
 		return quandlResponse, nil
 	} else {
-		log.Println(fmt.Sprintf("Their was an error contacting Quandl with response code %d", response.StatusCode))
-		return nil, &errors.MyError{Err: "Quandl API error", ErrorCode: http.StatusInternalServerError}
+		logging.FromContext(ctx).Warn("There was an error contacting Quandl", logging.STATUS, response.StatusCode)
+		return nil, upstreamError(response.StatusCode, "Quandl API error")
 	}
 }
 
-// Similar to CoinDesk, determine the start date for the Quandl response
-func getQuandlStartDate(interval string) string {
-	startTime := time.Now()
-
-	switch interval {
-	case TWOYEAR:
-		startTime = startTime.AddDate(-2, 0, 0)
-	case YEAR:
-		startTime = startTime.AddDate(-1, 0, 0)
-	case SIXMONTH:
-		startTime = startTime.AddDate(0, -6, 0)
-	case THREEMONTH:
-		startTime = startTime.AddDate(0, -3, 0)
-	case MONTH:
-		startTime = startTime.AddDate(0, -1, 0)
+// Quandl columns may be null on days without trading, so parse a numeric column into an optional Candle field
+func unmarshalQuandlColumn(jsonBucket []json.RawMessage, column int) (*float64, error) {
+	if column >= len(jsonBucket) {
+		return nil, fmt.Errorf("Quandl bucket has no column %d", column)
 	}
 
-	return startTime.Format(DATELAYOUTSTRING)
+	value := new(float64)
+	err := json.Unmarshal(jsonBucket[column], &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Similar to CoinDesk, add the window of the query to a Quandl request
+func addQuandlDates(query url.Values, start, end time.Time) {
+	query.Add("start_date", start.UTC().Format(DATELAYOUTSTRING))
+	query.Add("end_date", end.UTC().Format(DATELAYOUTSTRING))
 }
@@ -0,0 +1,148 @@
+package datamodels
+
+import (
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The pair served when a request does not name one
+const DefaultPair = "BTC-USD"
+
+// The most buckets a query may span on a single source, so that an open-ended window, such as a start years back at a
+// fine granularity, can neither fan out into hundreds of upstream requests nor fill the cache and the candle store
+const MAXWINDOWBUCKETS = 5000
+
+// The parameters of a historical request, which every source translates into its own request parameters
+type HistoricalQuery struct {
+	// The canonical trading pair, e.g. BTC-USD, which every source maps to its own symbol
+	Pair string
+	// Selects the granularity of the series
+	Interval string
+	// The window of time to return, inclusive
+	Start, End time.Time
+}
+
+// NewHistoricalQuery returns the query for the default pair over an interval looking back from now
+func NewHistoricalQuery(interval string) HistoricalQuery {
+	interval = strings.ToUpper(interval)
+	end := time.Now()
+
+	return HistoricalQuery{Pair: DefaultPair, Interval: interval, Start: intervalStart(interval, end), End: end}
+}
+
+// NewRangeQuery returns the query for a pair and interval over an arbitrary window
+//
+// An empty pair means DefaultPair, a zero start looks back one interval from end, and a zero end means now
+func NewRangeQuery(pair, interval string, start, end time.Time) (HistoricalQuery, *errors.MyError) {
+	query := NewHistoricalQuery(interval)
+
+	if pair != EMPTYSTRING {
+		query.Pair = strings.ToUpper(pair)
+	}
+
+	if !end.IsZero() {
+		query.End = end
+		query.Start = intervalStart(query.Interval, end)
+	}
+	if !start.IsZero() {
+		query.Start = start
+	}
+
+	if !query.Start.Before(query.End) {
+		return query, &errors.MyError{
+			Err:       fmt.Sprintf("Please provide a start before the end; %s is not before %s", query.Start.Format(time.RFC3339), query.End.Format(time.RFC3339)),
+			ErrorCode: http.StatusBadRequest,
+		}
+	}
+	return query, nil
+}
+
+// CheckWindow returns a client error if the window of a query spans more than MAXWINDOWBUCKETS buckets of a source
+//
+// Intervals the source does not serve are left for FetchCandles to report
+func CheckWindow(source HistoricalSource, query HistoricalQuery) *errors.MyError {
+	granularity := source.Granularity(query.Interval)
+	if granularity == 0 {
+		return nil
+	}
+
+	buckets := int64(query.End.Sub(query.Start) / granularity)
+	if buckets > MAXWINDOWBUCKETS {
+		return &errors.MyError{
+			Err:       fmt.Sprintf("Please provide a shorter window; %s spans %d buckets of %s on %s, at most %d are served at once", query.Interval, buckets, granularity, source.Name(), MAXWINDOWBUCKETS),
+			ErrorCode: http.StatusBadRequest,
+			Code:      errors.INVALIDREQUEST,
+			Source:    source.Name(),
+		}
+	}
+	return nil
+}
+
+// Map a canonical pair to the symbol of an exchange, returning a client error if the exchange does not trade it
+func lookupSymbol(symbols map[string]string, exchange string, pair string) (string, *errors.MyError) {
+	symbol, ok := symbols[strings.ToUpper(pair)]
+	if !ok {
+		return EMPTYSTRING, &errors.MyError{Err: fmt.Sprintf("Please provide a valid pair; %s does not trade %s", exchange, pair), ErrorCode: http.StatusBadRequest}
+	}
+	return symbol, nil
+}
+
+// The canonical pairs of a symbol table in alphabetical order
+func pairsOf(symbols map[string]string) []string {
+	pairs := make([]string, 0, len(symbols))
+	for pair := range symbols {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// Return the start of the window which looks back one interval from end
+func intervalStart(interval string, end time.Time) time.Time {
+	switch interval {
+	case TWOYEAR:
+		return end.AddDate(-2, 0, 0)
+	case YEAR:
+		return end.AddDate(-1, 0, 0)
+	case SIXMONTH:
+		return end.AddDate(0, -6, 0)
+	case THREEMONTH:
+		return end.AddDate(0, -3, 0)
+	case MONTH:
+		return end.AddDate(0, -1, 0)
+	case WEEK:
+		return end.AddDate(0, 0, -7)
+	case DAY:
+		return end.AddDate(0, 0, -1)
+	case TWELVEHOUR:
+		return end.Add(-12 * time.Hour)
+	case SIXHOUR:
+		return end.Add(-6 * time.Hour)
+	case HOUR:
+		return end.Add(-1 * time.Hour)
+	case THIRTYMINUTE:
+		return end.Add(-30 * time.Minute)
+	default:
+		return end.AddDate(-1, 0, 0)
+	}
+}
+
+// Exchanges round their windows to whole buckets or days, so drop the Candles which do not overlap the query window
+//
+// A Candle overlaps the window when any part of its bucket lies between Start and End
+func filterCandles(candles []Candle, query HistoricalQuery, granularity time.Duration) []Candle {
+	start := query.Start.Add(-granularity).Unix()
+	end := query.End.Unix()
+
+	filtered := make([]Candle, 0, len(candles))
+	for _, candle := range candles {
+		if candle.Timestamp > start && candle.Timestamp <= end {
+			filtered = append(filtered, candle)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,38 @@
+package datamodels
+
+import (
+	"github.com/adamhei/historicalapi/errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckWindow(t *testing.T) {
+	end := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	source := &gdaxSource{}
+
+	tests := []struct {
+		name    string
+		query   HistoricalQuery
+		invalid bool
+	}{
+		{name: "default window", query: HistoricalQuery{Interval: DAY, Start: intervalStart(DAY, end), End: end}},
+		{name: "longest default window", query: HistoricalQuery{Interval: TWOYEAR, Start: intervalStart(TWOYEAR, end), End: end}},
+		{name: "at the limit", query: HistoricalQuery{Interval: DAY, Start: end.Add(-MAXWINDOWBUCKETS * source.Granularity(DAY)), End: end}},
+		{name: "start years back", query: HistoricalQuery{Interval: DAY, Start: end.AddDate(-3, 0, 0), End: end}, invalid: true},
+		{name: "unserved interval", query: HistoricalQuery{Interval: "DECADE", Start: end.AddDate(-30, 0, 0), End: end}},
+	}
+
+	for _, test := range tests {
+		myErr := CheckWindow(source, test.query)
+		if !test.invalid {
+			if myErr != nil {
+				t.Errorf("%s: CheckWindow() = %s, want nil", test.name, myErr.Err)
+			}
+			continue
+		}
+		if myErr == nil || myErr.Status() != http.StatusBadRequest || myErr.Kind() != errors.INVALIDREQUEST {
+			t.Errorf("%s: CheckWindow() = %v, want a 400 %s", test.name, myErr, errors.INVALIDREQUEST)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The longest a request waits for its turn before it is rejected, unless configured otherwise
+const defaultMaxWait = 5 * time.Second
+
+// RateLimiter is a token bucket shared by every request to an upstream
+//
+// Requests wait for their tokens up to MaxWait and are rejected beyond it. The upstream can slow the limiter down
+// further with a Retry-After header, or with a used weight header such as Binance's X-MBX-USED-WEIGHT
+type RateLimiter struct {
+	// Tokens added per second
+	Rate float64
+	// The most tokens which can be saved up, i.e. the largest burst of requests
+	Burst float64
+	// The tokens every request takes, for upstreams which weigh their requests
+	Weight float64
+	// The longest a request waits for its tokens before it is rejected
+	MaxWait time.Duration
+
+	// The header reporting the weight used within the current WeightWindow, and the most weight allowed within it
+	WeightHeader string
+	WeightLimit  float64
+	WeightWindow time.Duration
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+	// No request is sent before this time, as asked by the upstream
+	pausedUntil time.Time
+}
+
+// NewRateLimiter returns a full bucket of burst tokens refilled at rate tokens per second, where every request takes
+// a single token
+func NewRateLimiter(rate float64, burst float64) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst, Weight: 1, MaxWait: defaultMaxWait, tokens: burst, last: time.Now()}
+}
+
+// SetRateLimiter replaces the limiter of the named source, or removes it if limiter is nil, e.g. when the source is
+// pointed at a local stand-in server
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetRateLimiter(name string, limiter *RateLimiter) error {
+	upstream, err := upstreamOf(name)
+	if err != nil {
+		return err
+	}
+
+	upstream.Limiter = limiter
+	return nil
+}
+
+// Wait takes the tokens of a request to the named exchange, sleeping until they are available
+//
+// A request which would have to wait longer than MaxWait takes no tokens and is rejected with 429 Too Many Requests,
+// and a request whose ctx is done while it waits gives its tokens back
+func (limiter *RateLimiter) Wait(ctx context.Context, exchange string) *errors.MyError {
+	limiter.mutex.Lock()
+
+	now := time.Now()
+	limiter.refill(now)
+
+	// Reserve the tokens, going into debt if needed, and wait until the debt is paid off
+	limiter.tokens -= limiter.Weight
+	wait := time.Duration(0)
+	if limiter.tokens < 0 && limiter.Rate > 0 {
+		wait = time.Duration(-limiter.tokens / limiter.Rate * float64(time.Second))
+	} else if limiter.tokens < 0 {
+		// Without a rate the bucket never refills
+		wait = limiter.MaxWait + 1
+	}
+	if paused := limiter.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+
+	if wait > limiter.MaxWait {
+		limiter.tokens += limiter.Weight
+		limiter.mutex.Unlock()
+
+		logging.FromContext(ctx).Warn("Rejected an upstream request over its rate limit", logging.EXCHANGE, exchange, "wait", wait)
+		return &errors.MyError{Err: fmt.Sprintf("Too many requests to %s; please retry in %s", exchange, wait.Round(time.Second)), ErrorCode: http.StatusTooManyRequests, Code: errors.UPSTREAMRATELIMITED}
+	}
+	limiter.mutex.Unlock()
+
+	if wait > 0 {
+		logging.FromContext(ctx).Debug("Waiting for the rate limit", logging.EXCHANGE, exchange, "wait", wait)
+
+		select {
+		case <-ctx.Done():
+			limiter.mutex.Lock()
+			limiter.tokens += limiter.Weight
+			limiter.mutex.Unlock()
+			return contextError(exchange, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// Observe slows the limiter down as asked by the headers of a response of the named exchange, logging any pause with
+// the logger of ctx
+func (limiter *RateLimiter) Observe(ctx context.Context, exchange string, response *http.Response) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+
+	// Binance answers 418 once an IP has ignored its 429s, and most APIs send Retry-After with a 429 or 503
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusTeapot:
+		if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After"), now); ok {
+			limiter.pause(ctx, exchange, now.Add(retryAfter))
+		}
+	}
+
+	if limiter.WeightHeader == EMPTYSTRING || limiter.WeightLimit <= 0 {
+		return
+	}
+	used, err := strconv.ParseFloat(response.Header.Get(limiter.WeightHeader), 64)
+	if err != nil {
+		return
+	}
+
+	// Never spend more than the weight the upstream says is left in its window
+	limiter.refill(now)
+	remaining := limiter.WeightLimit - used
+	if limiter.tokens > remaining {
+		limiter.tokens = remaining
+	}
+	if remaining < limiter.Weight && limiter.WeightWindow > 0 {
+		limiter.pause(ctx, exchange, now.Truncate(limiter.WeightWindow).Add(limiter.WeightWindow))
+	}
+}
+
+// Add the tokens earned since the last refill; the mutex must be held
+func (limiter *RateLimiter) refill(now time.Time) {
+	if !limiter.last.IsZero() {
+		limiter.tokens = math.Min(limiter.Burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.Rate)
+	}
+	limiter.last = now
+}
+
+// Hold every request until a time; the mutex must be held
+func (limiter *RateLimiter) pause(ctx context.Context, exchange string, until time.Time) {
+	if until.After(limiter.pausedUntil) {
+		logging.FromContext(ctx).Warn("Pausing upstream requests as asked by the upstream", logging.EXCHANGE, exchange, "until", until.Format(time.RFC3339))
+		limiter.pausedUntil = until
+	}
+}
+
+// A Retry-After header is either a number of seconds or an HTTP date
+func parseRetryAfter(retryAfter string, now time.Time) (time.Duration, bool) {
+	if retryAfter == EMPTYSTRING {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
@@ -0,0 +1,178 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		retryAfter string
+		wait       time.Duration
+		ok         bool
+	}{
+		{retryAfter: "", ok: false},
+		{retryAfter: "0", wait: 0, ok: true},
+		{retryAfter: "120", wait: 2 * time.Minute, ok: true},
+		{retryAfter: "-5", ok: false},
+		{retryAfter: "soon", ok: false},
+		{retryAfter: "Thu, 01 Mar 2018 12:00:30 GMT", wait: 30 * time.Second, ok: true},
+	}
+
+	for _, test := range tests {
+		wait, ok := parseRetryAfter(test.retryAfter, now)
+		if ok != test.ok || wait != test.wait {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, want %s, %t", test.retryAfter, wait, ok, test.wait, test.ok)
+		}
+	}
+}
+
+func TestRateLimiterBurstThenRate(t *testing.T) {
+	limiter := NewRateLimiter(20, 2)
+
+	started := time.Now()
+	for request := 0; request < 2; request++ {
+		if myErr := limiter.Wait(context.Background(), "test"); myErr != nil {
+			t.Fatal(myErr.Err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > 20*time.Millisecond {
+		t.Errorf("the burst took %s, want no wait", elapsed)
+	}
+
+	// The third request waits for a token, i.e. 1/20 of a second
+	if myErr := limiter.Wait(context.Background(), "test"); myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+	if elapsed := time.Since(started); elapsed < 40*time.Millisecond {
+		t.Errorf("the third request went out after %s, want it to wait for a token", elapsed)
+	}
+}
+
+func TestRateLimiterRejectsBeyondMaxWait(t *testing.T) {
+	limiter := NewRateLimiter(1, 1)
+	limiter.MaxWait = 100 * time.Millisecond
+
+	if myErr := limiter.Wait(context.Background(), "test"); myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+
+	myErr := limiter.Wait(context.Background(), "test")
+	if myErr == nil || myErr.Status() != http.StatusTooManyRequests || myErr.Kind() != errors.UPSTREAMRATELIMITED {
+		t.Fatalf("Wait() = %v, want a 429 %s", myErr, errors.UPSTREAMRATELIMITED)
+	}
+
+	// A rejected request takes no tokens
+	limiter.mutex.Lock()
+	tokens := limiter.tokens
+	limiter.mutex.Unlock()
+	if tokens < -0.01 {
+		t.Errorf("the rejected request left %f tokens, want about 0", tokens)
+	}
+}
+
+func TestRateLimiterCanceledWaitGivesTokensBack(t *testing.T) {
+	limiter := NewRateLimiter(1, 1)
+	limiter.Wait(context.Background(), "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	myErr := limiter.Wait(ctx, "test")
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMTIMEOUT {
+		t.Fatalf("Wait() = %v, want %s", myErr, errors.UPSTREAMTIMEOUT)
+	}
+
+	limiter.mutex.Lock()
+	tokens := limiter.tokens
+	limiter.mutex.Unlock()
+	if tokens < -0.01 {
+		t.Errorf("the canceled request left %f tokens, want about 0", tokens)
+	}
+}
+
+func TestRateLimiterObservesRetryAfter(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusTeapot} {
+		limiter := NewRateLimiter(100, 100)
+		limiter.MaxWait = 100 * time.Millisecond
+
+		limiter.Observe(context.Background(), "test", &http.Response{StatusCode: status, Header: http.Header{"Retry-After": []string{"30"}}})
+
+		myErr := limiter.Wait(context.Background(), "test")
+		if myErr == nil || myErr.Kind() != errors.UPSTREAMRATELIMITED {
+			t.Errorf("after a %d with Retry-After, Wait() = %v, want %s", status, myErr, errors.UPSTREAMRATELIMITED)
+		}
+	}
+
+	// Retry-After is only a pause on the statuses which ask to slow down
+	limiter := NewRateLimiter(100, 100)
+	limiter.Observe(context.Background(), "test", &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Retry-After": []string{"30"}}})
+	if myErr := limiter.Wait(context.Background(), "test"); myErr != nil {
+		t.Errorf("after a 200 with Retry-After, Wait() = %s, want nil", myErr.Err)
+	}
+}
+
+func TestRateLimiterObservesUsedWeight(t *testing.T) {
+	newLimiter := func() *RateLimiter {
+		limiter := NewRateLimiter(20, 1200)
+		limiter.Weight = 5
+		limiter.MaxWait = 100 * time.Millisecond
+		limiter.WeightHeader, limiter.WeightLimit, limiter.WeightWindow = "X-MBX-USED-WEIGHT", 1200, time.Hour
+		return limiter
+	}
+	usedWeight := func(used string) *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Mbx-Used-Weight": []string{used}}}
+	}
+
+	// Plenty of weight left only caps the bucket
+	limiter := newLimiter()
+	limiter.Observe(context.Background(), "test", usedWeight("1000"))
+	limiter.mutex.Lock()
+	tokens := limiter.tokens
+	limiter.mutex.Unlock()
+	if tokens > 200 {
+		t.Errorf("with 200 weight left, the bucket holds %f tokens", tokens)
+	}
+	if myErr := limiter.Wait(context.Background(), "test"); myErr != nil {
+		t.Errorf("with 200 weight left, Wait() = %s, want nil", myErr.Err)
+	}
+
+	// Less weight left than a request takes pauses until the next window
+	limiter = newLimiter()
+	limiter.Observe(context.Background(), "test", usedWeight("1198"))
+	if !limiter.pausedUntil.After(time.Now()) {
+		t.Error("with 2 weight left, the limiter did not pause until the next window")
+	}
+	if myErr := limiter.Wait(context.Background(), "test"); myErr == nil || myErr.Kind() != errors.UPSTREAMRATELIMITED {
+		t.Errorf("with 2 weight left, Wait() = %v, want %s", myErr, errors.UPSTREAMRATELIMITED)
+	}
+}
+
+func TestUpstreamHonorsRetryAfter(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		responseWriter.Header().Set("Retry-After", "60")
+		responseWriter.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	limiter := NewRateLimiter(100, 100)
+	limiter.MaxWait = 100 * time.Millisecond
+	upstream := &Upstream{BaseURL: server.URL, Limiter: limiter, Retry: &RetryPolicy{Retries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+
+	// The retry is never sent, since the upstream asked for a minute
+	_, myErr := upstream.get(context.Background(), "test", server.URL)
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMRATELIMITED {
+		t.Fatalf("get() = %v, want %s", myErr, errors.UPSTREAMRATELIMITED)
+	}
+	if requests := atomic.LoadInt64(&requests); requests != 1 {
+		t.Errorf("the upstream got %d requests, want 1", requests)
+	}
+}
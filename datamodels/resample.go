@@ -0,0 +1,162 @@
+package datamodels
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Go durations stop at hours, so daily buckets are parsed separately
+const dayBucketSuffix = "d"
+
+// ParseBucketSize parses a resampling bucket such as "15m", "6h" or "1d"
+func ParseBucketSize(bucket string) (time.Duration, error) {
+	var size time.Duration
+	var err error
+
+	if strings.HasSuffix(bucket, dayBucketSuffix) {
+		var days int64
+		days, err = strconv.ParseInt(strings.TrimSuffix(bucket, dayBucketSuffix), 10, 64)
+		size = time.Duration(days) * 24 * time.Hour
+	} else {
+		size, err = time.ParseDuration(bucket)
+	}
+
+	if err != nil || size < time.Second || size%time.Second != 0 {
+		return 0, fmt.Errorf("Please provide a valid bucket size; %s is invalid", bucket)
+	}
+	return size, nil
+}
+
+// The start of the bucket a timestamp falls in, with buckets aligned to the unix epoch so that every series
+// resampled to the same size shares its timestamps
+func bucketStart(timestamp int64, bucket time.Duration) int64 {
+	seconds := int64(bucket / time.Second)
+	start := timestamp - timestamp%seconds
+	if timestamp < 0 && timestamp%seconds != 0 {
+		start -= seconds
+	}
+	return start
+}
+
+// ResampleCandles aggregates Candles into buckets of the given size, in descending order (newest to oldest)
+//
+// Open is the first and Close the last known price of each bucket, High and Low its extremes, Volume and Trades
+// are summed and VWAP is weighted by volume. Bid, Ask and Mid are the last known quotes. A field stays null when none of
+// the Candles in a bucket provide it. The bucket should be no finer than the granularity of the series, since
+// Candles cannot be split.
+func ResampleCandles(candles []Candle, bucket time.Duration) []Candle {
+	if bucket < time.Second {
+		return candles
+	}
+
+	ascending := make([]Candle, len(candles))
+	copy(ascending, candles)
+	sort.Slice(ascending, func(i, j int) bool {
+		return ascending[i].Timestamp < ascending[j].Timestamp
+	})
+
+	resampled := make([]Candle, 0)
+	for start := 0; start < len(ascending); {
+		bucketTimestamp := bucketStart(ascending[start].Timestamp, bucket)
+
+		end := start
+		for end < len(ascending) && bucketStart(ascending[end].Timestamp, bucket) == bucketTimestamp {
+			end++
+		}
+
+		resampled = append(resampled, aggregateCandles(bucketTimestamp, ascending[start:end]))
+		start = end
+	}
+
+	// Back to the newest to oldest order used everywhere else
+	for i, j := 0, len(resampled)-1; i < j; i, j = i+1, j-1 {
+		resampled[i], resampled[j] = resampled[j], resampled[i]
+	}
+
+	return resampled
+}
+
+// ResamplePricePoints builds Candles of the given size from a series of instantaneous prices, in descending order
+func ResamplePricePoints(pricePoints []PricePoint, bucket time.Duration) ([]Candle, error) {
+	candles := make([]Candle, len(pricePoints))
+
+	for index, point := range pricePoints {
+		price, err := parsePrice(point.Price)
+		if err != nil {
+			return nil, err
+		}
+		candles[index] = Candle{Timestamp: point.Timestamp, Open: price, High: price, Low: price, Close: price}
+	}
+
+	return ResampleCandles(candles, bucket), nil
+}
+
+// Combine Candles in ascending order into a single Candle starting at timestamp
+func aggregateCandles(timestamp int64, candles []Candle) Candle {
+	aggregate := Candle{Timestamp: timestamp}
+
+	var weightedPrice, weightedVolume float64
+	vwapKnown := true
+
+	for _, candle := range candles {
+		if aggregate.Open == nil {
+			aggregate.Open = candle.Open
+		}
+		if candle.Close != nil {
+			aggregate.Close = candle.Close
+		}
+		if candle.High != nil && (aggregate.High == nil || *candle.High > *aggregate.High) {
+			aggregate.High = candle.High
+		}
+		if candle.Low != nil && (aggregate.Low == nil || *candle.Low < *aggregate.Low) {
+			aggregate.Low = candle.Low
+		}
+		if candle.Bid != nil {
+			aggregate.Bid = candle.Bid
+		}
+		if candle.Ask != nil {
+			aggregate.Ask = candle.Ask
+		}
+		if candle.Mid != nil {
+			aggregate.Mid = candle.Mid
+		}
+
+		if candle.Volume != nil {
+			aggregate.Volume = floatPtr(valueOr(aggregate.Volume, 0) + *candle.Volume)
+		}
+		if candle.Trades != nil {
+			trades := *candle.Trades
+			if aggregate.Trades != nil {
+				trades += *aggregate.Trades
+			}
+			aggregate.Trades = &trades
+		}
+
+		// A VWAP is only meaningful when every Candle contributes both its VWAP and its volume
+		if candle.VWAP == nil || candle.Volume == nil {
+			vwapKnown = false
+		} else {
+			weightedPrice += *candle.VWAP * *candle.Volume
+			weightedVolume += *candle.Volume
+		}
+	}
+
+	if vwapKnown && weightedVolume > 0 {
+		aggregate.VWAP = floatPtr(weightedPrice / weightedVolume)
+	} else if len(candles) == 1 {
+		aggregate.VWAP = candles[0].VWAP
+	}
+
+	return aggregate
+}
+
+// Dereference an optional field, with a fallback for null
+func valueOr(f *float64, fallback float64) float64 {
+	if f == nil {
+		return fallback
+	}
+	return *f
+}
@@ -0,0 +1,266 @@
+package datamodels
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseBucketSize(t *testing.T) {
+	tests := []struct {
+		bucket  string
+		size    time.Duration
+		invalid bool
+	}{
+		{bucket: "15m", size: 15 * time.Minute},
+		{bucket: "6h", size: 6 * time.Hour},
+		{bucket: "1d", size: 24 * time.Hour},
+		{bucket: "7d", size: 7 * 24 * time.Hour},
+		{bucket: "90s", size: 90 * time.Second},
+		{bucket: "500ms", invalid: true},
+		{bucket: "1500ms", invalid: true},
+		{bucket: "0d", invalid: true},
+		{bucket: "-1h", invalid: true},
+		{bucket: "xd", invalid: true},
+		{bucket: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		size, err := ParseBucketSize(test.bucket)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseBucketSize(%q) = %s, want an error", test.bucket, size)
+			}
+			continue
+		}
+		if err != nil || size != test.size {
+			t.Errorf("ParseBucketSize(%q) = %s, %v, want %s", test.bucket, size, err, test.size)
+		}
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	tests := []struct {
+		timestamp int64
+		bucket    time.Duration
+		start     int64
+	}{
+		{timestamp: 0, bucket: time.Hour, start: 0},
+		{timestamp: 3599, bucket: time.Hour, start: 0},
+		{timestamp: 3600, bucket: time.Hour, start: 3600},
+		{timestamp: 1514768400, bucket: 24 * time.Hour, start: 1514764800},
+		{timestamp: 1514786400, bucket: 6 * time.Hour, start: 1514786400},
+		{timestamp: -1, bucket: time.Hour, start: -3600},
+		{timestamp: -3600, bucket: time.Hour, start: -3600},
+	}
+
+	for _, test := range tests {
+		if start := bucketStart(test.timestamp, test.bucket); start != test.start {
+			t.Errorf("bucketStart(%d, %s) = %d, want %d", test.timestamp, test.bucket, start, test.start)
+		}
+	}
+}
+
+func TestResampleCandles(t *testing.T) {
+	hour := int64(time.Hour / time.Second)
+
+	tests := []struct {
+		name    string
+		candles []Candle
+		bucket  time.Duration
+		want    []Candle
+	}{
+		{
+			name:    "empty series",
+			candles: []Candle{},
+			bucket:  time.Hour,
+			want:    []Candle{},
+		},
+		{
+			name:    "bucket finer than a second is a no-op",
+			candles: []Candle{{Timestamp: 10, Open: floatPtr(1)}},
+			bucket:  0,
+			want:    []Candle{{Timestamp: 10, Open: floatPtr(1)}},
+		},
+		{
+			name: "open, close, extremes and sums",
+			candles: []Candle{
+				{Timestamp: 2 * hour, Open: floatPtr(12), High: floatPtr(13), Low: floatPtr(11), Close: floatPtr(12.5), Volume: floatPtr(3), Trades: int64Ptr(30)},
+				{Timestamp: hour + 1800, Open: floatPtr(10.5), High: floatPtr(14), Low: floatPtr(10), Close: floatPtr(11), Volume: floatPtr(1), Trades: int64Ptr(10)},
+				{Timestamp: hour, Open: floatPtr(10), High: floatPtr(11), Low: floatPtr(9), Close: floatPtr(10.5), Volume: floatPtr(2), Trades: int64Ptr(20)},
+			},
+			bucket: 2 * time.Hour,
+			want: []Candle{
+				{Timestamp: 2 * hour, Open: floatPtr(12), High: floatPtr(13), Low: floatPtr(11), Close: floatPtr(12.5), Volume: floatPtr(3), Trades: int64Ptr(30)},
+				{Timestamp: 0, Open: floatPtr(10), High: floatPtr(14), Low: floatPtr(9), Close: floatPtr(11), Volume: floatPtr(3), Trades: int64Ptr(30)},
+			},
+		},
+		{
+			name: "unordered input comes back newest first",
+			candles: []Candle{
+				{Timestamp: 0, Close: floatPtr(1)},
+				{Timestamp: 2 * hour, Close: floatPtr(3)},
+				{Timestamp: hour, Close: floatPtr(2)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 2 * hour, Close: floatPtr(3)},
+				{Timestamp: hour, Close: floatPtr(2)},
+				{Timestamp: 0, Close: floatPtr(1)},
+			},
+		},
+		{
+			name: "buckets without candles are left out",
+			candles: []Candle{
+				{Timestamp: 5 * hour, Close: floatPtr(2)},
+				{Timestamp: hour, Close: floatPtr(1)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 5 * hour, Close: floatPtr(2)},
+				{Timestamp: hour, Close: floatPtr(1)},
+			},
+		},
+		{
+			name: "nil fields are skipped and stay nil when no candle has them",
+			candles: []Candle{
+				{Timestamp: 1800, Close: floatPtr(11), Bid: floatPtr(10.9), Mid: floatPtr(10.5)},
+				{Timestamp: 0, Open: floatPtr(10), High: floatPtr(12), Ask: floatPtr(10.1)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 0, Open: floatPtr(10), High: floatPtr(12), Close: floatPtr(11), Bid: floatPtr(10.9), Ask: floatPtr(10.1), Mid: floatPtr(10.5)},
+			},
+		},
+		{
+			name: "the first open and last close win over later nils",
+			candles: []Candle{
+				{Timestamp: 2400, Open: floatPtr(13)},
+				{Timestamp: 1200, Close: floatPtr(12)},
+				{Timestamp: 0, Open: floatPtr(10), Close: floatPtr(11)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 0, Open: floatPtr(10), Close: floatPtr(12)},
+			},
+		},
+		{
+			name: "VWAP is weighted by volume",
+			candles: []Candle{
+				{Timestamp: 1800, VWAP: floatPtr(20), Volume: floatPtr(3)},
+				{Timestamp: 0, VWAP: floatPtr(10), Volume: floatPtr(1)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 0, VWAP: floatPtr(17.5), Volume: floatPtr(4)},
+			},
+		},
+		{
+			name: "VWAP is unknown when a candle has no volume",
+			candles: []Candle{
+				{Timestamp: 1800, VWAP: floatPtr(20)},
+				{Timestamp: 0, VWAP: floatPtr(10), Volume: floatPtr(1)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 0, Volume: floatPtr(1)},
+			},
+		},
+		{
+			name: "a single candle keeps its VWAP without volume",
+			candles: []Candle{
+				{Timestamp: 60, VWAP: floatPtr(10)},
+			},
+			bucket: time.Hour,
+			want: []Candle{
+				{Timestamp: 0, VWAP: floatPtr(10)},
+			},
+		},
+		{
+			name: "buckets are aligned to the epoch rather than the first candle",
+			candles: []Candle{
+				{Timestamp: 25 * hour, Close: floatPtr(2)},
+				{Timestamp: 23 * hour, Close: floatPtr(1)},
+			},
+			bucket: 24 * time.Hour,
+			want: []Candle{
+				{Timestamp: 24 * hour, Close: floatPtr(2)},
+				{Timestamp: 0, Close: floatPtr(1)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resampled := ResampleCandles(test.candles, test.bucket)
+			if !reflect.DeepEqual(resampled, test.want) {
+				t.Errorf("ResampleCandles() = %s, want %s", formatCandles(resampled), formatCandles(test.want))
+			}
+		})
+	}
+}
+
+func TestResampleCandlesLeavesInputUntouched(t *testing.T) {
+	candles := []Candle{{Timestamp: 0, Close: floatPtr(1)}, {Timestamp: 3600, Close: floatPtr(2)}}
+	ResampleCandles(candles, time.Hour)
+
+	if candles[0].Timestamp != 0 || candles[1].Timestamp != 3600 {
+		t.Errorf("ResampleCandles() reordered its input: %s", formatCandles(candles))
+	}
+}
+
+func TestResamplePricePoints(t *testing.T) {
+	pricePoints := []PricePoint{
+		{Timestamp: 1800, Price: "11"},
+		{Timestamp: 600, Price: "12"},
+		{Timestamp: 0, Price: "10"},
+	}
+
+	resampled, err := ResamplePricePoints(pricePoints, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Candle{{Timestamp: 0, Open: floatPtr(10), High: floatPtr(12), Low: floatPtr(10), Close: floatPtr(11)}}
+	if !reflect.DeepEqual(resampled, want) {
+		t.Errorf("ResamplePricePoints() = %s, want %s", formatCandles(resampled), formatCandles(want))
+	}
+
+	_, err = ResamplePricePoints([]PricePoint{{Timestamp: 0, Price: "not a price"}}, time.Hour)
+	if err == nil {
+		t.Error("ResamplePricePoints() accepted an unparsable price")
+	}
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+// Candles hold pointers, so print their values instead
+func formatCandles(candles []Candle) string {
+	formatted := "["
+	for index, candle := range candles {
+		if index > 0 {
+			formatted += " "
+		}
+		formatted += "{" + formatField("t", float64(candle.Timestamp))
+		fields := []struct {
+			name  string
+			value *float64
+		}{{"o", candle.Open}, {"h", candle.High}, {"l", candle.Low}, {"c", candle.Close}, {"v", candle.Volume}, {"vwap", candle.VWAP}, {"bid", candle.Bid}, {"ask", candle.Ask}, {"mid", candle.Mid}}
+		for _, field := range fields {
+			if field.value != nil {
+				formatted += " " + formatField(field.name, *field.value)
+			}
+		}
+		if candle.Trades != nil {
+			formatted += " " + formatField("n", float64(*candle.Trades))
+		}
+		formatted += "}"
+	}
+	return formatted + "]"
+}
+
+func formatField(name string, value float64) string {
+	return name + "=" + strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,57 @@
+package datamodels
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides how often and how patiently a failed upstream request is sent again
+//
+// Only failures which may pass on their own are retried: network errors, 429 Too Many Requests and 5xx responses
+type RetryPolicy struct {
+	// How many times a failed request is sent again; 0 disables retries
+	Retries int
+	// The delay before the first retry, doubled for every following one
+	BaseDelay time.Duration
+	// The longest delay between two attempts
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by every upstream without a policy of its own
+var DefaultRetryPolicy = RetryPolicy{Retries: 2, BaseDelay: 250 * time.Millisecond, MaxDelay: 4 * time.Second}
+
+// SetRetryPolicy makes every registered source retry its failed requests according to policy
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetRetryPolicy(policy RetryPolicy) {
+	for _, source := range sources {
+		if configurable, ok := source.(upstreamSource); ok {
+			policy := policy
+			configurable.upstream().Retry = &policy
+		}
+	}
+}
+
+// The delay before a retry, counting from 0, doubled for every attempt up to MaxDelay
+//
+// Half of the delay is random, so that requests which failed together do not all come back at the same time
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 0; i < retry && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Whether a response status may pass if the request is sent again
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
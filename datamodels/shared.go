@@ -1,9 +1,13 @@
 // Package datamodels interfaces either directly with each exchange's API or with the local database
 //
-// Each datamodel must have a function which returns an array of PricePoints and an optional error
+// Each exchange datamodel implements HistoricalSource, returning an array of PricePoints and an optional error,
+// and registers itself so that it is served by the API
 package datamodels
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 // Accepted Intervals
 const (
@@ -30,6 +34,36 @@ type PricePoint struct {
 	Price     string `json:"price"`
 }
 
+// Open-high-low-close-volume data for a single bucket of time, independent of exchange
+// Fields which a source does not provide are null rather than zero
+type Candle struct {
+	Timestamp int64    `json:"timestamp"`
+	Open      *float64 `json:"open"`
+	High      *float64 `json:"high"`
+	Low       *float64 `json:"low"`
+	Close     *float64 `json:"close"`
+	Volume    *float64 `json:"volume"`
+	VWAP      *float64 `json:"vwap"`
+	Bid       *float64 `json:"bid"`
+	Ask       *float64 `json:"ask"`
+	Mid       *float64 `json:"mid"`
+	Trades    *int64   `json:"trades"`
+}
+
+// Convenience for filling the optional Candle fields
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+// Exchanges report prices as strings, which we parse into an optional Candle field
+func parsePrice(price string) (*float64, error) {
+	f, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
 // Fix to ensure all timestamps returned to the client align on each 5-minute step
 func roundTime(t time.Time) time.Time {
 	return t.Truncate(time.Minute * 5)
@@ -0,0 +1,174 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoricalSource is implemented by every exchange adapter which can serve historical price data
+//
+// Adapters register themselves in an init function, after which they are served under /historical/{name}/{interval}
+type HistoricalSource interface {
+	// The lower case name the source is served under, e.g. "kraken"
+	Name() string
+	// The canonical trading pairs accepted by FetchCandles, e.g. BTC-USD
+	Pairs() []string
+	// The intervals accepted by FetchCandles, longest lookback first
+	Intervals() []string
+	// The size of the buckets returned for an accepted interval
+	Granularity(interval string) time.Duration
+	// Given a query, return all Candles within its window in descending order (newest to oldest), giving up on the
+	// upstream once ctx is done
+	FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError)
+	// The price of a Candle which this source reports in its PricePoints, or nil if the Candle has none
+	ReferencePrice(candle Candle) *float64
+}
+
+// StreamingSource is implemented by sources which can yield their Candles as each upstream request completes, rather
+// than once the whole window has been fetched
+type StreamingSource interface {
+	HistoricalSource
+	// Given a query, call yield with consecutive batches of the Candles within its window, in descending order across
+	// batches, stopping at the first error returned by yield
+	StreamCandles(ctx context.Context, query HistoricalQuery, yield func(candles []Candle) error) *errors.MyError
+}
+
+// All accepted intervals, longest lookback first
+var allIntervals = []string{TWOYEAR, YEAR, SIXMONTH, THREEMONTH, MONTH, WEEK, DAY, TWELVEHOUR, SIXHOUR, HOUR, THIRTYMINUTE}
+
+var sources = make(map[string]HistoricalSource)
+
+// Register makes a source available under its name
+//
+// Registering two sources with the same name is a programming error and panics
+func Register(source HistoricalSource) {
+	name := strings.ToLower(source.Name())
+	if _, exists := sources[name]; exists {
+		panic(fmt.Sprintf("datamodels: source %s registered twice", name))
+	}
+	sources[name] = source
+}
+
+// Unregister removes a source, e.g. an exchange disabled by configuration, from every route
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func Unregister(name string) error {
+	name = strings.ToLower(name)
+	if _, exists := sources[name]; !exists {
+		return fmt.Errorf("unknown exchange %s", name)
+	}
+	delete(sources, name)
+	return nil
+}
+
+// GetSource returns the registered source with the given (case insensitive) name
+func GetSource(name string) (HistoricalSource, bool) {
+	source, ok := sources[strings.ToLower(name)]
+	return source, ok
+}
+
+// Sources returns all registered sources ordered by name
+func Sources() []HistoricalSource {
+	all := make([]HistoricalSource, 0, len(sources))
+	for _, source := range sources {
+		all = append(all, source)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name() < all[j].Name()
+	})
+
+	return all
+}
+
+// SourcesTrading returns the registered sources which accept a pair, ordered by name
+func SourcesTrading(pair string) []HistoricalSource {
+	trading := make([]HistoricalSource, 0)
+	for _, source := range Sources() {
+		if contains(source.Pairs(), pair) && len(source.Intervals()) > 0 {
+			trading = append(trading, source)
+		}
+	}
+	return trading
+}
+
+// FetchHistorical returns the PricePoints of a source within the query window, derived from its Candles
+func FetchHistorical(ctx context.Context, source HistoricalSource, query HistoricalQuery) ([]PricePoint, *errors.MyError) {
+	candles, err := source.FetchCandles(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return ToPricePoints(source, candles), nil
+}
+
+// StreamCandles yields the Candles of a source within the query window batch by batch if the source is a
+// StreamingSource, and all at once otherwise
+//
+// An error returned by yield, such as a client which went away, ends the stream and is returned as well
+func StreamCandles(ctx context.Context, source HistoricalSource, query HistoricalQuery, yield func(candles []Candle) error) *errors.MyError {
+	if streaming, ok := source.(StreamingSource); ok {
+		return streaming.StreamCandles(ctx, query, yield)
+	}
+
+	candles, myErr := source.FetchCandles(ctx, query)
+	if myErr != nil {
+		return myErr
+	}
+	return yieldError(yield(candles))
+}
+
+// Wrap an error returned by a yield function, keeping the code of a *errors.MyError such as a client which went away
+func yieldError(err error) *errors.MyError {
+	if err == nil {
+		return nil
+	}
+	if myErr, ok := err.(*errors.MyError); ok {
+		return myErr
+	}
+	if err == context.Canceled {
+		return &errors.MyError{Err: "The request was canceled", ErrorCode: statusClientClosedRequest, Code: errors.CANCELED}
+	}
+	return &errors.MyError{Err: err.Error()}
+}
+
+// ToPricePoints reduces Candles to the reference price of their source, skipping Candles without one
+func ToPricePoints(source HistoricalSource, candles []Candle) []PricePoint {
+	pricePoints := make([]PricePoint, 0, len(candles))
+
+	for _, candle := range candles {
+		price := source.ReferencePrice(candle)
+		if price == nil {
+			continue
+		}
+		pricePoints = append(pricePoints, PricePoint{Timestamp: candle.Timestamp, Price: strconv.FormatFloat(*price, 'f', -1, 64)})
+	}
+
+	return pricePoints
+}
+
+// Whether a list of pairs or intervals contains the given one
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the accepted intervals in their canonical order, filtered by the given predicate
+func filterIntervals(supported func(interval string) bool) []string {
+	intervals := make([]string, 0)
+	for _, interval := range allIntervals {
+		if supported(interval) {
+			intervals = append(intervals, interval)
+		}
+	}
+	return intervals
+}
@@ -0,0 +1,218 @@
+package datamodels
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Identifies a stored series
+type StoreKey struct {
+	Exchange    string
+	Pair        string
+	Granularity time.Duration
+}
+
+func (key StoreKey) String() string {
+	return fmt.Sprintf("%s/%s/%d", key.Exchange, key.Pair, int64(key.Granularity/time.Second))
+}
+
+// A stored series along with the window of time it has been fetched for
+//
+// Candles are kept in descending order (newest to oldest), like everywhere else
+type StoredSeries struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Candles []Candle  `json:"candles"`
+}
+
+// CandleStore persists Candles so that they only need to be downloaded once
+type CandleStore interface {
+	// Load returns the stored series for a key, or nil if nothing has been stored yet
+	Load(key StoreKey) (*StoredSeries, error)
+	// Save replaces the stored series for a key
+	Save(key StoreKey, series *StoredSeries) error
+}
+
+// A HistoricalSource which serves its Candles from a CandleStore, only fetching the parts of a query window which have
+// not been stored yet
+type storedSource struct {
+	HistoricalSource
+	store CandleStore
+}
+
+// Serialize backfills of the same series, so that concurrent requests do not download it twice
+var storeLocks = struct {
+	sync.Mutex
+	keys map[StoreKey]*sync.Mutex
+}{keys: make(map[StoreKey]*sync.Mutex)}
+
+// NewStoredSource wraps a source so that its Candles are backfilled into the store once and then only the missing
+// tail is fetched
+func NewStoredSource(source HistoricalSource, store CandleStore) HistoricalSource {
+	return &storedSource{HistoricalSource: source, store: store}
+}
+
+// Given a query, fetch whatever part of its window the store is missing, save it and serve the window from the store
+//
+// The newest stored bucket is always fetched again since it may not have been complete when it was stored
+func (source *storedSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	granularity := source.Granularity(query.Interval)
+	if granularity == 0 || !contains(source.Pairs(), query.Pair) {
+		// Let the source explain what is wrong with the query
+		return source.HistoricalSource.FetchCandles(ctx, query)
+	}
+	key := StoreKey{Exchange: source.Name(), Pair: query.Pair, Granularity: granularity}
+
+	lock := lockStoreKey(key)
+	defer lock.Unlock()
+
+	series, err := source.store.Load(key)
+	if err != nil {
+		logging.FromContext(ctx).Error("Could not load from the candle store", "key", key, logging.ERROR, err)
+		return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError, Code: errors.DBERROR}
+	}
+	if series == nil {
+		series = new(StoredSeries)
+	}
+
+	// Backfill everything before the stored window, unless the source serves nothing that old any more, like Kraken
+	// beyond its 720 buckets
+	if series.covered() && query.Start.Before(series.From) {
+		myErr := source.fetchInto(ctx, series, query, query.Start, series.From, granularity)
+		if myErr != nil && myErr.Kind() != errors.INVALIDREQUEST {
+			return nil, myErr
+		}
+	}
+
+	// Fetch the missing tail, starting with the last stored bucket, or the whole window if nothing is stored yet
+	if !series.covered() || query.End.After(series.To) {
+		tailStart := query.Start
+		if series.covered() {
+			tailStart = series.To.Add(-granularity)
+			if tailStart.Before(series.From) {
+				tailStart = series.From
+			}
+		}
+
+		myErr := source.fetchInto(ctx, series, query, tailStart, query.End, granularity)
+		if myErr != nil {
+			return nil, myErr
+		}
+	}
+
+	err = source.store.Save(key, series)
+	if err != nil {
+		logging.FromContext(ctx).Error("Could not save to the candle store", "key", key, logging.ERROR, err)
+		return nil, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusInternalServerError, Code: errors.DBERROR}
+	}
+
+	return filterCandles(series.Candles, query, granularity), nil
+}
+
+// Fetch the window from start to end from the wrapped source, merge it into the series and extend the stored window by
+// the part the source actually returned
+func (source *storedSource) fetchInto(ctx context.Context, series *StoredSeries, query HistoricalQuery, start, end time.Time, granularity time.Duration) *errors.MyError {
+	logging.FromContext(ctx).Info("Backfilling the candle store", logging.EXCHANGE, source.Name(), logging.PAIR, query.Pair, "from", start.Format(time.RFC3339), "to", end.Format(time.RFC3339))
+
+	window := query
+	window.Start, window.End = start, end
+
+	candles, myErr := source.HistoricalSource.FetchCandles(ctx, window)
+	if myErr != nil {
+		return myErr
+	}
+
+	series.Candles = mergeCandles(series.Candles, candles)
+	series.cover(candles, start, end, granularity)
+	return nil
+}
+
+// Whether any window has been stored yet
+func (series *StoredSeries) covered() bool {
+	return series.From.Before(series.To)
+}
+
+// Extend the stored window by the part of the window from start to end which the fetched Candles cover
+//
+// Upstreams may return fewer buckets than asked for, e.g. Kraken only serves its 720 most recent buckets, so only the
+// span from the oldest to the newest fetched bucket counts. The stored window is left alone when that span does not
+// touch it, since it would otherwise claim the gap in between, which would then never be fetched again
+func (series *StoredSeries) cover(candles []Candle, start, end time.Time, granularity time.Duration) {
+	if len(candles) == 0 {
+		return
+	}
+
+	oldest, newest := candles[0].Timestamp, candles[0].Timestamp
+	for _, candle := range candles {
+		if candle.Timestamp < oldest {
+			oldest = candle.Timestamp
+		}
+		if candle.Timestamp > newest {
+			newest = candle.Timestamp
+		}
+	}
+
+	from, to := start, end
+	if oldestStart := time.Unix(oldest, 0); oldestStart.After(from) {
+		from = oldestStart
+	}
+	if newestEnd := time.Unix(newest, 0).Add(granularity); newestEnd.Before(to) {
+		to = newestEnd
+	}
+
+	if !series.covered() {
+		series.From, series.To = from, to
+		return
+	}
+	if from.After(series.To.Add(granularity)) || to.Before(series.From.Add(-granularity)) {
+		return
+	}
+	if from.Before(series.From) {
+		series.From = from
+	}
+	if to.After(series.To) {
+		series.To = to
+	}
+}
+
+// Merge two series in descending order, preferring the newer Candles on identical timestamps
+func mergeCandles(stored []Candle, fetched []Candle) []Candle {
+	byTimestamp := make(map[int64]Candle, len(stored)+len(fetched))
+	for _, candle := range stored {
+		byTimestamp[candle.Timestamp] = candle
+	}
+	for _, candle := range fetched {
+		byTimestamp[candle.Timestamp] = candle
+	}
+
+	merged := make([]Candle, 0, len(byTimestamp))
+	for _, candle := range byTimestamp {
+		merged = append(merged, candle)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Timestamp > merged[j].Timestamp
+	})
+
+	return merged
+}
+
+// Acquire the lock of a stored series
+func lockStoreKey(key StoreKey) *sync.Mutex {
+	storeLocks.Lock()
+	lock, ok := storeLocks.keys[key]
+	if !ok {
+		lock = new(sync.Mutex)
+		storeLocks.keys[key] = lock
+	}
+	storeLocks.Unlock()
+
+	lock.Lock()
+	return lock
+}
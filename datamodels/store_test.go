@@ -0,0 +1,121 @@
+package datamodels
+
+import (
+	"context"
+	"github.com/adamhei/historicalapi/errors"
+	"testing"
+	"time"
+)
+
+// Serves hourly Candles, but at most limit of them per request like Binance (the oldest) or Kraken (the newest)
+type limitedSource struct {
+	limit      int
+	keepNewest bool
+	calls      []HistoricalQuery
+}
+
+func (*limitedSource) Name() string                              { return "limited" }
+func (*limitedSource) Pairs() []string                           { return []string{DefaultPair} }
+func (*limitedSource) Intervals() []string                       { return []string{DAY} }
+func (*limitedSource) Granularity(interval string) time.Duration { return time.Hour }
+func (*limitedSource) ReferencePrice(candle Candle) *float64     { return candle.Close }
+
+func (source *limitedSource) FetchCandles(ctx context.Context, query HistoricalQuery) ([]Candle, *errors.MyError) {
+	source.calls = append(source.calls, query)
+
+	candles := make([]Candle, 0)
+	for timestamp := bucketStart(query.End.Unix(), time.Hour); timestamp > query.Start.Unix()-3600; timestamp -= 3600 {
+		candles = append(candles, Candle{Timestamp: timestamp, Close: floatPtr(float64(timestamp))})
+	}
+	if len(candles) > source.limit {
+		if source.keepNewest {
+			candles = candles[:source.limit]
+		} else {
+			candles = candles[len(candles)-source.limit:]
+		}
+	}
+	return candles, nil
+}
+
+func TestStoredSourceOnlyCoversFetchedCandles(t *testing.T) {
+	end := time.Date(2018, time.September, 30, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		keepNewest bool
+		// A window the first request was cut short of
+		missing HistoricalQuery
+	}{
+		{
+			name:    "oldest buckets only",
+			missing: HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -10), End: end.AddDate(0, 0, -5)},
+		},
+		{
+			name:       "newest buckets only",
+			keepNewest: true,
+			missing:    HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -30), End: end.AddDate(0, 0, -25)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream := &limitedSource{limit: 240, keepNewest: test.keepNewest}
+			source := NewStoredSource(upstream, store)
+
+			// 30 days of hourly buckets, of which the source only returns 10 days
+			_, myErr := source.FetchCandles(context.Background(), HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -30), End: end})
+			if myErr != nil {
+				t.Fatal(myErr.Err)
+			}
+
+			upstream.limit = 1000
+			candles, myErr := source.FetchCandles(context.Background(), test.missing)
+			if myErr != nil {
+				t.Fatal(myErr.Err)
+			}
+			if len(candles) != 5*24+1 {
+				t.Errorf("got %d candles for the window the first request was cut short of, want %d", len(candles), 5*24+1)
+			}
+			if len(upstream.calls) != 2 {
+				t.Errorf("the source was called %d times, want 2", len(upstream.calls))
+			}
+		})
+	}
+}
+
+func TestStoredSourceFetchesOnlyTheMissingTail(t *testing.T) {
+	end := time.Date(2018, time.September, 30, 0, 0, 0, 0, time.UTC)
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &limitedSource{limit: 1000}
+	source := NewStoredSource(upstream, store)
+
+	_, myErr := source.FetchCandles(context.Background(), HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -2), End: end})
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+
+	// Served from the store
+	candles, myErr := source.FetchCandles(context.Background(), HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -1), End: end})
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+	if len(candles) != 25 || len(upstream.calls) != 1 {
+		t.Errorf("got %d candles after %d calls, want 25 after 1", len(candles), len(upstream.calls))
+	}
+
+	// Only the tail from the last stored bucket is fetched
+	_, myErr = source.FetchCandles(context.Background(), HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: end.AddDate(0, 0, -1), End: end.Add(6 * time.Hour)})
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+	if len(upstream.calls) != 2 || !upstream.calls[1].Start.Equal(end.Add(-time.Hour)) {
+		t.Errorf("fetched the tail with %+v, want it to start at %s", upstream.calls[len(upstream.calls)-1], end.Add(-time.Hour))
+	}
+}
@@ -0,0 +1,369 @@
+package datamodels
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"github.com/adamhei/historicalapi/metrics"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a single request, including reading its response, may take unless the source says otherwise
+const defaultUpstreamTimeout = 15 * time.Second
+
+// Answered to a request whose client went away before it was served, as popularized by nginx
+const statusClientClosedRequest = 499
+
+// Upstream is the API a source fetches its data from
+type Upstream struct {
+	// The scheme and host of the API, optionally followed by a path prefix, e.g. https://api.kraken.com
+	BaseURL string
+	// The client every request is sent with; http.DefaultClient if nil
+	Client *http.Client
+	// Shared by every request to the API; requests are not limited if nil
+	Limiter *RateLimiter
+	// How failed requests are retried; DefaultRetryPolicy if nil
+	Retry *RetryPolicy
+	// Fails requests fast while the API is down; requests are always sent if nil
+	Breaker *CircuitBreaker
+	// How long a single attempt, including reading its response, may take; defaultUpstreamTimeout if 0
+	Timeout time.Duration
+	// Picks the failures which may pass on their own out of a response whose status looks fine, for an API which
+	// reports errors in its body; returns why the response failed, or an empty string if it did not
+	Inspect func(response *http.Response) string
+}
+
+// UpstreamStatus describes the health of the upstream of a registered source
+type UpstreamStatus struct {
+	Exchange string         `json:"exchange"`
+	BaseURL  string         `json:"baseURL"`
+	Breaker  *BreakerStatus `json:"breaker,omitempty"`
+}
+
+// A registered source whose Upstream can be reconfigured
+type upstreamSource interface {
+	HistoricalSource
+	upstream() *Upstream
+}
+
+func (upstream *Upstream) upstream() *Upstream {
+	return upstream
+}
+
+// SetBaseURL points the named source at another API serving the same paths, such as a local stand-in server, a proxy
+// or a mirror
+//
+// Sources are shared by every request, so they must be configured before the service starts serving
+func SetBaseURL(name string, baseURL string) error {
+	upstream, err := upstreamOf(name)
+	if err != nil {
+		return err
+	}
+
+	upstream.BaseURL = baseURL
+	return nil
+}
+
+// SetTimeout bounds every attempt of a request to the named source, including reading its response
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetTimeout(name string, timeout time.Duration) error {
+	upstream, err := upstreamOf(name)
+	if err != nil {
+		return err
+	}
+
+	upstream.Timeout = timeout
+	return nil
+}
+
+// The Upstream of the named source, which must have one
+func upstreamOf(name string) (*Upstream, error) {
+	source, ok := GetSource(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown exchange %s", name)
+	}
+
+	configurable, ok := source.(upstreamSource)
+	if !ok {
+		return nil, fmt.Errorf("exchange %s has no configurable upstream", name)
+	}
+	return configurable.upstream(), nil
+}
+
+// SetHTTPClient makes every registered source send its requests with client, e.g. to add a proxy or a custom transport
+//
+// Like SetBaseURL, it must be called before the service starts serving
+func SetHTTPClient(client *http.Client) {
+	for _, source := range sources {
+		if configurable, ok := source.(upstreamSource); ok {
+			configurable.upstream().Client = client
+		}
+	}
+}
+
+// UpstreamStatuses returns the status of the upstream of every registered source, ordered by name
+//
+// Sources sharing an upstream, such as the Quandl datasets, share their breaker and report the same state
+func UpstreamStatuses() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0)
+	for _, source := range Sources() {
+		configurable, ok := source.(upstreamSource)
+		if !ok {
+			continue
+		}
+
+		upstream := configurable.upstream()
+		status := UpstreamStatus{Exchange: source.Name(), BaseURL: upstream.BaseURL}
+		if upstream.Breaker != nil {
+			breaker := upstream.Breaker.Status()
+			status.Breaker = &breaker
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// The full URL of a path on the upstream
+func (upstream *Upstream) endpoint(path string) string {
+	return strings.TrimRight(upstream.BaseURL, "/") + path
+}
+
+// Send a GET request to the upstream of an exchange, once its circuit breaker and rate limiter allow it
+//
+// Network errors, timeouts, 429 and 5xx responses are retried with a jittered exponential backoff. The last response
+// is returned once the retries run out, so that the caller can report the error of the upstream. Every attempt is
+// bounded by the timeout of the upstream, and the whole request is abandoned as soon as ctx is done
+//
+// The error is checked before the response is touched, so the caller only has to close the body of a response it
+// was actually given
+func (upstream *Upstream) get(ctx context.Context, exchange string, requestString string) (*http.Response, *errors.MyError) {
+	if ctx.Err() != nil {
+		return nil, contextError(exchange, ctx.Err())
+	}
+
+	if upstream.Breaker != nil {
+		myErr := upstream.Breaker.Allow(ctx, exchange)
+		if myErr != nil {
+			metrics.UpstreamRejected(exchange, metrics.BREAKEROPEN)
+			return nil, myErr
+		}
+	}
+
+	policy := DefaultRetryPolicy
+	if upstream.Retry != nil {
+		policy = *upstream.Retry
+	}
+
+	logger := logging.FromContext(ctx).With(logging.EXCHANGE, exchange, logging.URL, requestString)
+	failure := EMPTYSTRING
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := policy.backoff(attempt - 1)
+			logger.Info("Retrying upstream request", logging.ATTEMPT, attempt+1, "delay", delay.Round(time.Millisecond), logging.ERROR, failure)
+
+			select {
+			case <-ctx.Done():
+				upstream.abandon(ctx, exchange, failure)
+				return nil, contextError(exchange, ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+
+		if upstream.Limiter != nil {
+			myErr := upstream.Limiter.Wait(ctx, exchange)
+			if myErr != nil {
+				if myErr.Code == errors.UPSTREAMRATELIMITED {
+					metrics.UpstreamRejected(exchange, metrics.RATELIMITED)
+				}
+				upstream.abandon(ctx, exchange, failure)
+				return nil, myErr
+			}
+		}
+
+		sent := time.Now()
+		response, err := upstream.send(ctx, exchange, requestString)
+		latency := time.Since(sent)
+
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, rather than the upstream
+			metrics.ObserveUpstream(exchange, metrics.CANCELED, latency)
+			logger.Info("Abandoned upstream request", logging.ATTEMPT, attempt+1, logging.LATENCY, latency, logging.ERROR, ctx.Err())
+			upstream.abandon(ctx, exchange, failure)
+			return nil, contextError(exchange, ctx.Err())
+		} else if err != nil {
+			metrics.ObserveUpstream(exchange, metrics.NETWORKERROR, latency)
+			logger.Warn("Could not reach upstream", logging.ATTEMPT, attempt+1, logging.LATENCY, latency, logging.ERROR, err)
+			failure = err.Error()
+		} else if retryableStatus(response.StatusCode) {
+			metrics.ObserveUpstream(exchange, strconv.Itoa(response.StatusCode), latency)
+			logger.Warn("Upstream request failed", logging.ATTEMPT, attempt+1, logging.LATENCY, latency, logging.STATUS, response.StatusCode)
+			failure = response.Status
+		} else if rejection := upstream.inspect(response); rejection != EMPTYSTRING {
+			metrics.ObserveUpstream(exchange, strconv.Itoa(response.StatusCode), latency)
+			logger.Warn("Upstream request failed", logging.ATTEMPT, attempt+1, logging.LATENCY, latency, logging.STATUS, response.StatusCode, logging.ERROR, rejection)
+			failure = rejection
+		} else {
+			metrics.ObserveUpstream(exchange, strconv.Itoa(response.StatusCode), latency)
+			logger.Info("Upstream request", logging.ATTEMPT, attempt+1, logging.LATENCY, latency, logging.STATUS, response.StatusCode)
+			upstream.settle(ctx, exchange, EMPTYSTRING)
+			return response, nil
+		}
+
+		if attempt >= policy.Retries {
+			logger.Warn("Giving up on upstream request", logging.ATTEMPT, attempt+1, logging.ERROR, failure)
+			if err != nil {
+				upstream.settle(ctx, exchange, failure)
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					return nil, &errors.MyError{Err: fmt.Sprintf("Timed out waiting for %s API", exchange), ErrorCode: http.StatusGatewayTimeout, Code: errors.UPSTREAMTIMEOUT}
+				}
+				return nil, &errors.MyError{Err: fmt.Sprintf("Failed to reach %s API", exchange), ErrorCode: http.StatusBadGateway, Code: errors.UPSTREAMUNAVAILABLE}
+			}
+
+			if response.StatusCode == http.StatusTooManyRequests {
+				// The upstream is up, just busy
+				upstream.settle(ctx, exchange, EMPTYSTRING)
+			} else {
+				upstream.settle(ctx, exchange, failure)
+			}
+			return response, nil
+		}
+
+		if response != nil {
+			// Drain the body so that its connection can be reused by the retry
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+	}
+}
+
+// Send a single GET request bounded by the timeout of the upstream, letting the rate limiter observe the response
+func (upstream *Upstream) send(ctx context.Context, exchange string, requestString string) (*http.Response, error) {
+	client := upstream.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	timeout := upstream.Timeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+
+	request, err := http.NewRequest(http.MethodGet, requestString, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	response, err := client.Do(request.WithContext(attemptCtx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if upstream.Limiter != nil {
+		upstream.Limiter.Observe(ctx, exchange, response)
+	}
+
+	// The timeout also covers reading the body, so it is only released once the caller closes it
+	response.Body = &cancelingBody{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// Why a response failed according to the Inspect function of the upstream, if it has one
+func (upstream *Upstream) inspect(response *http.Response) string {
+	if upstream.Inspect == nil {
+		return EMPTYSTRING
+	}
+	return upstream.Inspect(response)
+}
+
+// Read the body of a response, leaving it to be read again by the caller, who still has to close it
+func peekBody(response *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body = peekedBody{Reader: io.MultiReader(bytes.NewReader(body), response.Body), Closer: response.Body}
+	return body, err
+}
+
+// A response body which was read once already
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// A response body which releases the context of its request once it is closed
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// Report the outcome of a request to the circuit breaker; an empty failure is a success
+func (upstream *Upstream) settle(ctx context.Context, exchange string, failure string) {
+	if upstream.Breaker == nil {
+		return
+	}
+
+	if failure == EMPTYSTRING {
+		upstream.Breaker.Success()
+	} else {
+		upstream.Breaker.Failure(ctx, exchange, failure)
+	}
+}
+
+// Report a request which was given up on before it got an answer, which says nothing about the health of the upstream
+// unless the upstream itself failed the previous attempts
+func (upstream *Upstream) abandon(ctx context.Context, exchange string, failure string) {
+	if failure != EMPTYSTRING {
+		upstream.settle(ctx, exchange, failure)
+	} else if upstream.Breaker != nil {
+		upstream.Breaker.Release()
+	}
+}
+
+// Explain why a request ended early once its context is done: either its deadline passed or its client went away
+func contextError(exchange string, err error) *errors.MyError {
+	if err == context.DeadlineExceeded {
+		return &errors.MyError{Err: fmt.Sprintf("Timed out waiting for %s API", exchange), ErrorCode: http.StatusGatewayTimeout, Code: errors.UPSTREAMTIMEOUT}
+	}
+	return &errors.MyError{Err: fmt.Sprintf("Request to %s API was canceled", exchange), ErrorCode: statusClientClosedRequest, Code: errors.CANCELED}
+}
+
+// The error of an upstream which answered with an error status, or with an error of its own
+//
+// Clients are told 502 Bad Gateway, as the failure is not theirs, unless the upstream asked them to slow down
+func upstreamError(status int, message string) *errors.MyError {
+	myErr := &errors.MyError{Err: message, ErrorCode: http.StatusBadGateway, Code: errors.UPSTREAMERROR, UpstreamStatus: status}
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusTeapot:
+		myErr.ErrorCode = http.StatusTooManyRequests
+		myErr.Code = errors.UPSTREAMRATELIMITED
+	case status >= http.StatusInternalServerError:
+		myErr.Code = errors.UPSTREAMUNAVAILABLE
+	}
+	return myErr
+}
+
+// The error of an upstream response which could not be parsed, counted in the parse failures of the exchange
+func parseFailure(exchange string, message string) *errors.MyError {
+	metrics.ParseFailure(exchange)
+	return &errors.MyError{Err: message, ErrorCode: http.StatusBadGateway, Code: errors.PARSEFAILURE}
+}
+
+// The error of an interval which a source does not serve
+func invalidInterval(interval string) *errors.MyError {
+	return &errors.MyError{Err: fmt.Sprintf("Please provide a valid interval; %s is invalid", interval), ErrorCode: http.StatusBadRequest, Code: errors.INVALIDINTERVAL}
+}
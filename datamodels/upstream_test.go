@@ -0,0 +1,309 @@
+package datamodels
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A mock exchange which counts the requests it is sent
+type countingServer struct {
+	*httptest.Server
+	exchange *mockexchange.Exchange
+	requests int64
+}
+
+func newCountingServer(t *testing.T) *countingServer {
+	server := &countingServer{exchange: mockexchange.NewExchange()}
+	server.exchange.Now = func() time.Time { return fixtureTime }
+	handler := server.exchange.Handler()
+	server.Server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&server.requests, 1)
+		handler.ServeHTTP(responseWriter, request)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// The requests sent since the last call
+func (server *countingServer) sent() int64 {
+	return atomic.SwapInt64(&server.requests, 0)
+}
+
+// Retries without waiting, so that the tests do not have to
+var quickRetries = &RetryPolicy{Retries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+var binanceTestQuery = HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: fixtureTime.Add(-6 * time.Hour), End: fixtureTime}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Retries: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		retry int
+		delay time.Duration
+	}{
+		{retry: 0, delay: 100 * time.Millisecond},
+		{retry: 1, delay: 200 * time.Millisecond},
+		{retry: 3, delay: 800 * time.Millisecond},
+		{retry: 4, delay: time.Second},
+		{retry: 10, delay: time.Second},
+	}
+
+	for _, test := range tests {
+		// Half of the delay is random, so check its bounds a few times over
+		for sample := 0; sample < 20; sample++ {
+			delay := policy.backoff(test.retry)
+			if delay < test.delay/2 || delay > test.delay {
+				t.Errorf("backoff(%d) = %s, want between %s and %s", test.retry, delay, test.delay/2, test.delay)
+			}
+		}
+	}
+
+	if delay := (RetryPolicy{}).backoff(3); delay != 0 {
+		t.Errorf("backoff without a base delay = %s, want 0", delay)
+	}
+}
+
+func TestRetryableStatus(t *testing.T) {
+	for status, retryable := range map[int]bool{
+		http.StatusOK:                  false,
+		http.StatusBadRequest:          false,
+		http.StatusNotFound:            false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusServiceUnavailable:  true,
+	} {
+		if retryableStatus(status) != retryable {
+			t.Errorf("retryableStatus(%d) = %t, want %t", status, !retryable, retryable)
+		}
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	breaker := NewCircuitBreaker(2, 50*time.Millisecond)
+	assertState := func(state string) {
+		t.Helper()
+		if status := breaker.Status(); status.State != state {
+			t.Fatalf("the breaker is %s, want %s", status.State, state)
+		}
+	}
+
+	// A single failure stays below the threshold
+	if myErr := breaker.Allow(context.Background(), "test"); myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+	breaker.Failure(context.Background(), "test", "503 Service Unavailable")
+	assertState(BREAKERCLOSED)
+
+	// The second consecutive failure opens it
+	breaker.Allow(context.Background(), "test")
+	breaker.Failure(context.Background(), "test", "503 Service Unavailable")
+	assertState(BREAKEROPEN)
+	if myErr := breaker.Allow(context.Background(), "test"); myErr == nil || myErr.Status() != http.StatusServiceUnavailable || myErr.Kind() != errors.UPSTREAMUNAVAILABLE {
+		t.Fatalf("an open breaker allowed a request: %v", myErr)
+	}
+
+	// Once the cooldown passes, a single trial goes through
+	time.Sleep(60 * time.Millisecond)
+	assertState(BREAKERHALFOPEN)
+	if myErr := breaker.Allow(context.Background(), "test"); myErr != nil {
+		t.Fatalf("a half-open breaker rejected the trial: %s", myErr.Err)
+	}
+	if myErr := breaker.Allow(context.Background(), "test"); myErr == nil {
+		t.Fatal("a half-open breaker allowed a second request alongside the trial")
+	}
+
+	// A failed trial opens it again at once
+	breaker.Failure(context.Background(), "test", "503 Service Unavailable")
+	assertState(BREAKEROPEN)
+
+	// A trial which is never sent leaves the next request to be the trial
+	time.Sleep(60 * time.Millisecond)
+	breaker.Allow(context.Background(), "test")
+	breaker.Release()
+	if myErr := breaker.Allow(context.Background(), "test"); myErr != nil {
+		t.Fatalf("a released trial was not given back: %s", myErr.Err)
+	}
+
+	// A successful trial closes it
+	breaker.Success()
+	assertState(BREAKERCLOSED)
+	if status := breaker.Status(); status.Failures != 0 {
+		t.Errorf("a closed breaker counts %d failures, want 0", status.Failures)
+	}
+}
+
+func TestUpstreamRetriesFailures(t *testing.T) {
+	server := newCountingServer(t)
+	server.exchange.Fail("binance", http.StatusServiceUnavailable)
+	upstream := &Upstream{BaseURL: server.URL, Retry: quickRetries, Breaker: NewCircuitBreaker(1, 50*time.Millisecond)}
+
+	_, myErr := PollBinanceHistorical(context.Background(), upstream, binanceTestQuery)
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMUNAVAILABLE || myErr.UpstreamStatus != http.StatusServiceUnavailable {
+		t.Fatalf("PollBinanceHistorical() = %v, want %s", myErr, errors.UPSTREAMUNAVAILABLE)
+	}
+	if sent := server.sent(); sent != 3 {
+		t.Errorf("a failing upstream was sent %d requests, want the request and 2 retries", sent)
+	}
+
+	// The failure opened the breaker, which fails the next request without sending it
+	if state := upstream.Breaker.Status().State; state != BREAKEROPEN {
+		t.Fatalf("the breaker is %s after a failed request, want %s", state, BREAKEROPEN)
+	}
+	_, myErr = PollBinanceHistorical(context.Background(), upstream, binanceTestQuery)
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMUNAVAILABLE {
+		t.Fatalf("PollBinanceHistorical() = %v, want %s", myErr, errors.UPSTREAMUNAVAILABLE)
+	}
+	if sent := server.sent(); sent != 0 {
+		t.Errorf("an open breaker let %d requests through", sent)
+	}
+
+	// Once the upstream recovers, the trial request closes the breaker
+	server.exchange.Recover("binance")
+	time.Sleep(60 * time.Millisecond)
+	_, myErr = PollBinanceHistorical(context.Background(), upstream, binanceTestQuery)
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+	if sent := server.sent(); sent != 1 {
+		t.Errorf("the trial sent %d requests, want 1", sent)
+	}
+	if state := upstream.Breaker.Status().State; state != BREAKERCLOSED {
+		t.Errorf("the breaker is %s after a successful trial, want %s", state, BREAKERCLOSED)
+	}
+}
+
+func TestUpstreamRetriesRateLimits(t *testing.T) {
+	server := newCountingServer(t)
+	server.exchange.Fail("binance", http.StatusTooManyRequests)
+	upstream := &Upstream{BaseURL: server.URL, Retry: quickRetries, Breaker: NewCircuitBreaker(1, time.Minute)}
+
+	_, myErr := PollBinanceHistorical(context.Background(), upstream, binanceTestQuery)
+	if myErr == nil || myErr.Status() != http.StatusTooManyRequests || myErr.Kind() != errors.UPSTREAMRATELIMITED {
+		t.Fatalf("PollBinanceHistorical() = %v, want a 429 %s", myErr, errors.UPSTREAMRATELIMITED)
+	}
+	if sent := server.sent(); sent != 3 {
+		t.Errorf("a rate limited upstream was sent %d requests, want the request and 2 retries", sent)
+	}
+
+	// A busy upstream is still up
+	if status := upstream.Breaker.Status(); status.State != BREAKERCLOSED || status.Failures != 0 {
+		t.Errorf("the breaker is %s with %d failures after a rate limit, want %s", status.State, status.Failures, BREAKERCLOSED)
+	}
+}
+
+func TestUpstreamDoesNotRetryClientErrors(t *testing.T) {
+	server := newCountingServer(t)
+	server.exchange.Fail("binance", http.StatusBadRequest)
+	upstream := &Upstream{BaseURL: server.URL, Retry: quickRetries, Breaker: NewCircuitBreaker(1, time.Minute)}
+
+	_, myErr := PollBinanceHistorical(context.Background(), upstream, binanceTestQuery)
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMERROR {
+		t.Fatalf("PollBinanceHistorical() = %v, want %s", myErr, errors.UPSTREAMERROR)
+	}
+	if sent := server.sent(); sent != 1 {
+		t.Errorf("a rejected request was sent %d times, want 1", sent)
+	}
+	if state := upstream.Breaker.Status().State; state != BREAKERCLOSED {
+		t.Errorf("the breaker is %s after a rejected request, want %s", state, BREAKERCLOSED)
+	}
+}
+
+func TestUpstreamRetriesKrakenErrors(t *testing.T) {
+	server := newCountingServer(t)
+	// Kraken reports its services being unavailable with 200 OK
+	server.exchange.Fail("kraken", http.StatusOK)
+	upstream := &Upstream{BaseURL: server.URL, Retry: quickRetries, Breaker: NewCircuitBreaker(1, time.Minute), Inspect: inspectKrakenResponse}
+	query := HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: fixtureTime.Add(-6 * time.Hour), End: fixtureTime}
+
+	_, myErr := PollKrakenHistorical(context.Background(), upstream, query)
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMUNAVAILABLE || myErr.UpstreamStatus != http.StatusOK {
+		t.Fatalf("PollKrakenHistorical() = %v, want %s", myErr, errors.UPSTREAMUNAVAILABLE)
+	}
+	if sent := server.sent(); sent != 3 {
+		t.Errorf("an unavailable Kraken was sent %d requests, want the request and 2 retries", sent)
+	}
+	if status := upstream.Breaker.Status(); status.State != BREAKEROPEN || status.LastError != "EService:Unavailable" {
+		t.Errorf("the breaker is %s after %q, want %s after EService:Unavailable", status.State, status.LastError, BREAKEROPEN)
+	}
+}
+
+func TestKrakenErrorStatus(t *testing.T) {
+	for krakenError, status := range map[string]int{
+		"EService:Unavailable":       http.StatusServiceUnavailable,
+		"EService:Busy":              http.StatusServiceUnavailable,
+		"EAPI:Rate limit exceeded":   http.StatusTooManyRequests,
+		"EQuery:Unknown asset pair":  http.StatusOK,
+		"EGeneral:Invalid arguments": http.StatusOK,
+	} {
+		if got := krakenErrorStatus(krakenError); got != status {
+			t.Errorf("krakenErrorStatus(%q) = %d, want %d", krakenError, got, status)
+		}
+	}
+}
+
+func TestUpstreamDoesNotRetryKrakenRejections(t *testing.T) {
+	requests := int64(0)
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		responseWriter.Write([]byte(`{"error":["EQuery:Unknown asset pair"]}`))
+	}))
+	defer server.Close()
+	upstream := &Upstream{BaseURL: server.URL, Retry: quickRetries, Breaker: NewCircuitBreaker(1, time.Minute), Inspect: inspectKrakenResponse}
+	query := HistoricalQuery{Pair: DefaultPair, Interval: DAY, Start: fixtureTime.Add(-6 * time.Hour), End: fixtureTime}
+
+	// The body is still there for the parser after being inspected
+	_, myErr := PollKrakenHistorical(context.Background(), upstream, query)
+	if myErr == nil || myErr.Kind() != errors.UPSTREAMERROR || myErr.Err != "EQuery:Unknown asset pair" {
+		t.Fatalf("PollKrakenHistorical() = %v, want %s", myErr, errors.UPSTREAMERROR)
+	}
+	if requests := atomic.LoadInt64(&requests); requests != 1 {
+		t.Errorf("a rejected request was sent %d times, want 1", requests)
+	}
+	if state := upstream.Breaker.Status().State; state != BREAKERCLOSED {
+		t.Errorf("the breaker is %s after a rejected request, want %s", state, BREAKERCLOSED)
+	}
+}
+
+func TestUpstreamLogsWithTheRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("Retry-After", "1")
+		responseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	upstream := &Upstream{Retry: &RetryPolicy{}, Breaker: NewCircuitBreaker(1, time.Minute), Limiter: NewRateLimiter(100, 100)}
+
+	var lines bytes.Buffer
+	ctx := logging.WithLogger(context.Background(), logging.New(&lines, slog.LevelDebug, logging.JSON).With(logging.REQUESTID, "request-1"))
+	response, myErr := upstream.get(ctx, "test", server.URL)
+	if myErr != nil {
+		t.Fatal(myErr.Err)
+	}
+	response.Body.Close()
+
+	// The pause of the rate limiter and the opening of the breaker are traced back to the request which caused them
+	logged := make(map[string]string)
+	decoder := json.NewDecoder(&lines)
+	for decoder.More() {
+		var line map[string]interface{}
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		requestID, _ := line[logging.REQUESTID].(string)
+		logged[line["msg"].(string)] = requestID
+	}
+	for _, message := range []string{"Pausing upstream requests as asked by the upstream", "Opened a circuit breaker"} {
+		if requestID, ok := logged[message]; !ok || requestID != "request-1" {
+			t.Errorf("%q was logged with request id %q, want request-1", message, requestID)
+		}
+	}
+}
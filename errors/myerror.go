@@ -1,11 +1,110 @@
 // Package errors defines a custom error type to include http errors
 package errors
 
+import "net/http"
+
+// Machine-readable error codes, so that clients can branch on the kind of error rather than on its message
+const (
+	INVALIDINTERVAL     = "invalid_interval"
+	INVALIDREQUEST      = "invalid_request"
+	NOTFOUND            = "not_found"
+	UPSTREAMUNAVAILABLE = "upstream_unavailable"
+	UPSTREAMRATELIMITED = "upstream_rate_limited"
+	UPSTREAMTIMEOUT     = "upstream_timeout"
+	// The upstream answered, but with an error of its own
+	UPSTREAMERROR = "upstream_error"
+	// The upstream answered with a body which could not be parsed
+	PARSEFAILURE = "parse_failure"
+	DBERROR      = "db_error"
+	// The service runs without the database a route needs
+	DBUNAVAILABLE = "db_unavailable"
+	// The client went away before it was answered
+	CANCELED      = "canceled"
+	INTERNALERROR = "internal_error"
+)
+
 type MyError struct {
-	Err string
+	Err       string
 	ErrorCode int
+	// One of the codes above; derived from ErrorCode if empty
+	Code string
+	// The exchange which failed, if any
+	Source string
+	// The status the upstream answered with, if it answered
+	UpstreamStatus int
+}
+
+// ErrorResponse is the JSON body of every error response
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody describes an error to the client
+type ErrorBody struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	Status         int    `json:"status"`
+	Source         string `json:"source,omitempty"`
+	UpstreamStatus int    `json:"upstreamStatus,omitempty"`
+	// Identifies the request in the logs of the service
+	RequestID string `json:"requestId,omitempty"`
 }
 
 func (e *MyError) Error() string {
 	return e.Err
 }
+
+// Status returns the HTTP status of the error, 500 if it has none
+func (e *MyError) Status() int {
+	if e.ErrorCode == 0 {
+		return http.StatusInternalServerError
+	}
+	return e.ErrorCode
+}
+
+// Kind returns the code of the error, or the one matching its status if it has none
+func (e *MyError) Kind() string {
+	if e.Code != "" {
+		return e.Code
+	}
+
+	switch status := e.Status(); {
+	case status == http.StatusNotFound:
+		return NOTFOUND
+	case status == http.StatusTooManyRequests:
+		return UPSTREAMRATELIMITED
+	case status == http.StatusGatewayTimeout:
+		return UPSTREAMTIMEOUT
+	case status == http.StatusBadGateway || status == http.StatusServiceUnavailable:
+		return UPSTREAMUNAVAILABLE
+	case status >= 400 && status < 500:
+		return INVALIDREQUEST
+	default:
+		return INTERNALERROR
+	}
+}
+
+// From returns a copy of the error attributed to an exchange, unless it already is
+//
+// Errors may be shared by concurrent requests, e.g. through the cache, so they are never modified in place
+func (e *MyError) From(source string) *MyError {
+	if e == nil || e.Source != "" {
+		return e
+	}
+
+	attributed := *e
+	attributed.Source = source
+	return &attributed
+}
+
+// Response returns the body describing the error to the client
+func (e *MyError) Response(requestID string) ErrorResponse {
+	return ErrorResponse{Error: ErrorBody{
+		Code:           e.Kind(),
+		Message:        e.Err,
+		Status:         e.Status(),
+		Source:         e.Source,
+		UpstreamStatus: e.UpstreamStatus,
+		RequestID:      requestID,
+	}}
+}
@@ -0,0 +1,113 @@
+// Package fixtures records the raw responses of the upstream exchange APIs to disk and replays them, so that an odd
+// result can be reproduced exactly and the datamodels parsers can be tested against real responses
+//
+// Both the Recorder and the Replayer are http.RoundTrippers, installed with datamodels.SetHTTPClient
+package fixtures
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Fixture is a recorded upstream response along with the request it answered
+type Fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// Query parameters which are never written to disk and are ignored when matching requests
+var secretParams = []string{"api_key"}
+
+// Headers which are never written to disk, either because they are secret or because the recorded body, which is
+// stored decoded, no longer matches them
+var droppedHeaders = []string{"Set-Cookie", "Content-Length", "Content-Encoding"}
+
+// Characters which do not belong in a file name
+var unsafeCharacters = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// Key identifies a request by its method and URL, without secrets and with its query parameters sorted, so that
+// the same request always maps to the same fixture
+func Key(request *http.Request) string {
+	return request.Method + " " + redact(request.URL)
+}
+
+// The URL of a request without its secret query parameters
+func redact(requestURL *url.URL) string {
+	redacted := *requestURL
+	query := redacted.Query()
+	for _, param := range secretParams {
+		query.Del(param)
+	}
+
+	// Encode sorts the parameters
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// The fixture file of a request within dir, e.g. api.kraken.com_0_public_OHLC_3f2a9c0b1d4e.json
+func fixturePath(dir string, request *http.Request) string {
+	sum := sha1.Sum([]byte(Key(request)))
+	name := unsafeCharacters.ReplaceAllString(request.URL.Host+request.URL.Path, "_")
+	return filepath.Join(dir, fmt.Sprintf("%s_%s.json", name, hex.EncodeToString(sum[:6])))
+}
+
+// Load returns the fixture recorded in dir for a request, or nil if there is none
+func Load(dir string, request *http.Request) (*Fixture, error) {
+	contents, err := os.ReadFile(fixturePath(dir, request))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := new(Fixture)
+	err = json.Unmarshal(contents, fixture)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt fixture %s: %s", fixturePath(dir, request), err)
+	}
+	return fixture, nil
+}
+
+// Save writes the fixture of a request to dir, replacing any earlier recording of the same request
+func Save(dir string, request *http.Request, fixture *Fixture) error {
+	contents, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(dir, "fixture")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(contents)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), fixturePath(dir, request))
+}
+
+// A copy of a response header without the dropped headers
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range droppedHeaders {
+		redacted.Del(name)
+	}
+	return redacted
+}
@@ -0,0 +1,63 @@
+package fixtures
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/adamhei/historicalapi/logging"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Recorder forwards every request upstream and saves the response to Dir before handing it back
+type Recorder struct {
+	Dir string
+	// The transport requests are forwarded with; http.DefaultTransport if nil
+	Transport http.RoundTripper
+}
+
+// NewRecorder returns a Recorder saving into dir, creating the directory if needed
+func NewRecorder(dir string) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: dir}, nil
+}
+
+// RoundTrip forwards a request and records its response
+//
+// A response which cannot be recorded is an error, so that a recording session never silently misses a response
+func (recorder *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport := recorder.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := &Fixture{
+		Method: request.Method,
+		URL:    redact(request.URL),
+		Status: response.StatusCode,
+		Header: redactHeader(response.Header),
+		Body:   string(body),
+	}
+	err = Save(recorder.Dir, request, fixture)
+	if err != nil {
+		return nil, fmt.Errorf("could not record %s: %s", Key(request), err)
+	}
+	logging.FromContext(request.Context()).Info("Recorded an upstream response", "fixture", Key(request))
+
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return response, nil
+}
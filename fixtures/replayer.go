@@ -0,0 +1,48 @@
+package fixtures
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Replayer answers every request with the response recorded for it in Dir, without touching the network
+type Replayer struct {
+	Dir string
+}
+
+// NewReplayer returns a Replayer serving the fixtures recorded in dir
+func NewReplayer(dir string) *Replayer {
+	return &Replayer{Dir: dir}
+}
+
+// RoundTrip returns the recorded response of a request, or an error if it was never recorded
+func (replayer *Replayer) RoundTrip(request *http.Request) (*http.Response, error) {
+	fixture, err := Load(replayer.Dir, request)
+	if err != nil {
+		return nil, err
+	}
+	if fixture == nil {
+		return nil, fmt.Errorf("no fixture recorded for %s in %s", Key(request), replayer.Dir)
+	}
+
+	header := fixture.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(fixture.Body)))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fixture.Status, http.StatusText(fixture.Status)),
+		StatusCode:    fixture.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(fixture.Body)),
+		ContentLength: int64(len(fixture.Body)),
+		Request:       request,
+	}, nil
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// Arbitrage serves the spread between two exchanges trading the same pair (BTC-USD if absent) over an interval
+//
+// The optional threshold query parameter is the percentage spread above which a bucket counts as an opportunity, and
+// the window can be chosen with start and end as for Historical
+// As CSV, only the spreads are written
+func (appContext *AppContext) Arbitrage(responseWriter http.ResponseWriter, request *http.Request) {
+	args := mux.Vars(request)
+	statuses := make(cacheStatuses, 2)
+
+	sourceA, myErr := appContext.lookupReportingSource(args[EXCHANGEA], statuses.reporter(0))
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	sourceB, myErr := appContext.lookupReportingSource(args[EXCHANGEB], statuses.reporter(1))
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	threshold, myErr := parseThreshold(request.URL.Query().Get(THRESHOLD))
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	query, myErr := parseQuery(request)
+	if myErr == nil {
+		myErr = datamodels.CheckWindow(sourceA, query)
+	}
+	if myErr == nil {
+		myErr = datamodels.CheckWindow(sourceB, query)
+	}
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	report, myErr := datamodels.PollArbitrage(queryContext(request, query), sourceA, sourceB, query, threshold)
+	statuses.write(responseWriter)
+
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+	} else {
+		respondAs(responseWriter, request, seriesFilename(request, "arbitrage"), report, spreadTable{report})
+	}
+}
+
+// Parse the threshold query parameter, falling back on the default when absent
+func parseThreshold(threshold string) (float64, *errors.MyError) {
+	if threshold == datamodels.EMPTYSTRING {
+		return datamodels.DefaultSpreadThreshold, nil
+	}
+
+	parsed, err := strconv.ParseFloat(threshold, 64)
+	if err != nil || parsed < 0 {
+		return 0, &errors.MyError{Err: fmt.Sprintf("Please provide a valid threshold; %s is invalid", threshold), ErrorCode: http.StatusBadRequest}
+	}
+	return parsed, nil
+}
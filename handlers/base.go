@@ -8,19 +8,60 @@ package handlers
 
 import (
 	"encoding/json"
+	"github.com/adamhei/historicalapi/datamodels"
 	"github.com/adamhei/historicalapi/errors"
 	"gopkg.in/mgo.v2"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
-const INTERVAL = "interval"
+// Path arguments
+const (
+	INTERVAL  = "interval"
+	PAIR      = "pair"
+	EXCHANGE  = "exchange"
+	EXCHANGEA = "exchangeA"
+	EXCHANGEB = "exchangeB"
+)
 
-// Dependency injection for easy access to the database
-//
-// Currently obsolete as Gemini is not supported
+// Reports whether each series of a response was answered from the cache
+const CACHEHEADER = "X-Cache"
+
+// Query parameters
+const (
+	THRESHOLD = "threshold"
+	BUCKET    = "bucket"
+	START     = "start"
+	END       = "end"
+	FORMAT    = "format"
+	EXCHANGES = "exchanges"
+)
+
+// Dependency injection for easy access to the database, the local candle store and the cache
 type AppContext struct {
+	// Currently obsolete as Gemini is not supported; nil when the service runs without MongoDB, in which case the
+	// routes needing it answer 503 Service Unavailable
 	Db *mgo.Database
+	// Whether a mounted route reads MongoDB, which makes the service unready while it is down; set by the router
+	MongoRequired bool
+	// When set, the historical routes are served from this store, which only fetches the data it is missing
+	Store datamodels.CandleStore
+	// When set, recently served series are answered from memory
+	Cache *datamodels.CandleCache
+	// When set, the live routes push the latest prices polled by this hub
+	LiveHub *datamodels.LiveHub
+	// When set, /readyz reports the latest probe of every exchange
+	Prober *datamodels.Prober
+	// Logs every request along with the upstream calls it triggered; the default logger if nil
+	Logger *slog.Logger
+}
+
+// The database of the routes needing MongoDB, or a 503 error when the service runs without it
+func (appContext *AppContext) database() (*mgo.Database, *errors.MyError) {
+	if appContext.Db == nil {
+		return nil, &errors.MyError{Err: "This route needs MongoDB, which this instance runs without", ErrorCode: http.StatusServiceUnavailable, Code: errors.DBUNAVAILABLE}
+	}
+	return appContext.Db, nil
 }
 
 // The index endpoint
@@ -29,16 +70,16 @@ func (appcontext *AppContext) Index(responseWriter http.ResponseWriter, request
 }
 
 // respond is the all in one method for writing a response or error back to the client
+//
+// Errors are written as an {"error": {...}} object carrying their code, source and the ID of the request
 func respond(writer http.ResponseWriter, data interface{}, err *errors.MyError) {
 	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 	if err != nil {
-		log.Println(err.Err)
-		errCode := err.ErrorCode
-		if errCode == 0 {
-			errCode = http.StatusInternalServerError
-		}
-		http.Error(writer, err.Err, errCode)
+		logError(writer, err)
+		writer.Header().Set("X-Content-Type-Options", "nosniff")
+		writer.WriteHeader(err.Status())
+		json.NewEncoder(writer).Encode(err.Response(writer.Header().Get(REQUESTIDHEADER)))
 	} else {
 		json.NewEncoder(writer).Encode(data)
 	}
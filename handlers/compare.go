@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/metrics"
+	"net/http"
+	"strings"
+)
+
+// Compare serves the PricePoints of several exchanges for the same pair (BTC-USD if absent) and interval, fetching
+// them concurrently so that the response takes about as long as the slowest exchange
+//
+// The optional exchanges query parameter (e.g. kraken,gdax) selects the exchanges, every one trading the pair by
+// default, and the same start, end, bucket and format query parameters as Historical are accepted. An exchange which
+// fails reports its error in its series rather than failing the whole comparison
+func (appContext *AppContext) Compare(responseWriter http.ResponseWriter, request *http.Request) {
+	query, myErr := parseQuery(request)
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	bucketSize, myErr := parseBucket(request)
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	exchanges := parseExchanges(request.URL.Query().Get(EXCHANGES), query.Pair)
+	if len(exchanges) == 0 {
+		respond(responseWriter, nil, &errors.MyError{Err: fmt.Sprintf("Please provide a valid pair; no exchange trades %s", query.Pair), ErrorCode: http.StatusBadRequest})
+		return
+	}
+
+	statuses := make(cacheStatuses, len(exchanges))
+	sources := make([]datamodels.HistoricalSource, len(exchanges))
+	for index, exchange := range exchanges {
+		sources[index], myErr = appContext.lookupReportingSource(exchange, statuses.reporter(index))
+		if myErr == nil {
+			myErr = datamodels.CheckWindow(sources[index], query)
+		}
+		if myErr != nil {
+			respond(responseWriter, nil, myErr)
+			return
+		}
+	}
+
+	comparison, myErr := datamodels.PollComparison(queryContext(request, query), sources, query, bucketSize)
+	statuses.write(responseWriter)
+
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+	} else {
+		for _, series := range comparison.Series {
+			metrics.PricePointsReturned(series.Exchange, len(series.PricePoints))
+		}
+		respondAs(responseWriter, request, seriesFilename(request, "compare"), comparison, newComparisonTable(comparison))
+	}
+}
+
+// Split the comma separated exchanges query parameter, defaulting to every exchange trading the pair
+func parseExchanges(exchanges string, pair string) []string {
+	names := make([]string, 0)
+	for _, exchange := range strings.Split(exchanges, ",") {
+		if exchange = strings.TrimSpace(exchange); exchange != datamodels.EMPTYSTRING {
+			names = append(names, exchange)
+		}
+	}
+	if len(names) > 0 {
+		return names
+	}
+
+	for _, source := range datamodels.SourcesTrading(pair) {
+		names = append(names, source.Name())
+	}
+	return names
+}
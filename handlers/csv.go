@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicaldata/trademodels"
+	"github.com/gorilla/mux"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Flush the CSV writer after this many rows, so that long series are streamed rather than buffered
+const csvFlushRows = 500
+
+// Write a table as CSV, suggesting the client saves it as filename.csv
+func respondCSV(writer http.ResponseWriter, filename string, table seriesTable) {
+	writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".csv"}))
+
+	csvWriter := csv.NewWriter(writer)
+	csvWriter.Write(table.header())
+	for index := 0; index < table.len(); index++ {
+		csvWriter.Write(table.row(index))
+
+		if (index+1)%csvFlushRows == 0 {
+			csvWriter.Flush()
+			if flusher, ok := writer.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		// The status has been sent already, so the client, which most likely went away, sees a truncated table
+		logError(writer, &errors.MyError{Err: fmt.Sprintf("Could not write CSV %s: %s", filename, err), Code: errors.CANCELED})
+	}
+}
+
+// A suggested file name made of the arguments of a series, e.g. kraken_BTC-USD_MONTH
+func csvFilename(parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != datamodels.EMPTYSTRING {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "_")
+}
+
+// The suggested file name of the series of a request, named after its path arguments and followed by any suffixes
+func seriesFilename(request *http.Request, prefix string, suffixes ...string) string {
+	args := mux.Vars(request)
+
+	pair := args[PAIR]
+	if pair == datamodels.EMPTYSTRING {
+		pair = datamodels.DefaultPair
+	}
+
+	parts := []string{prefix, args[EXCHANGE], args[EXCHANGEA], args[EXCHANGEB], strings.ToUpper(pair), args[INTERVAL]}
+	return csvFilename(append(parts, suffixes...)...)
+}
+
+type pricePointTable []datamodels.PricePoint
+
+func (table pricePointTable) header() []string {
+	return []string{"timestamp", "price"}
+}
+
+func (table pricePointTable) len() int {
+	return len(table)
+}
+
+func (table pricePointTable) row(index int) []string {
+	return []string{strconv.FormatInt(table[index].Timestamp, 10), table[index].Price}
+}
+
+func (table pricePointTable) value(index int) interface{} {
+	return table[index]
+}
+
+// Fields an exchange does not provide are left empty
+type candleTable []datamodels.Candle
+
+func (table candleTable) header() []string {
+	return []string{"timestamp", "open", "high", "low", "close", "volume", "vwap", "bid", "ask", "mid", "trades"}
+}
+
+func (table candleTable) len() int {
+	return len(table)
+}
+
+func (table candleTable) row(index int) []string {
+	candle := table[index]
+
+	row := []string{strconv.FormatInt(candle.Timestamp, 10)}
+	for _, value := range []*float64{candle.Open, candle.High, candle.Low, candle.Close, candle.Volume, candle.VWAP, candle.Bid, candle.Ask, candle.Mid} {
+		row = append(row, formatOptional(value))
+	}
+
+	trades := datamodels.EMPTYSTRING
+	if candle.Trades != nil {
+		trades = strconv.FormatInt(*candle.Trades, 10)
+	}
+	return append(row, trades)
+}
+
+func (table candleTable) value(index int) interface{} {
+	return table[index]
+}
+
+// The spreads of an arbitrage report, with the prices named after their exchanges; the summary is only written as JSON
+type spreadTable struct {
+	report *datamodels.ArbitrageReport
+}
+
+func (table spreadTable) header() []string {
+	return []string{"timestamp", table.report.ExchangeA, table.report.ExchangeB, "spread", "percentSpread"}
+}
+
+func (table spreadTable) len() int {
+	return len(table.report.Spreads)
+}
+
+func (table spreadTable) row(index int) []string {
+	spread := table.report.Spreads[index]
+	return []string{
+		strconv.FormatInt(spread.Timestamp, 10),
+		formatFloat(spread.PriceA),
+		formatFloat(spread.PriceB),
+		formatFloat(spread.Spread),
+		formatFloat(spread.PercentSpread),
+	}
+}
+
+func (table spreadTable) value(index int) interface{} {
+	return table.report.Spreads[index]
+}
+
+// A price point of one exchange within a comparison
+type comparisonRow struct {
+	Exchange  string `json:"exchange"`
+	Timestamp int64  `json:"timestamp"`
+	Price     string `json:"price"`
+}
+
+// The series of a comparison one after another, leaving out the exchanges which failed
+type comparisonTable []comparisonRow
+
+func newComparisonTable(comparison *datamodels.Comparison) comparisonTable {
+	table := make(comparisonTable, 0)
+	for _, series := range comparison.Series {
+		for _, pricePoint := range series.PricePoints {
+			table = append(table, comparisonRow{Exchange: series.Exchange, Timestamp: pricePoint.Timestamp, Price: pricePoint.Price})
+		}
+	}
+	return table
+}
+
+func (table comparisonTable) header() []string {
+	return []string{"exchange", "timestamp", "price"}
+}
+
+func (table comparisonTable) len() int {
+	return len(table)
+}
+
+func (table comparisonTable) row(index int) []string {
+	return []string{table[index].Exchange, strconv.FormatInt(table[index].Timestamp, 10), table[index].Price}
+}
+
+func (table comparisonTable) value(index int) interface{} {
+	return table[index]
+}
+
+type geminiTable []trademodels.GeminiOrder
+
+func (table geminiTable) header() []string {
+	return []string{"timestampms", "price"}
+}
+
+func (table geminiTable) len() int {
+	return len(table)
+}
+
+func (table geminiTable) row(index int) []string {
+	return []string{strconv.FormatInt(table[index].Timestampms, 10), table[index].Price}
+}
+
+func (table geminiTable) value(index int) interface{} {
+	return table[index]
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func formatOptional(value *float64) string {
+	if value == nil {
+		return datamodels.EMPTYSTRING
+	}
+	return formatFloat(*value)
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVResponses(t *testing.T) {
+	useMockExchange(t)
+	appContext := &AppContext{}
+	router := mux.NewRouter()
+	router.HandleFunc("/historical/{exchange}/{interval}", appContext.Historical)
+	router.HandleFunc("/candles/{exchange}/{interval}", appContext.Candles)
+
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		header   []string
+		filename string
+	}{
+		{
+			name:     "price points",
+			path:     "/historical/gdax/day?format=csv",
+			header:   []string{"timestamp", "price"},
+			filename: "gdax_BTC-USD_day.csv",
+		},
+		{
+			name:     "candles",
+			path:     "/candles/gdax/day?format=CSV",
+			header:   []string{"timestamp", "open", "high", "low", "close", "volume", "vwap", "bid", "ask", "mid", "trades"},
+			filename: "gdax_BTC-USD_day_candles.csv",
+		},
+		{
+			name:     "accept header",
+			path:     "/candles/gdax/day",
+			accept:   "application/json;q=0.5, text/csv",
+			header:   []string{"timestamp", "open", "high", "low", "close", "volume", "vwap", "bid", "ask", "mid", "trades"},
+			filename: "gdax_BTC-USD_day_candles.csv",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.accept != "" {
+				request.Header.Set("Accept", test.accept)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("GET %s answered %d: %s", test.path, recorder.Code, recorder.Body)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/csv; charset=utf-8", contentType)
+			}
+			if disposition := recorder.Header().Get("Content-Disposition"); disposition != "attachment; filename="+test.filename {
+				t.Errorf("Content-Disposition = %q, want an attachment named %s", disposition, test.filename)
+			}
+
+			rows, err := csv.NewReader(recorder.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) < 2 {
+				t.Fatalf("got %d rows, want a header and the series", len(rows))
+			}
+			if !reflect.DeepEqual(rows[0], test.header) {
+				t.Errorf("header = %v, want %v", rows[0], test.header)
+			}
+			for _, row := range rows[1:] {
+				if len(row) != len(test.header) {
+					t.Fatalf("row %v has %d cells, want %d", row, len(row), len(test.header))
+				}
+				// GDAX provides neither VWAP, quotes nor trade counts
+				if len(row) > 2 && strings.Join(row[6:], "") != "" {
+					t.Errorf("row %v has values for fields gdax does not provide, want empty cells", row)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVErrorsAreJSON(t *testing.T) {
+	useMockExchange(t)
+	appContext := &AppContext{}
+	router := mux.NewRouter()
+	router.HandleFunc("/candles/{exchange}/{interval}", appContext.Candles)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{name: "unknown exchange", path: "/candles/nowhere/day?format=csv", status: http.StatusNotFound, code: errors.NOTFOUND},
+		{name: "unknown interval", path: "/candles/gdax/fortnight?format=csv", status: http.StatusBadRequest, code: errors.INVALIDINTERVAL},
+		{name: "invalid start", path: "/candles/gdax/day?format=csv&start=yesterday", status: http.StatusBadRequest, code: errors.INVALIDREQUEST},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: GET %s answered %d, want %d", test.name, test.path, recorder.Code, test.status)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+			t.Errorf("%s: Content-Type = %q, want JSON", test.name, contentType)
+		}
+		if disposition := recorder.Header().Get("Content-Disposition"); disposition != "" {
+			t.Errorf("%s: an error is offered as the attachment %q", test.name, disposition)
+		}
+
+		var response errors.ErrorResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if response.Error.Code != test.code || response.Error.Status != test.status {
+			t.Errorf("%s: error %s %d, want %s %d", test.name, response.Error.Code, response.Error.Status, test.code, test.status)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"github.com/adamhei/historicalapi/datamodels"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Response formats besides the default JSON
+const (
+	CSVFORMAT    = "csv"
+	NDJSONFORMAT = "ndjson"
+)
+
+// The media types of the response formats, as accepted in an Accept header
+var formatMediaTypes = map[string]string{
+	"text/csv":             CSVFORMAT,
+	"application/x-ndjson": NDJSONFORMAT,
+	"application/ndjson":   NDJSONFORMAT,
+}
+
+// A series response which can be written row by row, as CSV or as NDJSON
+type seriesTable interface {
+	// The CSV header row
+	header() []string
+	len() int
+	// The CSV row of an element
+	row(index int) []string
+	// The element to write as an NDJSON line
+	value(index int) interface{}
+}
+
+// requestedFormat returns the format the client asked for, either with ?format=csv|ndjson or with an Accept header,
+// and the empty string for JSON
+//
+// The format query parameter wins over the Accept header, so that links pasted into a spreadsheet work
+func requestedFormat(request *http.Request) string {
+	if format := request.URL.Query().Get(FORMAT); format != datamodels.EMPTYSTRING {
+		format = strings.ToLower(format)
+		if format == CSVFORMAT || format == NDJSONFORMAT {
+			return format
+		}
+		return datamodels.EMPTYSTRING
+	}
+
+	for _, accepted := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if format, ok := formatMediaTypes[mediaType]; err == nil && ok {
+			return format
+		}
+	}
+	return datamodels.EMPTYSTRING
+}
+
+// respondAs writes table as CSV or NDJSON if the client asked for either, and data as JSON otherwise
+func respondAs(writer http.ResponseWriter, request *http.Request, filename string, data interface{}, table seriesTable) {
+	switch requestedFormat(request) {
+	case CSVFORMAT:
+		respondCSV(writer, filename, table)
+	case NDJSONFORMAT:
+		stream := newNDJSONStream(writer)
+		stream.finish(stream.writeTable(table))
+	default:
+		respond(writer, data, nil)
+	}
+}
@@ -2,10 +2,34 @@ package handlers
 
 import (
 	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicaldata/trademodels"
 	"net/http"
 )
 
+// GeminiHistorical serves the Gemini trades of the past two years, streaming them from the database given
+// ?format=ndjson
 func (appContext *AppContext) GeminiHistorical(w http.ResponseWriter, r *http.Request) {
-	results, err := datamodels.QueryGeminiHistorical(appContext.Db, datamodels.TWOYEAR)
-	respond(w, results, err)
+	db, myErr := appContext.database()
+	if myErr != nil {
+		respond(w, nil, myErr)
+		return
+	}
+
+	if requestedFormat(r) == NDJSONFORMAT {
+		stream := newNDJSONStream(w)
+		stream.finish(datamodels.StreamGeminiHistorical(db, datamodels.NewHistoricalQuery(datamodels.TWOYEAR), func(order trademodels.GeminiOrder) error {
+			if myErr := stream.write(order); myErr != nil {
+				return myErr
+			}
+			return nil
+		}))
+		return
+	}
+
+	results, err := datamodels.QueryGeminiHistorical(db, datamodels.NewHistoricalQuery(datamodels.TWOYEAR))
+	if err != nil {
+		respond(w, nil, err)
+	} else {
+		respondAs(w, r, "gemini", results, geminiTable(results))
+	}
 }
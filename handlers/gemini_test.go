@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/adamhei/historicalapi/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGeminiHistoricalWithoutMongo(t *testing.T) {
+	appContext := new(AppContext)
+
+	for _, target := range []string{"/historical/gemini", "/historical/gemini?format=ndjson", "/historical/gemini?format=csv"} {
+		recorder := httptest.NewRecorder()
+		appContext.GeminiHistorical(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+
+		response := new(errors.ErrorResponse)
+		err := json.NewDecoder(recorder.Body).Decode(response)
+		if err != nil {
+			t.Fatalf("%s answered a body which is not an error: %s", target, err)
+		}
+		if recorder.Code != http.StatusServiceUnavailable || response.Error.Code != errors.DBUNAVAILABLE {
+			t.Errorf("%s answered %d %s, want 503 %s", target, recorder.Code, response.Error.Code, errors.DBUNAVAILABLE)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"github.com/adamhei/historicalapi/datamodels"
+	"net/http"
+	"time"
+)
+
+// Dependency states reported by Readyz
+const (
+	DEPENDENCYUP       = "up"
+	DEPENDENCYDOWN     = "down"
+	DEPENDENCYDISABLED = "disabled"
+)
+
+// The longest Readyz waits for MongoDB to answer a ping
+const mongoPingTimeout = 2 * time.Second
+
+// Health is the answer of Healthz
+type Health struct {
+	Status string `json:"status"`
+}
+
+// Readiness is the answer of Readyz
+type Readiness struct {
+	// Whether the service can serve requests, i.e. every dependency its routes need is up
+	Ready bool            `json:"ready"`
+	Mongo DependencyState `json:"mongo"`
+	// The latest probe of every exchange, if probing is enabled; a failing exchange does not make the service unready
+	Exchanges []datamodels.ProbeResult `json:"exchanges,omitempty"`
+}
+
+// DependencyState reports whether a dependency answered its last check, and how fast
+type DependencyState struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Healthz answers as long as the process is up
+func (appContext *AppContext) Healthz(responseWriter http.ResponseWriter, request *http.Request) {
+	respond(responseWriter, Health{Status: "ok"}, nil)
+}
+
+// Readyz reports the MongoDB session and the latest probe of every exchange, answering 503 Service Unavailable when
+// MongoDB is down and a mounted route reads it, so that load balancers stop routing to this instance
+func (appContext *AppContext) Readyz(responseWriter http.ResponseWriter, request *http.Request) {
+	readiness := Readiness{Mongo: appContext.pingMongo()}
+	readiness.Ready = !appContext.MongoRequired || readiness.Mongo.Status != DEPENDENCYDOWN
+	if appContext.Prober != nil {
+		readiness.Exchanges = appContext.Prober.Results()
+	}
+
+	if !readiness.Ready {
+		responseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+		responseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+	respond(responseWriter, readiness, nil)
+}
+
+// Ping MongoDB on a copy of the session, so that a slow server cannot hold up the session of the handlers
+func (appContext *AppContext) pingMongo() DependencyState {
+	if appContext.Db == nil {
+		return DependencyState{Status: DEPENDENCYDISABLED}
+	}
+
+	session := appContext.Db.Session.Copy()
+	defer session.Close()
+	session.SetSyncTimeout(mongoPingTimeout)
+	session.SetSocketTimeout(mongoPingTimeout)
+
+	started := time.Now()
+	err := session.Ping()
+	state := DependencyState{Status: DEPENDENCYUP, LatencyMs: time.Since(started).Milliseconds()}
+	if err != nil {
+		state.Status = DEPENDENCYDOWN
+		state.Error = err.Error()
+	}
+	return state
+}
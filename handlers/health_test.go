@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzWithoutMongo(t *testing.T) {
+	for _, required := range []bool{false, true} {
+		appContext := &AppContext{MongoRequired: required}
+		recorder := httptest.NewRecorder()
+		appContext.Readyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		readiness := new(Readiness)
+		err := json.NewDecoder(recorder.Body).Decode(readiness)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Routes reading MongoDB answer 503 on their own while it is disabled, so the service still serves the others
+		if recorder.Code != http.StatusOK || !readiness.Ready || readiness.Mongo.Status != DEPENDENCYDISABLED {
+			t.Errorf("with MongoDB required %t but disabled, /readyz answered %d %+v", required, recorder.Code, readiness)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Describes a registered exchange and the pairs and intervals it accepts
+type exchangeListing struct {
+	Name      string   `json:"name"`
+	Pairs     []string `json:"pairs"`
+	Intervals []string `json:"intervals"`
+}
+
+// Exchanges lists every registered exchange along with its supported pairs and intervals
+func (appContext *AppContext) Exchanges(responseWriter http.ResponseWriter, request *http.Request) {
+	listings := make([]exchangeListing, 0)
+	for _, source := range datamodels.Sources() {
+		listings = append(listings, exchangeListing{Name: source.Name(), Pairs: source.Pairs(), Intervals: source.Intervals()})
+	}
+
+	respond(responseWriter, listings, nil)
+}
+
+// Historical serves the PricePoints of any registered exchange for the requested pair (BTC-USD if absent) and interval
+//
+// The optional start and end query parameters (RFC3339 or unix seconds) select a window other than the interval
+// looking back from now, and the optional bucket query parameter (e.g. 6h or 1d) resamples the series before it is
+// reduced to PricePoints
+//
+// Like every historical route, it answers with CSV instead of JSON given ?format=csv or Accept: text/csv, and streams
+// NDJSON given ?format=ndjson or Accept: application/x-ndjson
+func (appContext *AppContext) Historical(responseWriter http.ResponseWriter, request *http.Request) {
+	if requestedFormat(request) == NDJSONFORMAT {
+		appContext.streamCandles(responseWriter, request, func(source datamodels.HistoricalSource, candles []datamodels.Candle) seriesTable {
+			return pricePointTable(returnedPricePoints(source, candles))
+		})
+		return
+	}
+
+	source, candles, myErr := appContext.fetchCandles(responseWriter, request)
+
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+	} else {
+		pricePoints := returnedPricePoints(source, candles)
+		respondAs(responseWriter, request, seriesFilename(request, datamodels.EMPTYSTRING), pricePoints, pricePointTable(pricePoints))
+	}
+}
+
+// Candles serves the full open-high-low-close-volume data of any registered exchange for the requested interval
+// Fields the exchange does not provide are null
+//
+// Accepts the same start, end, bucket and format query parameters as Historical
+func (appContext *AppContext) Candles(responseWriter http.ResponseWriter, request *http.Request) {
+	if requestedFormat(request) == NDJSONFORMAT {
+		appContext.streamCandles(responseWriter, request, func(source datamodels.HistoricalSource, candles []datamodels.Candle) seriesTable {
+			return candleTable(candles)
+		})
+		return
+	}
+
+	_, candles, myErr := appContext.fetchCandles(responseWriter, request)
+
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+	} else {
+		respondAs(responseWriter, request, seriesFilename(request, datamodels.EMPTYSTRING, "candles"), candles, candleTable(candles))
+	}
+}
+
+// Parse the arguments shared by the historical routes and fetch the matching candles
+func (appContext *AppContext) fetchCandles(responseWriter http.ResponseWriter, request *http.Request) (datamodels.HistoricalSource, []datamodels.Candle, *errors.MyError) {
+	source, query, bucketSize, myErr := appContext.parseCandleRequest(responseWriter, request)
+	if myErr != nil {
+		return nil, nil, myErr
+	}
+
+	candles, myErr := source.FetchCandles(queryContext(request, query), query)
+	if myErr != nil {
+		return nil, nil, myErr.From(source.Name())
+	}
+
+	if bucketSize != 0 {
+		candles = datamodels.ResampleCandles(candles, bucketSize)
+	}
+	return source, candles, nil
+}
+
+// Stream the candles of a request as NDJSON, writing every batch as the rows of toTable as soon as the source yields it
+//
+// Resampled series are only written once complete, since a bucket may straddle two batches
+func (appContext *AppContext) streamCandles(responseWriter http.ResponseWriter, request *http.Request, toTable func(source datamodels.HistoricalSource, candles []datamodels.Candle) seriesTable) {
+	source, query, bucketSize, myErr := appContext.parseCandleRequest(responseWriter, request)
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+
+	stream := newNDJSONStream(responseWriter)
+
+	if bucketSize != 0 {
+		candles, myErr := source.FetchCandles(queryContext(request, query), query)
+		if myErr == nil {
+			myErr = stream.writeTable(toTable(source, datamodels.ResampleCandles(candles, bucketSize)))
+		}
+		stream.finish(myErr.From(source.Name()))
+		return
+	}
+
+	stream.finish(datamodels.StreamCandles(queryContext(request, query), source, query, func(candles []datamodels.Candle) error {
+		if myErr := stream.writeTable(toTable(source, candles)); myErr != nil {
+			return myErr
+		}
+		return nil
+	}).From(source.Name()))
+}
+
+// Parse the exchange, pair, interval, window and bucket arguments shared by the historical routes
+func (appContext *AppContext) parseCandleRequest(responseWriter http.ResponseWriter, request *http.Request) (datamodels.HistoricalSource, datamodels.HistoricalQuery, time.Duration, *errors.MyError) {
+	args := mux.Vars(request)
+
+	source, myErr := appContext.lookupSource(args[EXCHANGE], responseWriter)
+	if myErr != nil {
+		return nil, datamodels.HistoricalQuery{}, 0, myErr
+	}
+
+	bucketSize, myErr := parseBucket(request)
+	if myErr != nil {
+		return nil, datamodels.HistoricalQuery{}, 0, myErr
+	}
+
+	query, myErr := parseQuery(request)
+	if myErr != nil {
+		return nil, datamodels.HistoricalQuery{}, 0, myErr
+	}
+
+	myErr = datamodels.CheckWindow(source, query)
+	if myErr != nil {
+		return nil, datamodels.HistoricalQuery{}, 0, myErr
+	}
+
+	return source, query, bucketSize, nil
+}
+
+// Parse the optional bucket query parameter, returning 0 when absent
+func parseBucket(request *http.Request) (time.Duration, *errors.MyError) {
+	bucket := request.URL.Query().Get(BUCKET)
+	if bucket == datamodels.EMPTYSTRING {
+		return 0, nil
+	}
+
+	bucketSize, err := datamodels.ParseBucketSize(bucket)
+	if err != nil {
+		return 0, &errors.MyError{Err: err.Error(), ErrorCode: http.StatusBadRequest}
+	}
+	return bucketSize, nil
+}
+
+// Build the query from the pair and interval path arguments and the optional start and end query parameters
+func parseQuery(request *http.Request) (datamodels.HistoricalQuery, *errors.MyError) {
+	pathArgs := mux.Vars(request)
+	args := request.URL.Query()
+
+	start, myErr := parseTime(args.Get(START))
+	if myErr != nil {
+		return datamodels.HistoricalQuery{}, myErr
+	}
+
+	end, myErr := parseTime(args.Get(END))
+	if myErr != nil {
+		return datamodels.HistoricalQuery{}, myErr
+	}
+
+	return datamodels.NewRangeQuery(pathArgs[PAIR], pathArgs[INTERVAL], start, end)
+}
+
+// Parse a time given either as RFC3339 or as unix seconds, returning the zero time when absent
+func parseTime(arg string) (time.Time, *errors.MyError) {
+	if arg == datamodels.EMPTYSTRING {
+		return time.Time{}, nil
+	}
+
+	if seconds, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		return time.Time{}, &errors.MyError{Err: fmt.Sprintf("Please provide a valid time; %s is neither RFC3339 nor unix seconds", arg), ErrorCode: http.StatusBadRequest}
+	}
+	return parsed, nil
+}
+
+// Find the registered source for the exchange path argument, backed by the candle store and cache if there are any
+//
+// Cached sources report the status of each of their lookups in the X-Cache header of the response
+func (appContext *AppContext) lookupSource(exchange string, responseWriter http.ResponseWriter) (datamodels.HistoricalSource, *errors.MyError) {
+	return appContext.lookupReportingSource(exchange, func(status datamodels.CacheStatus) {
+		responseWriter.Header().Add(CACHEHEADER, string(status))
+	})
+}
+
+// Like lookupSource, but call report with the status of each cache lookup
+func (appContext *AppContext) lookupReportingSource(exchange string, report func(status datamodels.CacheStatus)) (datamodels.HistoricalSource, *errors.MyError) {
+	source, ok := datamodels.GetSource(exchange)
+	if !ok {
+		return nil, &errors.MyError{Err: fmt.Sprintf("Unknown exchange %s", exchange), ErrorCode: http.StatusNotFound}
+	}
+
+	if appContext.Store != nil {
+		source = datamodels.NewStoredSource(source, appContext.Store)
+	}
+	if appContext.Cache != nil {
+		source = datamodels.NewCachedSource(source, appContext.Cache, report)
+	}
+	return source, nil
+}
+
+// The cache statuses of sources which are fetched concurrently, by source
+//
+// Headers cannot be written concurrently, so the statuses are only written to X-Cache once every source is done, in
+// the order of the sources
+type cacheStatuses [][]datamodels.CacheStatus
+
+// The report function of the source at an index
+func (statuses cacheStatuses) reporter(index int) func(status datamodels.CacheStatus) {
+	return func(status datamodels.CacheStatus) {
+		statuses[index] = append(statuses[index], status)
+	}
+}
+
+func (statuses cacheStatuses) write(responseWriter http.ResponseWriter) {
+	for _, sourceStatuses := range statuses {
+		for _, status := range sourceStatuses {
+			responseWriter.Header().Add(CACHEHEADER, string(status))
+		}
+	}
+}
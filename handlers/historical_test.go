@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCandlesReportCacheStatus(t *testing.T) {
+	useMockExchange(t)
+	appContext := &AppContext{Cache: datamodels.NewCandleCache()}
+	router := mux.NewRouter()
+	router.HandleFunc("/candles/{exchange}/{interval}", appContext.Candles)
+
+	tests := []struct {
+		name   string
+		path   string
+		status string
+	}{
+		{name: "first lookup", path: "/candles/gdax/day", status: string(datamodels.CacheMiss)},
+		{name: "same series", path: "/candles/gdax/day", status: string(datamodels.CacheHit)},
+		{name: "other interval", path: "/candles/gdax/week", status: string(datamodels.CacheMiss)},
+		{name: "other exchange", path: "/candles/binance/day", status: string(datamodels.CacheMiss)},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: GET %s answered %d: %s", test.name, test.path, recorder.Code, recorder.Body)
+		}
+		if status := recorder.Header().Values(CACHEHEADER); len(status) != 1 || status[0] != test.status {
+			t.Errorf("%s: GET %s has %s %v, want [%s]", test.name, test.path, CACHEHEADER, status, test.status)
+		}
+	}
+}
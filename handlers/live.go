@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Ping live subscribers this often, so that dead connections are noticed and proxies keep idle ones open
+const livePingPeriod = 30 * time.Second
+
+// A subscriber which has not answered a ping within this time is disconnected
+const livePongWait = 2 * livePingPeriod
+
+// How long a subscriber told to go away may take to answer the close frame before its connection is closed anyway
+const liveCloseWait = time.Second
+
+// The prices are public, so browsers on any origin may subscribe
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(request *http.Request) bool {
+		return true
+	},
+}
+
+// LiveExchange pushes every change of the latest price of an exchange over a WebSocket, for the pair query parameter
+// (BTC-USD if absent)
+//
+// A pair the exchange does not trade is answered with 400 Bad Request rather than a WebSocket which never speaks
+func (appContext *AppContext) LiveExchange(responseWriter http.ResponseWriter, request *http.Request) {
+	exchange := mux.Vars(request)[EXCHANGE]
+
+	source, ok := datamodels.GetSource(exchange)
+	if !ok {
+		respond(responseWriter, nil, &errors.MyError{Err: fmt.Sprintf("Unknown exchange %s", exchange), ErrorCode: http.StatusNotFound, Code: errors.NOTFOUND})
+		return
+	}
+
+	if pair := livePair(request); !trades(source, pair) {
+		respond(responseWriter, nil, &errors.MyError{
+			Err:       fmt.Sprintf("Please provide a valid pair; %s does not trade %s", source.Name(), pair),
+			ErrorCode: http.StatusBadRequest,
+			Code:      errors.INVALIDREQUEST,
+			Source:    source.Name(),
+		})
+		return
+	}
+
+	appContext.live(responseWriter, request, func(update datamodels.LiveUpdate) bool {
+		return update.Price != nil && update.Price.Exchange == source.Name()
+	})
+}
+
+// Live pushes the latest price of every exchange trading the pair query parameter (BTC-USD if absent) over a single
+// WebSocket, along with the current spread between the most and least expensive of them
+func (appContext *AppContext) Live(responseWriter http.ResponseWriter, request *http.Request) {
+	appContext.live(responseWriter, request, func(update datamodels.LiveUpdate) bool {
+		return true
+	})
+}
+
+// Subscribe to the live updates of the requested pair and write those selected by the filter to a WebSocket until
+// either side goes away
+func (appContext *AppContext) live(responseWriter http.ResponseWriter, request *http.Request, filter func(update datamodels.LiveUpdate) bool) {
+	if appContext.LiveHub == nil {
+		respond(responseWriter, nil, &errors.MyError{Err: "Live prices are disabled", ErrorCode: http.StatusNotFound, Code: errors.NOTFOUND})
+		return
+	}
+
+	pair := livePair(request)
+
+	updates, unsubscribe, myErr := appContext.LiveHub.Subscribe(pair)
+	if myErr != nil {
+		respond(responseWriter, nil, myErr)
+		return
+	}
+	defer unsubscribe()
+
+	conn, err := upgrader.Upgrade(responseWriter, request, nil)
+	if err != nil {
+		// The upgrader has answered the client already
+		logging.FromContext(request.Context()).Info("Could not upgrade to a WebSocket", logging.ERROR, err)
+		return
+	}
+	defer conn.Close()
+
+	closed := readUntilClosed(conn)
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+
+	logger := logging.FromContext(request.Context()).With(logging.PAIR, pair, "remoteAddr", request.RemoteAddr)
+	logger.Info("Streaming live prices")
+
+	for {
+		select {
+		case update := <-updates:
+			if !filter(update) {
+				continue
+			}
+			err = conn.WriteJSON(update)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(livePingPeriod))
+		case <-closed:
+			return
+		case <-appContext.LiveHub.Closing():
+			goAway(conn, closed)
+			return
+		case <-request.Context().Done():
+			// The service is shutting down
+			goAway(conn, closed)
+			return
+		}
+
+		if err != nil {
+			logger.Info("Stopped streaming live prices", logging.ERROR, err)
+			return
+		}
+	}
+}
+
+// Tell a subscriber the service is shutting down and give it a moment to answer, so that it sees a clean close
+func goAway(conn *websocket.Conn, closed <-chan struct{}) {
+	deadline := time.Now().Add(liveCloseWait)
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), deadline)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(liveCloseWait):
+	}
+}
+
+// Subscribers never send anything, but reading is how close frames and pongs are handled
+// The returned channel is closed once the connection is
+func readUntilClosed(conn *websocket.Conn) <-chan struct{} {
+	closed := make(chan struct{})
+
+	conn.SetReadDeadline(time.Now().Add(livePongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// The pair query parameter of a live request in upper case, BTC-USD if absent
+func livePair(request *http.Request) string {
+	pair := request.URL.Query().Get(PAIR)
+	if pair == datamodels.EMPTYSTRING {
+		return datamodels.DefaultPair
+	}
+	return strings.ToUpper(pair)
+}
+
+// Whether a source trades a canonical pair
+func trades(source datamodels.HistoricalSource, pair string) bool {
+	for _, traded := range source.Pairs() {
+		if traded == pair {
+			return true
+		}
+	}
+	return false
+}
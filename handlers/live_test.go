@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/mockexchange"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Point every registered source at a mock exchange for the duration of a test
+func useMockExchange(t *testing.T) {
+	server := mockexchange.NewServer()
+	t.Cleanup(server.Close)
+
+	for _, status := range datamodels.UpstreamStatuses() {
+		status := status
+		datamodels.SetBaseURL(status.Exchange, server.URL)
+		t.Cleanup(func() {
+			datamodels.SetBaseURL(status.Exchange, status.BaseURL)
+		})
+	}
+}
+
+func TestLiveHubCloseSaysGoodbye(t *testing.T) {
+	useMockExchange(t)
+	hub := datamodels.NewLiveHub(time.Hour)
+	appContext := &AppContext{LiveHub: hub}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/live", appContext.Live)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conns := make([]*websocket.Conn, 3)
+	for index := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/live", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[index] = conn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- hub.Close(ctx)
+	}()
+
+	// Every subscriber is told the service is going away, and answering lets Close return
+	for index, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("subscriber %d was disconnected with %v, want a going away close frame", index, err)
+		}
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close() = %s, want every subscriber gone", err)
+	}
+
+	// Nobody subscribes to a closed hub
+	_, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/live", nil)
+	if err == nil || response == nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("a closed hub accepted a subscriber: %v", err)
+	}
+}
+
+func TestLiveExchangeRejectsBeforeUpgrading(t *testing.T) {
+	useMockExchange(t)
+	hub := datamodels.NewLiveHub(time.Hour)
+	defer hub.Close(context.Background())
+	appContext := &AppContext{LiveHub: hub}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/live/{exchange}", appContext.LiveExchange)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{name: "unknown exchange", path: "/live/nowhere", status: http.StatusNotFound, code: errors.NOTFOUND},
+		{name: "pair the exchange does not trade", path: "/live/bitstamp?pair=eth-usd", status: http.StatusBadRequest, code: errors.INVALIDREQUEST},
+		{name: "pair no exchange trades", path: "/live/gdax?pair=DOGE-USD", status: http.StatusBadRequest, code: errors.INVALIDREQUEST},
+	}
+
+	for _, test := range tests {
+		conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+test.path, nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: %s was upgraded to a WebSocket", test.name, test.path)
+			continue
+		}
+		if response == nil || response.StatusCode != test.status {
+			t.Errorf("%s: %s was refused with %v, want %d", test.name, test.path, err, test.status)
+			continue
+		}
+
+		var body errors.ErrorResponse
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if body.Error.Code != test.code {
+			t.Errorf("%s: error code %s, want %s", test.name, body.Error.Code, test.code)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/errors"
+	"github.com/adamhei/historicalapi/logging"
+	"github.com/adamhei/historicalapi/metrics"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Routes polled by load balancers and Prometheus, whose successful requests are only logged at debug level
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// A ResponseWriter remembering the status and error of its response, so that the request is logged once served
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	myErr  *errors.MyError
+}
+
+func (writer *loggingWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *loggingWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+// Streamed responses flush as they go
+func (writer *loggingWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// The live routes take over the connection to upgrade it to a WebSocket
+func (writer *loggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer cannot be hijacked")
+	}
+	writer.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// LogRequests gives every request a logger tagged with its request ID, which follows it into every upstream call it
+// triggers, and logs a line once the request is served with its status, latency and error if any. The request is also
+// counted in the metrics of its route
+//
+// It must run after WithRequestID
+func (appContext *AppContext) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		logger := appContext.logger().With(logging.REQUESTID, RequestID(request.Context()))
+		writer := &loggingWriter{ResponseWriter: responseWriter}
+
+		started := time.Now()
+		next.ServeHTTP(writer, request.WithContext(logging.WithLogger(request.Context(), logger)))
+
+		latency := time.Since(started)
+		status := writer.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		template := datamodels.EMPTYSTRING
+		if route := mux.CurrentRoute(request); route != nil {
+			template, _ = route.GetPathTemplate()
+			metrics.ObserveRequest(template, request.Method, status, latency)
+		}
+		fields := []any{logging.METHOD, request.Method, logging.PATH, request.URL.Path, logging.STATUS, status, logging.LATENCY, latency}
+		for _, name := range []string{EXCHANGE, EXCHANGEA, EXCHANGEB, PAIR, INTERVAL} {
+			if value, ok := mux.Vars(request)[name]; ok {
+				fields = append(fields, name, value)
+			}
+		}
+
+		level := slog.LevelInfo
+		if quietRoutes[template] && status < http.StatusBadRequest {
+			level = slog.LevelDebug
+		}
+		if writer.myErr != nil {
+			fields = append(fields, logging.CODE, writer.myErr.Kind(), logging.ERROR, writer.myErr.Err)
+			if writer.myErr.Source != datamodels.EMPTYSTRING {
+				fields = append(fields, "source", writer.myErr.Source)
+			}
+			level = errorLevel(writer.myErr)
+		}
+		logger.Log(request.Context(), level, "Served request", fields...)
+	})
+}
+
+// The logger of the service, or the default logger if none was injected
+func (appContext *AppContext) logger() *slog.Logger {
+	if appContext.Logger != nil {
+		return appContext.Logger
+	}
+	return slog.Default()
+}
+
+// Attach the error of a response to the line LogRequests logs for it, or log it right away outside of LogRequests
+func logError(writer http.ResponseWriter, myErr *errors.MyError) {
+	if logged, ok := writer.(*loggingWriter); ok {
+		logged.myErr = myErr
+		return
+	}
+
+	slog.Log(context.Background(), errorLevel(myErr), "Request failed", logging.REQUESTID, writer.Header().Get(REQUESTIDHEADER),
+		logging.CODE, myErr.Kind(), logging.ERROR, myErr.Err)
+}
+
+// Failures of the service itself are errors, failures of the exchanges warnings, clients going away debug noise, and
+// everything else, such as invalid requests, is business as usual
+func errorLevel(myErr *errors.MyError) slog.Level {
+	switch myErr.Kind() {
+	case errors.CANCELED:
+		return slog.LevelDebug
+	case errors.INTERNALERROR, errors.DBERROR:
+		return slog.LevelError
+	case errors.UPSTREAMUNAVAILABLE, errors.UPSTREAMTIMEOUT, errors.UPSTREAMRATELIMITED, errors.UPSTREAMERROR, errors.PARSEFAILURE:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// The context of a request whose upstream calls are logged along with the pair and interval of its query
+func queryContext(request *http.Request, query datamodels.HistoricalQuery) context.Context {
+	return logging.With(request.Context(), logging.PAIR, query.Pair, logging.INTERVAL, query.Interval)
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/metrics"
+	"net/http"
+)
+
+// Metrics serves the request, upstream, cache and parse failure metrics of the service to Prometheus
+func (appContext *AppContext) Metrics(responseWriter http.ResponseWriter, request *http.Request) {
+	metrics.Handler().ServeHTTP(responseWriter, request)
+}
+
+// Reduce Candles to the PricePoints returned to a client, counting them in the metrics of their exchange
+func returnedPricePoints(source datamodels.HistoricalSource, candles []datamodels.Candle) []datamodels.PricePoint {
+	pricePoints := datamodels.ToPricePoints(source, candles)
+	metrics.PricePointsReturned(source.Name(), len(pricePoints))
+	return pricePoints
+}
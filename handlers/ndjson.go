@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"net/http"
+	"syscall"
+)
+
+// Answered to a request whose client went away, as by the datamodels package
+const statusClientClosedRequest = 499
+
+// Flush an NDJSON stream written value by value after this many lines, so that clients see the first values of a
+// long series early
+const ndjsonFlushLines = 500
+
+// ndjsonStream writes newline delimited JSON, one value per line, as the values are produced
+type ndjsonStream struct {
+	writer  http.ResponseWriter
+	encoder *json.Encoder
+	lines   int
+}
+
+func newNDJSONStream(writer http.ResponseWriter) *ndjsonStream {
+	writer.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	return &ndjsonStream{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+// Write a single value as a line
+func (stream *ndjsonStream) write(value interface{}) *errors.MyError {
+	myErr := stream.encode(value)
+	if myErr != nil {
+		return myErr
+	}
+
+	if stream.lines%ndjsonFlushLines == 0 {
+		stream.flush()
+	}
+	return nil
+}
+
+// Write every element of a table as a line, then flush them, so that each batch a source yields reaches the client as
+// soon as it is written
+func (stream *ndjsonStream) writeTable(table seriesTable) *errors.MyError {
+	for index := 0; index < table.len(); index++ {
+		myErr := stream.encode(table.value(index))
+		if myErr != nil {
+			return myErr
+		}
+	}
+
+	stream.flush()
+	return nil
+}
+
+func (stream *ndjsonStream) encode(value interface{}) *errors.MyError {
+	err := stream.encoder.Encode(value)
+	if err != nil {
+		return writeError(err)
+	}
+
+	stream.lines++
+	return nil
+}
+
+// End the stream, reporting the error which ended it if any
+//
+// An error before the first line is an ordinary error response; after it, the status has been sent already, so the
+// error is written as a last {"error": {...}} line instead, like the body of an error response
+func (stream *ndjsonStream) finish(myErr *errors.MyError) {
+	if myErr != nil && stream.lines == 0 {
+		respond(stream.writer, nil, myErr)
+		return
+	}
+
+	if myErr != nil {
+		logError(stream.writer, myErr)
+		stream.encoder.Encode(myErr.Response(stream.writer.Header().Get(REQUESTIDHEADER)))
+	}
+	stream.flush()
+}
+
+// The error of a line which could not be written, which is the client going away unless the value itself could not
+// be encoded
+func writeError(err error) *errors.MyError {
+	if clientGone(err) {
+		return &errors.MyError{Err: fmt.Sprintf("The client went away: %s", err), ErrorCode: statusClientClosedRequest, Code: errors.CANCELED}
+	}
+	return &errors.MyError{Err: fmt.Sprintf("Could not write NDJSON: %s", err), Code: errors.INTERNALERROR}
+}
+
+// Whether a write failed because the client canceled its request or closed its connection
+func clientGone(err error) bool {
+	return stderrors.Is(err, context.Canceled) || stderrors.Is(err, syscall.EPIPE) || stderrors.Is(err, syscall.ECONNRESET)
+}
+
+func (stream *ndjsonStream) flush() {
+	if flusher, ok := stream.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
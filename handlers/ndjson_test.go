@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamhei/historicalapi/errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A response writer whose client has gone away
+type goneWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (writer goneWriter) Write([]byte) (int, error) {
+	return 0, writer.err
+}
+
+func TestNDJSONWriteErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		value interface{}
+		code  string
+		level slog.Level
+	}{
+		{name: "broken pipe", err: &wrappedError{syscall.EPIPE}, value: 1, code: errors.CANCELED, level: slog.LevelDebug},
+		{name: "connection reset", err: syscall.ECONNRESET, value: 1, code: errors.CANCELED, level: slog.LevelDebug},
+		{name: "canceled request", err: context.Canceled, value: 1, code: errors.CANCELED, level: slog.LevelDebug},
+		{name: "unencodable value", value: math.NaN(), code: errors.INTERNALERROR, level: slog.LevelError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var writer http.ResponseWriter = httptest.NewRecorder()
+			if test.err != nil {
+				writer = goneWriter{ResponseRecorder: httptest.NewRecorder(), err: test.err}
+			}
+
+			myErr := newNDJSONStream(writer).write(test.value)
+			if myErr == nil || myErr.Kind() != test.code {
+				t.Fatalf("write() = %v, want %s", myErr, test.code)
+			}
+			if level := errorLevel(myErr); level != test.level {
+				t.Errorf("a %s error is logged at %s, want %s", myErr.Kind(), level, test.level)
+			}
+		})
+	}
+}
+
+// A response recorder which remembers how many lines it had received at each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (recorder *flushRecorder) Flush() {
+	recorder.flushedAt = append(recorder.flushedAt, strings.Count(recorder.Body.String(), "\n"))
+	recorder.ResponseRecorder.Flush()
+}
+
+func TestNDJSONFlushesEveryBatch(t *testing.T) {
+	recorder := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	stream := newNDJSONStream(recorder)
+
+	batches := []pricePointTable{
+		{{Timestamp: 3, Price: "3"}, {Timestamp: 2, Price: "2"}},
+		{{Timestamp: 1, Price: "1"}},
+		{},
+	}
+	for _, batch := range batches {
+		if myErr := stream.writeTable(batch); myErr != nil {
+			t.Fatal(myErr.Err)
+		}
+	}
+
+	if want := []int{2, 3, 3}; !reflect.DeepEqual(recorder.flushedAt, want) {
+		t.Errorf("flushed after lines %v, want %v", recorder.flushedAt, want)
+	}
+}
+
+// A write error as the net package reports it, wrapping the syscall error
+type wrappedError struct {
+	err error
+}
+
+func (wrapped *wrappedError) Error() string {
+	return fmt.Sprintf("write tcp: %s", wrapped.err)
+}
+
+func (wrapped *wrappedError) Unwrap() error {
+	return wrapped.err
+}
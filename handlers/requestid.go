@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// Identifies a request in both its response and the logs of the service
+const REQUESTIDHEADER = "X-Request-ID"
+
+// Request IDs sent by clients are only reused if they are reasonably short and safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// WithRequestID gives every request an ID, reusing the one sent by the client in the X-Request-ID header if any, and
+// echoes it in the X-Request-ID response header
+//
+// The ID is available to handlers through RequestID
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get(REQUESTIDHEADER)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+
+		responseWriter.Header().Set(REQUESTIDHEADER, requestID)
+		next.ServeHTTP(responseWriter, request.WithContext(context.WithValue(request.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// RequestID returns the ID of the request ctx belongs to, or an empty string outside of a request
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// A random 16 character hex ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
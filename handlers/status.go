@@ -0,0 +1,11 @@
+package handlers
+
+import (
+	"github.com/adamhei/historicalapi/datamodels"
+	"net/http"
+)
+
+// Status reports the circuit breaker of every exchange, i.e. whether its requests are currently failing fast
+func (appContext *AppContext) Status(responseWriter http.ResponseWriter, request *http.Request) {
+	respond(responseWriter, datamodels.UpstreamStatuses(), nil)
+}
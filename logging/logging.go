@@ -0,0 +1,61 @@
+// Package logging provides the structured logger of the service and carries it through request contexts, so that every
+// upstream call can be traced back to the client request which caused it
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Field names shared by every log line
+const (
+	REQUESTID = "requestId"
+	METHOD    = "method"
+	PATH      = "path"
+	EXCHANGE  = "exchange"
+	PAIR      = "pair"
+	INTERVAL  = "interval"
+	URL       = "url"
+	STATUS    = "status"
+	LATENCY   = "latency"
+	ATTEMPT   = "attempt"
+	CODE      = "code"
+	ERROR     = "error"
+)
+
+// Log formats
+const (
+	TEXT = "text"
+	JSON = "json"
+)
+
+type loggerKey struct{}
+
+// New returns a logger writing lines at level or above to writer, as JSON objects if format is JSON and as key=value
+// pairs otherwise
+func New(writer io.Writer, level slog.Level, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == JSON {
+		return slog.New(slog.NewJSONHandler(writer, options))
+	}
+	return slog.New(slog.NewTextHandler(writer, options))
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// With returns a copy of ctx whose logger adds the given fields to every line, e.g. the exchange of a request
+func With(ctx context.Context, fields ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(fields...))
+}
+
+// FromContext returns the logger of ctx, or the default logger outside of a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -1,32 +1,203 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"github.com/adamhei/historicalapi/config"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/fixtures"
 	"github.com/adamhei/historicalapi/handlers"
+	"github.com/adamhei/historicalapi/logging"
 	"github.com/adamhei/historicalapi/routes"
-	"github.com/adamhei/historicaldata/trademodels"
 	"gopkg.in/mgo.v2"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// How long requests may take to answer once their upstream fetches are canceled on shutdown
+const canceledRequestsTimeout = 5 * time.Second
+
 func main() {
-	mgoDialInfo := &mgo.DialInfo{
-		Addrs:    []string{trademodels.DbUrl},
-		Timeout:  1 * time.Hour,
-		Database: trademodels.AUTHDB,
-		Username: trademodels.USERNAME,
-		Password: trademodels.PASSWORD,
-	}
-	sesh, err := mgo.DialWithInfo(mgoDialInfo)
-	defer sesh.Close()
+	configPath := flag.String("config", os.Getenv(config.ENVPREFIX+"CONFIG"), "YAML file of settings, overridden by HISTORICALAPI_ environment variables and then by these flags")
+	storeDir := flag.String("store", "", "directory of the local candle store; historical data is fetched upstream on every request if empty")
+	upstreams := flag.String("upstream", "", "comma separated exchange=baseURL pairs pointing exchanges at stand-in servers, proxies or mirrors, e.g. kraken=http://localhost:8080")
+	recordDir := flag.String("record", "", "directory to record every upstream response into, to be replayed later with -replay")
+	replayDir := flag.String("replay", "", "directory of recorded upstream responses to answer every upstream request from instead of the network")
+	retries := flag.Int("retries", datamodels.DefaultRetryPolicy.Retries, "how many times a failed upstream request is retried, with a jittered exponential backoff")
+	upstreamTimeout := flag.Duration("upstream-timeout", 0, "how long a single upstream request, including reading its response, may take; 0 keeps the default of each exchange")
+	livePeriod := flag.Duration("live-period", 10*time.Second, "shortest time between two polls of an exchange for the live routes; 0 disables them")
+	probePeriod := flag.Duration("probe-period", time.Minute, "time between two probes of every exchange reported by /readyz; 0 disables them")
+	logLevel := flag.String("log-level", "info", "the least severe log lines written: debug, info, warn or error")
+	logFormat := flag.String("log-format", logging.TEXT, "log lines as key=value pairs (text) or JSON objects (json)")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("Please provide -log-level as debug, info, warn or error", logging.ERROR, err)
+	}
+	if *logFormat != logging.TEXT && *logFormat != logging.JSON {
+		fatal("Please provide -log-format as text or json", "format", *logFormat)
+	}
+	logger := logging.New(os.Stderr, level, *logFormat)
+	slog.SetDefault(logger)
+
+	settings, err := config.Load(*configPath)
 	if err != nil {
-		log.Println("Could not connect to DB")
-		panic(err)
+		fatal("Invalid configuration", logging.ERROR, err)
+	}
+	err = settings.Apply()
+	if err != nil {
+		fatal("Could not apply the configuration", logging.ERROR, err)
+	}
+
+	if *recordDir != "" && *replayDir != "" {
+		fatal("Please provide either -record or -replay, not both")
+	}
+	if *recordDir != "" {
+		recorder, err := fixtures.NewRecorder(*recordDir)
+		if err != nil {
+			fatal("Could not open the fixture directory", logging.ERROR, err)
+		}
+		datamodels.SetHTTPClient(&http.Client{Transport: recorder})
+	}
+	if *replayDir != "" {
+		datamodels.SetHTTPClient(&http.Client{Transport: fixtures.NewReplayer(*replayDir)})
 	}
 
-	db := sesh.DB(trademodels.DbName)
-	appContext := &handlers.AppContext{Db: db}
-	router := routes.NewRouter(appContext)
-	log.Fatal(http.ListenAndServe(":80", router))
+	retryPolicy := datamodels.DefaultRetryPolicy
+	retryPolicy.Retries = *retries
+	datamodels.SetRetryPolicy(retryPolicy)
+
+	if *upstreamTimeout > 0 {
+		for _, source := range datamodels.Sources() {
+			err := datamodels.SetTimeout(source.Name(), *upstreamTimeout)
+			if err != nil {
+				fatal("Could not set the upstream timeout", logging.ERROR, err)
+			}
+		}
+	}
+
+	for _, override := range strings.Split(*upstreams, ",") {
+		if override == "" {
+			continue
+		}
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			fatal("Please provide -upstream overrides as exchange=baseURL", "override", override)
+		}
+		err := datamodels.SetBaseURL(parts[0], parts[1])
+		if err != nil {
+			fatal("Could not override an upstream", logging.ERROR, err)
+		}
+	}
+
+	appContext := &handlers.AppContext{Db: dialMongo(settings.Mongo), Cache: datamodels.NewCandleCache(), Logger: logger}
+	if *livePeriod > 0 {
+		appContext.LiveHub = datamodels.NewLiveHub(*livePeriod)
+	}
+	// Canceled once the requests in flight had their grace period, abandoning their upstream fetches
+	serving, stopServing := context.WithCancel(context.Background())
+	if *probePeriod > 0 {
+		appContext.Prober = datamodels.NewProber(*probePeriod)
+		appContext.Prober.Start(serving)
+	}
+
+	if *storeDir != "" {
+		store, err := datamodels.NewFileStore(*storeDir)
+		if err != nil {
+			fatal("Could not open the candle store", logging.ERROR, err)
+		}
+		appContext.Store = store
+	}
+
+	server := settings.HTTPServer(routes.NewRouter(appContext), serving)
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			fatal("Stopped serving", logging.ERROR, err)
+		}
+	}()
+	slog.Info("Serving", "listen", settings.Listen)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	slog.Info("Shutting down", "signal", received.String(), "grace", settings.Server.ShutdownGrace)
+
+	liveClosed := closeLiveHub(appContext.LiveHub, settings.Server.ShutdownGrace)
+	shutdown(server, stopServing, settings.Server.ShutdownGrace)
+	<-liveClosed
+	if appContext.Db != nil {
+		appContext.Db.Session.Close()
+	}
+	slog.Info("Stopped serving")
+}
+
+// Stop accepting connections and wait up to grace for the requests in flight, then cancel their upstream fetches and
+// give them a moment to answer before closing their connections
+func shutdown(server *http.Server, stopServing context.CancelFunc, grace time.Duration) {
+	defer stopServing()
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if server.Shutdown(ctx) == nil {
+		return
+	}
+
+	slog.Warn("Canceling the requests still in flight after the grace period")
+	stopServing()
+
+	ctx, cancel = context.WithTimeout(context.Background(), canceledRequestsTimeout)
+	defer cancel()
+	if server.Shutdown(ctx) != nil {
+		server.Close()
+	}
+}
+
+// Tell the live subscribers to leave and wait up to grace for their WebSockets, which the server does not wait for since
+// they are hijacked; the returned channel is closed once they are gone
+func closeLiveHub(hub *datamodels.LiveHub, grace time.Duration) <-chan struct{} {
+	closed := make(chan struct{})
+	if hub == nil {
+		close(closed)
+		return closed
+	}
+
+	go func() {
+		defer close(closed)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		err := hub.Close(ctx)
+		if err != nil {
+			slog.Warn("Live subscribers were still connected after the grace period", logging.ERROR, err)
+		}
+	}()
+	return closed
+}
+
+// Dial MongoDB, which only the routes reading the database need, so that the service runs without it when it is not
+// configured or cannot be reached
+func dialMongo(settings config.Mongo) *mgo.Database {
+	if !settings.Enabled() {
+		slog.Info("Running without MongoDB since no address is configured")
+		return nil
+	}
+
+	sesh, err := mgo.DialWithInfo(settings.DialInfo())
+	if err != nil {
+		slog.Warn("Running without MongoDB since it cannot be reached", logging.ERROR, err)
+		return nil
+	}
+	return sesh.DB(settings.Database)
+}
+
+// Log why the service cannot go on and exit
+func fatal(message string, fields ...any) {
+	slog.Error(message, fields...)
+	os.Exit(1)
 }
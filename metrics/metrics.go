@@ -0,0 +1,121 @@
+// Package metrics exposes how the service and its upstreams behave to Prometheus, on the /metrics route
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Prefix of every metric of the service
+const namespace = "historicalapi"
+
+// Why an upstream request was never sent
+const (
+	RATELIMITED = "rate_limited"
+	BREAKEROPEN = "breaker_open"
+)
+
+// Upstream requests which never got a response are counted with one of these statuses instead of an HTTP status
+const (
+	NETWORKERROR = "network_error"
+	CANCELED     = "canceled"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests served, by route, method and status",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve a request, by route and method",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method"})
+
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_requests_total",
+		Help:      "Requests sent to the exchanges, retries included, by exchange and status",
+	}, []string{"exchange", "status"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time taken by an exchange to answer the headers of a request, by exchange",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"exchange"})
+
+	upstreamRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_rejections_total",
+		Help:      "Requests to the exchanges failed before they were sent, by exchange and reason",
+	}, []string{"exchange", "reason"})
+
+	parseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Exchange responses which could not be parsed, by exchange",
+	}, []string{"exchange"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Series looked up in the candle cache, by exchange and result (HIT or MISS)",
+	}, []string{"exchange", "result"})
+
+	pricePoints = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "price_points_total",
+		Help:      "PricePoints returned to clients, by exchange",
+	}, []string{"exchange"})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, upstreamRequests, upstreamDuration, upstreamRejections,
+		parseFailures, cacheLookups, pricePoints)
+}
+
+// Handler serves every metric in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest counts a served request and its duration
+func ObserveRequest(route string, method string, status int, duration time.Duration) {
+	requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// ObserveUpstream counts a request sent to an exchange, with its HTTP status or one of the statuses above
+//
+// Like every metric below, exchanges are labeled by the Name of their source, e.g. gdax or index
+func ObserveUpstream(exchange string, status string, duration time.Duration) {
+	upstreamRequests.WithLabelValues(exchange, status).Inc()
+	upstreamDuration.WithLabelValues(exchange).Observe(duration.Seconds())
+}
+
+// UpstreamRejected counts a request to an exchange which was never sent, for one of the reasons above
+func UpstreamRejected(exchange string, reason string) {
+	upstreamRejections.WithLabelValues(exchange, reason).Inc()
+}
+
+// ParseFailure counts a response of an exchange which could not be parsed
+func ParseFailure(exchange string) {
+	parseFailures.WithLabelValues(exchange).Inc()
+}
+
+// CacheLookup counts a series looked up in the candle cache
+func CacheLookup(exchange string, result string) {
+	cacheLookups.WithLabelValues(exchange, result).Inc()
+}
+
+// PricePointsReturned counts the PricePoints of an exchange returned to a client
+func PricePointsReturned(exchange string, count int) {
+	pricePoints.WithLabelValues(exchange).Add(float64(count))
+}
@@ -0,0 +1,104 @@
+package mockexchange
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Binance intervals and their length in seconds
+// Binance follows the calendar for 1M, which the mock simplifies to 30 day buckets
+var binanceIntervals = map[string]int64{
+	"1m":  60,
+	"3m":  180,
+	"5m":  300,
+	"15m": 900,
+	"30m": 1800,
+	"1h":  3600,
+	"2h":  7200,
+	"4h":  14400,
+	"6h":  21600,
+	"8h":  28800,
+	"12h": 43200,
+	"1d":  86400,
+	"3d":  259200,
+	"1w":  604800,
+	"1M":  2592000,
+}
+
+// Binance returns 500 buckets unless asked for up to this many
+const (
+	binanceDefaultLimit = 500
+	binanceMaxLimit     = 1000
+)
+
+type binanceError struct {
+	Code int64  `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// Serve /api/v1/klines?symbol=BTCUSDT&interval=1h&startTime=...&endTime=...&limit=1000 with millisecond times
+//
+// Like Binance, buckets come back oldest first, starting at startTime
+func (exchange *Exchange) binance(responseWriter http.ResponseWriter, request *http.Request) {
+	if status, failing := exchange.failure("binance"); failing {
+		writeJSON(responseWriter, status, binanceError{Code: -1001, Msg: "Internal error; unable to process your request. Please try again."})
+		return
+	}
+
+	args := request.URL.Query()
+
+	base, quote, ok := splitSymbol(args.Get("symbol"))
+	if !ok {
+		writeJSON(responseWriter, http.StatusBadRequest, binanceError{Code: -1121, Msg: "Invalid symbol."})
+		return
+	}
+
+	granularity, ok := binanceIntervals[args.Get("interval")]
+	if !ok {
+		writeJSON(responseWriter, http.StatusBadRequest, binanceError{Code: -1120, Msg: "Invalid interval."})
+		return
+	}
+
+	limit := int64(binanceDefaultLimit)
+	if args.Get("limit") != "" {
+		var err error
+		limit, err = strconv.ParseInt(args.Get("limit"), 10, 64)
+		if err != nil || limit < 1 || limit > binanceMaxLimit {
+			writeJSON(responseWriter, http.StatusBadRequest, binanceError{Code: -1100, Msg: "Illegal characters found in parameter 'limit'."})
+			return
+		}
+	}
+
+	now := exchange.now()
+	end := now.Unix()
+	if endTime, err := strconv.ParseInt(args.Get("endTime"), 10, 64); err == nil {
+		end = endTime / 1000
+	}
+	start := end - (limit-1)*granularity
+	if startTime, err := strconv.ParseInt(args.Get("startTime"), 10, 64); err == nil {
+		start = startTime / 1000
+	}
+
+	candles := series("binance", base, quote, start, end, granularity, now)
+	if int64(len(candles)) > limit {
+		candles = candles[:limit]
+	}
+
+	buckets := make([][]interface{}, len(candles))
+	for index, candle := range candles {
+		closeTime := time.Unix(candle.timestamp+granularity, 0).Add(-time.Millisecond)
+		buckets[index] = []interface{}{
+			candle.timestamp * 1000,
+			formatPrice(candle.open), formatPrice(candle.high), formatPrice(candle.low), formatPrice(candle.close),
+			formatPrice(candle.volume),
+			closeTime.UnixNano() / int64(time.Millisecond),
+			formatPrice(candle.volume * candle.vwap),
+			candle.trades,
+			formatPrice(candle.volume / 2), formatPrice(candle.volume * candle.vwap / 2),
+			"0",
+		}
+	}
+
+	writeJSON(responseWriter, http.StatusOK, buckets)
+}
@@ -0,0 +1,70 @@
+package mockexchange
+
+import (
+	"net/http"
+	"time"
+)
+
+// The date layout of CoinDesk and Quandl
+const dateLayout = "2006-01-02"
+
+const day = int64(24 * time.Hour / time.Second)
+
+// The currencies the CoinDesk index is quoted in
+var coinDeskCurrencies = map[string]bool{"USD": true, "EUR": true, "GBP": true}
+
+type coinDeskResponse struct {
+	BPI        map[string]float64 `json:"bpi"`
+	Disclaimer string             `json:"disclaimer"`
+	Time       coinDeskTime       `json:"time"`
+}
+
+type coinDeskTime struct {
+	Updated    string `json:"updated"`
+	UpdatedIso string `json:"updatedISO"`
+}
+
+// Serve /v1/bpi/historical/open.json?currency=USD&start=2017-01-01&end=2017-02-01
+//
+// Like CoinDesk, the index is a map from every date of the window to its opening price, and errors are plain text
+func (exchange *Exchange) coinDesk(responseWriter http.ResponseWriter, request *http.Request) {
+	if status, failing := exchange.failure("index"); failing {
+		http.Error(responseWriter, "Sorry, there was an error processing your request", status)
+		return
+	}
+
+	args := request.URL.Query()
+
+	currency := args.Get("currency")
+	if currency == "" {
+		currency = "USD"
+	}
+	if !coinDeskCurrencies[currency] {
+		http.Error(responseWriter, "Sorry, that currency was not found", http.StatusNotFound)
+		return
+	}
+
+	now := exchange.now()
+	end, endErr := time.Parse(dateLayout, args.Get("end"))
+	start, startErr := time.Parse(dateLayout, args.Get("start"))
+	if args.Get("start") == "" && args.Get("end") == "" {
+		end, endErr = now.UTC().Truncate(24*time.Hour), nil
+		start, startErr = end.AddDate(0, -1, 0), nil
+	}
+	if startErr != nil || endErr != nil || end.Before(start) {
+		http.Error(responseWriter, "Sorry, the start and end dates are invalid", http.StatusBadRequest)
+		return
+	}
+
+	bpi := make(map[string]float64)
+	for _, candle := range series("index", "BTC", currency, start.Unix(), end.Unix(), day, now) {
+		bpi[time.Unix(candle.timestamp, 0).UTC().Format(dateLayout)] = candle.open
+	}
+
+	updated := now.UTC()
+	writeJSON(responseWriter, http.StatusOK, coinDeskResponse{
+		BPI:        bpi,
+		Disclaimer: "Synthetic data for development; not the CoinDesk Bitcoin Price Index",
+		Time:       coinDeskTime{Updated: updated.Format("Jan 2, 2006 15:04:05 UTC"), UpdatedIso: updated.Format(time.RFC3339)},
+	})
+}
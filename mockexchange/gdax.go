@@ -0,0 +1,76 @@
+package mockexchange
+
+import (
+	"fmt"
+	"github.com/adamhei/historicaldata/trademodels"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GDAX granularities in seconds
+var gdaxGranularities = map[int64]bool{60: true, 300: true, 900: true, 3600: true, 21600: true, 86400: true}
+
+// GDAX returns at most this many buckets per request
+const gdaxMaxBuckets = 300
+
+// Serve /products/BTC-USD/candles?granularity=3600&start=...&end=... with RFC3339 times
+//
+// Like GDAX, buckets come back newest first and both ends of the window are inclusive
+func (exchange *Exchange) gdax(responseWriter http.ResponseWriter, request *http.Request) {
+	if status, failing := exchange.failure("gdax"); failing {
+		writeGdaxError(responseWriter, status, "service unavailable")
+		return
+	}
+
+	assets := strings.Split(strings.ToUpper(mux.Vars(request)["product"]), "-")
+	if len(assets) != 2 || !knownPair(assets[0], assets[1]) {
+		writeGdaxError(responseWriter, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	args := request.URL.Query()
+	granularity, err := strconv.ParseInt(args.Get("granularity"), 10, 64)
+	if err != nil || !gdaxGranularities[granularity] {
+		writeGdaxError(responseWriter, http.StatusBadRequest, "Unsupported granularity")
+		return
+	}
+
+	end := exchange.now()
+	if args.Get("end") != "" {
+		end, err = time.Parse(time.RFC3339, args.Get("end"))
+		if err != nil {
+			writeGdaxError(responseWriter, http.StatusBadRequest, fmt.Sprintf("Invalid end %s", args.Get("end")))
+			return
+		}
+	}
+
+	start := end.Add(-time.Duration(granularity*gdaxMaxBuckets) * time.Second)
+	if args.Get("start") != "" {
+		start, err = time.Parse(time.RFC3339, args.Get("start"))
+		if err != nil {
+			writeGdaxError(responseWriter, http.StatusBadRequest, fmt.Sprintf("Invalid start %s", args.Get("start")))
+			return
+		}
+	}
+
+	if end.Sub(start) > time.Duration(granularity*gdaxMaxBuckets)*time.Second {
+		writeGdaxError(responseWriter, http.StatusBadRequest, "granularity too small for the requested time range")
+		return
+	}
+
+	candles := series("gdax", assets[0], assets[1], start.Unix(), end.Unix(), granularity, exchange.now())
+	buckets := make([][]float64, len(candles))
+	for index, candle := range candles {
+		// [time, low, high, open, close, volume], newest first
+		buckets[len(candles)-1-index] = []float64{float64(candle.timestamp), candle.low, candle.high, candle.open, candle.close, candle.volume}
+	}
+
+	writeJSON(responseWriter, http.StatusOK, buckets)
+}
+
+func writeGdaxError(responseWriter http.ResponseWriter, status int, message string) {
+	writeJSON(responseWriter, status, trademodels.GdaxError{Message: message})
+}
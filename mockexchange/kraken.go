@@ -0,0 +1,113 @@
+package mockexchange
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Kraken asset codes and the assets they stand for
+var krakenAssets = map[string]string{
+	"XXBT": "BTC",
+	"XETH": "ETH",
+	"XLTC": "LTC",
+	"ZUSD": "USD",
+	"ZEUR": "EUR",
+}
+
+// Kraken intervals in minutes
+var krakenIntervals = map[int64]bool{1: true, 5: true, 15: true, 30: true, 60: true, 240: true, 1440: true, 10080: true, 21600: true}
+
+// Kraken only serves this many of the most recent buckets
+const krakenMaxBuckets = 720
+
+type krakenResponse struct {
+	Error  []string               `json:"error"`
+	Result map[string]interface{} `json:"result"`
+}
+
+// Serve /0/public/OHLC?pair=XXBTZUSD&interval=1440&since=1500000000
+//
+// Like Kraken, errors come back in the error array with 200 OK
+func (exchange *Exchange) kraken(responseWriter http.ResponseWriter, request *http.Request) {
+	if status, failing := exchange.failure("kraken"); failing {
+		writeKraken(responseWriter, status, "EService:Unavailable", nil)
+		return
+	}
+
+	args := request.URL.Query()
+	symbol := args.Get("pair")
+
+	base, quote := krakenAssets[prefix(symbol, 4)], krakenAssets[suffix(symbol, 4)]
+	if len(symbol) != 8 || !knownPair(base, quote) {
+		writeKraken(responseWriter, http.StatusOK, "EQuery:Unknown asset pair", nil)
+		return
+	}
+
+	interval := int64(1)
+	if args.Get("interval") != "" {
+		var err error
+		interval, err = strconv.ParseInt(args.Get("interval"), 10, 64)
+		if err != nil || !krakenIntervals[interval] {
+			writeKraken(responseWriter, http.StatusOK, "EGeneral:Invalid arguments", nil)
+			return
+		}
+	}
+	granularity := interval * 60
+
+	since, _ := strconv.ParseInt(args.Get("since"), 10, 64)
+	now := exchange.now().Unix()
+	if oldest := now - now%granularity - (krakenMaxBuckets-1)*granularity; since < oldest {
+		since = oldest
+	}
+
+	candles := series("kraken", base, quote, since, now, granularity, exchange.now())
+	buckets := make([][]interface{}, len(candles))
+	for index, candle := range candles {
+		buckets[index] = []interface{}{
+			candle.timestamp,
+			formatPrice(candle.open), formatPrice(candle.high), formatPrice(candle.low), formatPrice(candle.close),
+			formatPrice(candle.vwap), formatPrice(candle.volume),
+			candle.trades,
+		}
+	}
+
+	last := since
+	if len(candles) > 0 {
+		last = candles[len(candles)-1].timestamp
+	}
+	writeKraken(responseWriter, http.StatusOK, "", map[string]interface{}{symbol: buckets, "last": last})
+}
+
+func writeKraken(responseWriter http.ResponseWriter, status int, krakenError string, result map[string]interface{}) {
+	response := krakenResponse{Error: []string{}, Result: result}
+	if krakenError != "" {
+		response.Error = append(response.Error, krakenError)
+	}
+	writeJSON(responseWriter, status, response)
+}
+
+func writeJSON(responseWriter http.ResponseWriter, status int, body interface{}) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	json.NewEncoder(responseWriter).Encode(body)
+}
+
+// Exchanges send prices as strings to avoid losing precision
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', 8, 64)
+}
+
+func prefix(value string, length int) string {
+	if len(value) < length {
+		return value
+	}
+	return value[:length]
+}
+
+func suffix(value string, length int) string {
+	if len(value) < length {
+		return value
+	}
+	return value[len(value)-length:]
+}
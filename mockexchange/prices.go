@@ -0,0 +1,116 @@
+package mockexchange
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+)
+
+// The value of one unit of every asset the mock exchanges trade, in US dollars
+var usdValues = map[string]float64{
+	"BTC":  4000,
+	"ETH":  300,
+	"LTC":  50,
+	"USD":  1,
+	"USDT": 1,
+	"EUR":  1.18,
+	"GBP":  1.33,
+}
+
+// A synthetic bucket of a series
+type candle struct {
+	timestamp                            int64
+	open, high, low, close, volume, vwap float64
+	trades                               int64
+}
+
+// The price of base in quote on an exchange at a time
+//
+// Every pair follows a weekly wave shared by all exchanges, plus a small exchange-specific noise so that exchanges
+// disagree a little and there is a spread to study. Prices only depend on their arguments, so overlapping requests
+// always agree with each other.
+func price(exchange string, base string, quote string, timestamp int64) float64 {
+	// Tether tracks the dollar
+	pair := base + "-" + strings.Replace(quote, "USDT", "USD", 1)
+	week := float64(7 * 24 * time.Hour / time.Second)
+	phase := float64(hash(pair)%1000) / 1000 * 2 * math.Pi
+
+	wave := math.Sin(float64(timestamp)/week*2*math.Pi + phase)
+	return usdValues[base] / usdValues[quote] * (1 + 0.05*wave + 0.005*noise(exchange, pair, timestamp))
+}
+
+// The bucket of base in quote starting at a timestamp
+func newCandle(exchange string, base string, quote string, timestamp int64, granularity int64) candle {
+	open := price(exchange, base, quote, timestamp)
+	close := price(exchange, base, quote, timestamp+granularity)
+	// Tether tracks the dollar
+	pair := base + "-" + strings.Replace(quote, "USDT", "USD", 1)
+
+	high := math.Max(open, close) * (1 + 0.002*math.Abs(noise("high", pair, timestamp)))
+	low := math.Min(open, close) * (1 - 0.002*math.Abs(noise("low", pair, timestamp)))
+	volume := 10 + 90*math.Abs(noise("volume"+exchange, pair, timestamp))
+
+	return candle{
+		timestamp: timestamp,
+		open:      open,
+		high:      high,
+		low:       low,
+		close:     close,
+		volume:    volume,
+		vwap:      (open + high + low + close) / 4,
+		trades:    int64(volume * 3),
+	}
+}
+
+// The buckets of base in quote starting between start and end inclusive, aligned to the granularity, in ascending
+// order
+//
+// Nothing is served beyond now, like a real exchange
+func series(exchange string, base string, quote string, start int64, end int64, granularity int64, now time.Time) []candle {
+	if end > now.Unix() {
+		end = now.Unix()
+	}
+
+	first := start - start%granularity
+	if first < start {
+		first += granularity
+	}
+
+	candles := make([]candle, 0)
+	for timestamp := first; timestamp <= end; timestamp += granularity {
+		candles = append(candles, newCandle(exchange, base, quote, timestamp, granularity))
+	}
+	return candles
+}
+
+// Whether both assets of a pair are traded
+func knownPair(base string, quote string) bool {
+	_, baseOk := usdValues[base]
+	_, quoteOk := usdValues[quote]
+	return baseOk && quoteOk && base != quote
+}
+
+// Split a symbol without a separator, such as BTCUSDT, into the assets it trades
+func splitSymbol(symbol string) (string, string, bool) {
+	symbol = strings.ToUpper(symbol)
+	for quote := range usdValues {
+		base := strings.TrimSuffix(symbol, quote)
+		if base != symbol && knownPair(base, quote) {
+			return base, quote, true
+		}
+	}
+	return "", "", false
+}
+
+// A deterministic value between -1 and 1
+func noise(seed string, pair string, timestamp int64) float64 {
+	sum := hash(seed + "/" + pair + "/" + time.Unix(timestamp, 0).UTC().Format(time.RFC3339))
+	return float64(sum%20001)/10000 - 1
+}
+
+func hash(value string) uint32 {
+	sum := fnv.New32a()
+	sum.Write([]byte(value))
+	return sum.Sum32()
+}
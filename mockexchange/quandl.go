@@ -0,0 +1,112 @@
+package mockexchange
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The columns of the Quandl exchange databases
+var quandlColumns = map[string][]string{
+	"BITFINEX": {"Date", "High", "Low", "Mid", "Last", "Bid", "Ask", "Volume"},
+	"BITSTAMP": {"Date", "High", "Low", "Last", "Bid", "Ask", "Volume", "VWAP"},
+}
+
+type quandlResponse struct {
+	Dataset quandlDataset `json:"dataset"`
+}
+
+type quandlDataset struct {
+	DatasetCode         string          `json:"dataset_code"`
+	DatabaseCode        string          `json:"database_code"`
+	Name                string          `json:"name"`
+	NewestAvailableDate string          `json:"newest_available_date"`
+	ColumnNames         []string        `json:"column_names"`
+	Frequency           string          `json:"frequency"`
+	Type                string          `json:"type"`
+	StartDate           string          `json:"start_date"`
+	EndDate             string          `json:"end_date"`
+	Data                [][]interface{} `json:"data"`
+	Order               string          `json:"order"`
+}
+
+type quandlError struct {
+	Error quandlErrorBody `json:"quandl_error"`
+}
+
+type quandlErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serve /api/v3/datasets/BITFINEX/BTCUSD.json?start_date=2017-01-01&end_date=2017-02-01, and the single BITSTAMP/USD
+// dataset for BTC-USD
+//
+// Like Quandl, rows are daily and newest first, and some prices are null on days without trading
+func (exchange *Exchange) quandl(responseWriter http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	database, dataset := strings.ToUpper(vars["database"]), strings.ToUpper(vars["dataset"])
+
+	if status, failing := exchange.failure(strings.ToLower(database)); failing {
+		writeJSON(responseWriter, status, quandlError{quandlErrorBody{Code: "QEMx01", Message: "Something went wrong. Please try again later."}})
+		return
+	}
+
+	base, quote, ok := splitSymbol(dataset)
+	if database == "BITSTAMP" {
+		base, quote, ok = "BTC", dataset, dataset == "USD"
+	}
+	columns, known := quandlColumns[database]
+	if !ok || !known {
+		writeJSON(responseWriter, http.StatusNotFound, quandlError{quandlErrorBody{Code: "QECx02", Message: "You have submitted an incorrect Quandl code. Please check your Quandl codes and try again."}})
+		return
+	}
+
+	now := exchange.now()
+	args := request.URL.Query()
+	end, err := time.Parse(dateLayout, args.Get("end_date"))
+	if err != nil {
+		end = now.UTC().Truncate(24 * time.Hour)
+	}
+	start, err := time.Parse(dateLayout, args.Get("start_date"))
+	if err != nil {
+		start = end.AddDate(-1, 0, 0)
+	}
+
+	exchangeName := strings.ToLower(database)
+	candles := series(exchangeName, base, quote, start.Unix(), end.Unix(), day, now)
+	data := make([][]interface{}, len(candles))
+	for index, candle := range candles {
+		data[len(candles)-1-index] = quandlRow(database, candle)
+	}
+
+	writeJSON(responseWriter, http.StatusOK, quandlResponse{Dataset: quandlDataset{
+		DatasetCode:         dataset,
+		DatabaseCode:        database,
+		Name:                "Synthetic " + database + " " + dataset + " data",
+		NewestAvailableDate: now.UTC().Format(dateLayout),
+		ColumnNames:         columns,
+		Frequency:           "daily",
+		Type:                "Time Series",
+		StartDate:           start.Format(dateLayout),
+		EndDate:             end.Format(dateLayout),
+		Data:                data,
+		Order:               "desc",
+	}})
+}
+
+// A row of the columns of a database, leaving the bid and ask of every seventh day null like a day without quotes
+func quandlRow(database string, candle candle) []interface{} {
+	date := time.Unix(candle.timestamp, 0).UTC().Format(dateLayout)
+
+	var bid, ask interface{} = candle.close * 0.999, candle.close * 1.001
+	if (candle.timestamp/day)%7 == 0 {
+		bid, ask = nil, nil
+	}
+
+	if database == "BITFINEX" {
+		return []interface{}{date, candle.high, candle.low, candle.vwap, candle.close, bid, ask, candle.volume}
+	}
+	return []interface{}{date, candle.high, candle.low, candle.close, bid, ask, candle.volume, candle.vwap}
+}
@@ -0,0 +1,107 @@
+// Package mockexchange serves deterministic synthetic data in the formats of the exchange APIs behind the
+// datamodels sources, so that the service can be developed and tested without network
+//
+// A single server speaks every format on the same paths as the real APIs, so each source only needs its base URL
+// pointed at it: either with datamodels.SetBaseURL or with the -upstream flag printed by Server.Upstreams
+package mockexchange
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the exchanges served, as registered in datamodels
+var Exchanges = []string{"binance", "bitfinex", "bitstamp", "gdax", "index", "kraken"}
+
+// Exchange handles the requests of every mock exchange
+type Exchange struct {
+	// The newest data served; time.Now if nil
+	Now func() time.Time
+
+	mutex    sync.Mutex
+	failures map[string]int
+}
+
+// Server is an Exchange listening on a local port, for use in tests
+type Server struct {
+	*httptest.Server
+	Exchange *Exchange
+}
+
+// NewExchange returns an Exchange which answers every request successfully
+func NewExchange() *Exchange {
+	return &Exchange{failures: make(map[string]int)}
+}
+
+// NewServer starts a Server on a local port, which the caller must Close
+func NewServer() *Server {
+	exchange := NewExchange()
+	return &Server{Server: httptest.NewServer(exchange.Handler()), Exchange: exchange}
+}
+
+// Upstreams returns the value of the -upstream flag which points every exchange at the server
+func (server *Server) Upstreams() string {
+	return Upstreams(server.URL)
+}
+
+// Upstreams returns the value of the -upstream flag which points every exchange at baseURL
+func Upstreams(baseURL string) string {
+	overrides := make([]string, len(Exchanges))
+	for index, name := range Exchanges {
+		overrides[index] = fmt.Sprintf("%s=%s", name, baseURL)
+	}
+	return strings.Join(overrides, ",")
+}
+
+// Fail makes every following request to the named exchange fail with the given status code and the error body of
+// that exchange, e.g. Kraken's error array or a GDAX message
+//
+// Kraken reports most of its errors with 200 OK, so Fail("kraken", http.StatusOK) exercises its error array
+func (exchange *Exchange) Fail(name string, status int) {
+	exchange.mutex.Lock()
+	defer exchange.mutex.Unlock()
+	if exchange.failures == nil {
+		exchange.failures = make(map[string]int)
+	}
+	exchange.failures[name] = status
+}
+
+// Recover makes the named exchange answer successfully again
+func (exchange *Exchange) Recover(name string) {
+	exchange.mutex.Lock()
+	defer exchange.mutex.Unlock()
+	delete(exchange.failures, name)
+}
+
+// Handler routes the paths of every exchange API to its mock
+func (exchange *Exchange) Handler() http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/0/public/OHLC", exchange.kraken).Methods(http.MethodGet)
+	router.HandleFunc("/products/{product}/candles", exchange.gdax).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/klines", exchange.binance).Methods(http.MethodGet)
+	router.HandleFunc("/v1/bpi/historical/open.json", exchange.coinDesk).Methods(http.MethodGet)
+	router.HandleFunc("/api/v3/datasets/{database}/{dataset}.json", exchange.quandl).Methods(http.MethodGet)
+
+	return router
+}
+
+// The status code the named exchange has been told to fail with, if any
+func (exchange *Exchange) failure(name string) (int, bool) {
+	exchange.mutex.Lock()
+	defer exchange.mutex.Unlock()
+	status, ok := exchange.failures[name]
+	return status, ok
+}
+
+func (exchange *Exchange) now() time.Time {
+	if exchange.Now != nil {
+		return exchange.Now()
+	}
+	return time.Now()
+}
@@ -11,13 +11,17 @@ import (
 type route struct {
 	Name, Method, Path string
 	HandlerFunc        http.HandlerFunc
+	// Whether the route reads MongoDB
+	NeedsMongo bool
 }
 
 // NewRouter constructs and returns a mux Router with all routes in the API
 func NewRouter(appContext *handlers.AppContext) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(handlers.WithRequestID, appContext.LogRequests)
 
 	for _, r := range getRoutes(appContext) {
+		appContext.MongoRequired = appContext.MongoRequired || r.NeedsMongo
 		router.Methods(r.Method).
 			Path(r.Path).
 			Name(r.Name).
@@ -40,42 +44,97 @@ func getRoutes(appContext *handlers.AppContext) []route {
 		//	Path:        "/historical/gemini",
 		//	Name:        "Gemini Historical",
 		//	HandlerFunc: appContext.GeminiHistorical,
+		//	NeedsMongo:  true,
 		//},
 		{
 			Method:      http.MethodGet,
-			Path:        "/historical/gdax/{interval}",
-			Name:        "GDAX Historical",
-			HandlerFunc: appContext.GdaxHistorical,
+			Path:        "/historical",
+			Name:        "Supported exchanges and intervals",
+			HandlerFunc: appContext.Exchanges,
 		},
 		{
 			Method:      http.MethodGet,
-			Path:        "/historical/kraken/{interval}",
-			Name:        "Kraken Historical",
-			HandlerFunc: appContext.KrakenHistorical,
+			Path:        "/historical/{exchange}/{interval}",
+			Name:        "Exchange Historical",
+			HandlerFunc: appContext.Historical,
 		},
 		{
 			Method:      http.MethodGet,
-			Path:        "/historical/bitfinex/{interval}",
-			Name:        "Bitfinex Historical",
-			HandlerFunc: appContext.BitfinexHistorical,
+			Path:        "/historical/{exchange}/{pair}/{interval}",
+			Name:        "Exchange Pair Historical",
+			HandlerFunc: appContext.Historical,
 		},
 		{
 			Method:      http.MethodGet,
-			Path:        "/historical/index/{interval}",
-			Name:        "Index Price (from CoinDesk)",
-			HandlerFunc: appContext.CoinDeskHistorical,
+			Path:        "/candles/{exchange}/{interval}",
+			Name:        "Exchange Candles",
+			HandlerFunc: appContext.Candles,
 		},
 		{
 			Method:      http.MethodGet,
-			Path:        "/historical/binance/{interval}",
-			Name:        "Binance Historical",
-			HandlerFunc: appContext.BinanceHistorical,
+			Path:        "/candles/{exchange}/{pair}/{interval}",
+			Name:        "Exchange Pair Candles",
+			HandlerFunc: appContext.Candles,
 		},
 		{
 			Method:      http.MethodGet,
-			Path:        "/historical/bitstamp/{interval}",
-			Name:        "Bitstamp Historical",
-			HandlerFunc: appContext.BitstampHistorical,
+			Path:        "/arbitrage/{exchangeA}/{exchangeB}/{interval}",
+			Name:        "Arbitrage Spread",
+			HandlerFunc: appContext.Arbitrage,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/arbitrage/{exchangeA}/{exchangeB}/{pair}/{interval}",
+			Name:        "Arbitrage Pair Spread",
+			HandlerFunc: appContext.Arbitrage,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/compare/{interval}",
+			Name:        "Exchange Comparison",
+			HandlerFunc: appContext.Compare,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/compare/{pair}/{interval}",
+			Name:        "Exchange Pair Comparison",
+			HandlerFunc: appContext.Compare,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/status",
+			Name:        "Upstream Status",
+			HandlerFunc: appContext.Status,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/healthz",
+			Name:        "Health",
+			HandlerFunc: appContext.Healthz,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/readyz",
+			Name:        "Readiness",
+			HandlerFunc: appContext.Readyz,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/metrics",
+			Name:        "Metrics",
+			HandlerFunc: appContext.Metrics,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/live",
+			Name:        "Live Prices and Spread",
+			HandlerFunc: appContext.Live,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/live/{exchange}",
+			Name:        "Exchange Live Price",
+			HandlerFunc: appContext.LiveExchange,
 		},
 	}
 }
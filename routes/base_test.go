@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"github.com/adamhei/historicalapi/handlers"
+	"testing"
+)
+
+func TestNewRouterRequiresMongoOnlyForItsRoutes(t *testing.T) {
+	appContext := new(handlers.AppContext)
+	NewRouter(appContext)
+
+	needsMongo := false
+	for _, r := range getRoutes(appContext) {
+		needsMongo = needsMongo || r.NeedsMongo
+	}
+	if appContext.MongoRequired != needsMongo {
+		t.Errorf("MongoRequired = %t, want %t for the mounted routes", appContext.MongoRequired, needsMongo)
+	}
+}
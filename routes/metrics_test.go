@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/adamhei/historicalapi/datamodels"
+	"github.com/adamhei/historicalapi/handlers"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountFailingUpstreams(t *testing.T) {
+	// Answers every request with a body no adapter can parse
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(responseWriter, "{not json")
+	}))
+	defer server.Close()
+	router := NewRouter(new(handlers.AppContext))
+
+	tests := []struct {
+		exchange string
+		path     string
+	}{
+		{exchange: "binance", path: "/historical/binance/day"},
+		// Quandl requests are counted under the exchange of their dataset
+		{exchange: "bitstamp", path: "/historical/bitstamp/month"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.exchange, func(t *testing.T) {
+			for _, status := range datamodels.UpstreamStatuses() {
+				if status.Exchange == test.exchange {
+					datamodels.SetBaseURL(test.exchange, server.URL)
+					defer datamodels.SetBaseURL(test.exchange, status.BaseURL)
+				}
+			}
+
+			series := []string{
+				`historicalapi_requests_total{method="GET",route="/historical/{exchange}/{interval}",status="502"}`,
+				fmt.Sprintf(`historicalapi_upstream_requests_total{exchange="%s",status="200"}`, test.exchange),
+				fmt.Sprintf(`historicalapi_parse_failures_total{exchange="%s"}`, test.exchange),
+			}
+			before := scrapeMetrics(t, router)
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if recorder.Code != http.StatusBadGateway {
+				t.Fatalf("GET %s answered %d, want %d", test.path, recorder.Code, http.StatusBadGateway)
+			}
+
+			after := scrapeMetrics(t, router)
+			for _, name := range series {
+				if counted := after[name] - before[name]; counted != 1 {
+					t.Errorf("%s went up by %g, want 1", name, counted)
+				}
+			}
+		})
+	}
+}
+
+// The value of every series served on /metrics, by name and labels
+func scrapeMetrics(t *testing.T, router *mux.Router) map[string]float64 {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		separator := strings.LastIndex(line, " ")
+		if strings.HasPrefix(line, "#") || separator < 0 {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(line[separator+1:], 64)
+		if err != nil {
+			t.Fatalf("could not parse the metric %q: %s", line, err)
+		}
+		values[line[:separator]] = value
+	}
+	return values
+}